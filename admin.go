@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultAdminBind is the address the admin API listens on unless configured
+// otherwise: it can control any call, so it is not exposed by default
+const defaultAdminBind = "127.0.0.1"
+
+// errAudioSourceNotAllowed rejects prompt sources outside the allowed places
+var errAudioSourceNotAllowed = errors.New("audio source not allowed")
+
+// AdminConfig configures the admin API
+type AdminConfig struct {
+	Bind  string // Listen address, defaults to defaultAdminBind
+	Port  int
+	Token string // Bearer token, required unless listening on loopback
+	// Where played prompts may come from: files under AudioDir and URLs
+	// under one of AudioURLs. Any other source is refused.
+	AudioDir  string
+	AudioURLs []string
+}
+
+// Validate checks that the admin API is not exposed beyond this host
+// without a token
+func (c AdminConfig) Validate() error {
+	if c.Token == "" && !isLoopbackHost(c.bind()) {
+		return fmt.Errorf("an admin token is required when the admin API listens on %s", c.bind())
+	}
+	return nil
+}
+
+// bind returns the listen address
+func (c AdminConfig) bind() string {
+	if c.Bind == "" {
+		return defaultAdminBind
+	}
+	return c.Bind
+}
+
+// isLoopbackHost reports whether host only accepts local connections
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// resolveAudio maps a prompt source of a play request to the file or URL to
+// load. Files are resolved under AudioDir, which they cannot escape, and URLs
+// must share the scheme and host of an allowed URL and lie under its path.
+func (c AdminConfig) resolveAudio(source string) (string, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		requested, err := url.Parse(source)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errAudioSourceNotAllowed, err)
+		}
+		// Dot segments must not climb out of the allowed path
+		requested.Path = path.Clean("/" + requested.Path)
+		requested.RawPath = ""
+		for _, allowed := range c.AudioURLs {
+			prefix, err := url.Parse(allowed)
+			if err != nil {
+				continue
+			}
+			if requested.Scheme == prefix.Scheme && requested.Host == prefix.Host && requested.User == nil &&
+				strings.HasPrefix(requested.Path, strings.TrimSuffix(prefix.Path, "/")+"/") {
+				return requested.String(), nil
+			}
+		}
+		return "", fmt.Errorf("%w: URL is not under --admin-audio-urls", errAudioSourceNotAllowed)
+	}
+
+	if c.AudioDir == "" {
+		return "", fmt.Errorf("%w: no --admin-audio-dir is configured", errAudioSourceNotAllowed)
+	}
+	dir, err := filepath.Abs(c.AudioDir)
+	if err != nil {
+		return "", err
+	}
+	// Relative sources are relative to the directory; absolute ones must lie in it
+	file := source
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	if !isWithinDir(dir, file) {
+		return "", fmt.Errorf("%w: file is outside --admin-audio-dir", errAudioSourceNotAllowed)
+	}
+	// Symlinks in the directory must not lead out of it either
+	if resolved, err := filepath.EvalSymlinks(file); err == nil {
+		if realDir, err := filepath.EvalSymlinks(dir); err == nil && !isWithinDir(realDir, resolved) {
+			return "", fmt.Errorf("%w: file is outside --admin-audio-dir", errAudioSourceNotAllowed)
+		}
+	}
+	return file, nil
+}
+
+// isWithinDir reports whether file lies inside dir
+func isWithinDir(dir, file string) bool {
+	rel, err := filepath.Rel(dir, filepath.Clean(file))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// AdminServer exposes an HTTP API for controlling live calls
+type AdminServer struct {
+	config    AdminConfig
+	sipServer *SIPServer
+	server    *http.Server
+}
+
+// PlayRequest is the body of a play request
+type PlayRequest struct {
+	Audio     string `json:"audio"`               // WAV path or http(s) URL
+	Loop      bool   `json:"loop,omitempty"`      // Repeat until stopped
+	Interrupt bool   `json:"interrupt,omitempty"` // Drop audio already queued, e.g. the AI's speech
+}
+
+// WebRTCSignal is an SDP offer or answer, in the shape of a browser's
+// RTCSessionDescription, with the participant's role
+type WebRTCSignal struct {
+	ID   string `json:"id,omitempty"` // Participant ID, set on answers
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+	SupervisorRole
+}
+
+// NewAdminServer creates an admin API server. If a token is set, requests
+// must carry it as a bearer token.
+func NewAdminServer(config AdminConfig, sipServer *SIPServer) *AdminServer {
+	a := &AdminServer{
+		config:    config,
+		sipServer: sipServer,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /sessions/{call_id}/play", a.authorize(a.handlePlay))
+	mux.HandleFunc("DELETE /sessions/{call_id}/play", a.authorize(a.handleStopPlay))
+	// Joining a call lets a browser listen in and talk, so WebRTC always
+	// requires the token, even when the rest of the API is left open locally
+	mux.HandleFunc("POST /sessions/{call_id}/webrtc", a.requireToken(a.handleWebRTCJoin))
+	mux.HandleFunc("DELETE /sessions/{call_id}/webrtc/{participant_id}", a.requireToken(a.handleWebRTCLeave))
+	mux.HandleFunc("PUT /sessions/{call_id}/webrtc/{participant_id}/role", a.requireToken(a.handleSetRole))
+	mux.HandleFunc("GET /metrics", a.authorize(a.handleMetrics))
+
+	a.server = &http.Server{
+		Addr:              net.JoinHostPort(config.bind(), strconv.Itoa(config.Port)),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return a
+}
+
+// Start begins listening for admin requests
+func (a *AdminServer) Start() error {
+	slog.Info("Starting admin server",
+		"event", "admin_server_start",
+		"address", a.server.Addr,
+		"auth", a.config.Token != "")
+
+	go func() {
+		if err := a.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("Admin server error",
+				"event", "admin_server_error",
+				"error", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// Stop shuts the admin server down
+func (a *AdminServer) Stop() error {
+	return a.server.Close()
+}
+
+// authorize rejects requests without the configured bearer token
+func (a *AdminServer) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.config.Token != "" {
+			expected := "Bearer " + a.config.Token
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+				slog.Warn("Unauthorized admin request",
+					"event", "admin_unauthorized",
+					"remote_addr", r.RemoteAddr,
+					"path", r.URL.Path)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// requireToken is authorize for endpoints that must never be served without
+// a token. Without a configured token they are refused.
+func (a *AdminServer) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	authorized := a.authorize(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.config.Token == "" {
+			slog.Warn("Refused admin request needing a token",
+				"event", "admin_token_required",
+				"remote_addr", r.RemoteAddr,
+				"path", r.URL.Path)
+			http.Error(w, "This endpoint requires --admin-token to be set", http.StatusForbidden)
+			return
+		}
+		authorized(w, r)
+	}
+}
+
+// handlePlay starts playing a prompt to the caller, replacing any prompt in progress
+func (a *AdminServer) handlePlay(w http.ResponseWriter, r *http.Request) {
+	callID := r.PathValue("call_id")
+	session := a.sipServer.getSession(callID)
+	if session == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	var req PlayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Audio == "" {
+		http.Error(w, `Body must be JSON with an "audio" path or URL`, http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("Admin play request",
+		"event", "admin_play",
+		"session", callID,
+		"audio", req.Audio,
+		"loop", req.Loop,
+		"interrupt", req.Interrupt)
+
+	source, err := a.config.resolveAudio(req.Audio)
+	if err != nil {
+		slog.Warn("Refused admin prompt source",
+			"event", "admin_play_forbidden",
+			"session", callID,
+			"audio", req.Audio,
+			"remote_addr", r.RemoteAddr,
+			"error", err.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if _, err := session.promptPlayer.Play(source, req.Loop, req.Interrupt); err != nil {
+		slog.Error("Failed to play prompt",
+			"event", "admin_play_error",
+			"session", callID,
+			"audio", req.Audio,
+			"error", err.Error())
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleStopPlay stops the prompt currently playing to the caller
+func (a *AdminServer) handleStopPlay(w http.ResponseWriter, r *http.Request) {
+	callID := r.PathValue("call_id")
+	session := a.sipServer.getSession(callID)
+	if session == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	session.promptPlayer.Stop()
+
+	slog.Info("Admin stop play request",
+		"event", "admin_play_stop",
+		"session", callID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWebRTCJoin answers a browser's SDP offer and joins it to the call
+func (a *AdminServer) handleWebRTCJoin(w http.ResponseWriter, r *http.Request) {
+	callID := r.PathValue("call_id")
+	session := a.sipServer.getSession(callID)
+	if session == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	var offer WebRTCSignal
+	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil || offer.Type != "offer" || offer.SDP == "" {
+		http.Error(w, `Body must be JSON with "type": "offer" and an "sdp"`, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := offer.SupervisorRole.normalize(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	participant, answer, err := a.sipServer.webrtc.Join(session, offer.SDP, offer.SupervisorRole)
+	if errors.Is(err, errBridgeNotMixing) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to join WebRTC participant",
+			"event", "webrtc_join_error",
+			"session", callID,
+			"error", err.Error())
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/sessions/%s/webrtc/%s", callID, participant.ID()))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(WebRTCSignal{
+		ID:             participant.ID(),
+		Type:           "answer",
+		SDP:            answer,
+		SupervisorRole: participant.Role(),
+	})
+}
+
+// handleWebRTCLeave disconnects a browser participant
+func (a *AdminServer) handleWebRTCLeave(w http.ResponseWriter, r *http.Request) {
+	callID := r.PathValue("call_id")
+	session := a.sipServer.getSession(callID)
+	if session == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	participant := session.webrtcParticipant(r.PathValue("participant_id"))
+	if participant == nil {
+		http.Error(w, "Participant not found", http.StatusNotFound)
+		return
+	}
+
+	participant.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSetRole switches a browser participant between listen, whisper and barge
+func (a *AdminServer) handleSetRole(w http.ResponseWriter, r *http.Request) {
+	callID := r.PathValue("call_id")
+	session := a.sipServer.getSession(callID)
+	if session == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	participant := session.webrtcParticipant(r.PathValue("participant_id"))
+	if participant == nil {
+		http.Error(w, "Participant not found", http.StatusNotFound)
+		return
+	}
+
+	var req SupervisorRole
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `Body must be JSON with a "role"`, http.StatusBadRequest)
+		return
+	}
+
+	role, err := participant.SetRole(req)
+	if err != nil {
+		if err == io.ErrClosedPipe {
+			http.Error(w, "Participant not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(role)
+}
+
+// handleMetrics serves metrics in the Prometheus text exposition format
+func (a *AdminServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(w)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminConfigValidate(t *testing.T) {
+	tests := []struct {
+		bind    string
+		token   string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"127.0.0.1", "", false},
+		{"::1", "", false},
+		{"localhost", "", false},
+		{"0.0.0.0", "", true},
+		{"", "secret", false},
+		{"0.0.0.0", "secret", false},
+		{"10.1.2.3", "", true},
+	}
+	for _, tt := range tests {
+		err := AdminConfig{Bind: tt.bind, Port: 8081, Token: tt.token}.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("bind %q token %q: error %v, want error %v", tt.bind, tt.token, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAdminConfigResolveAudio(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret.wav"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.wav"), filepath.Join(dir, "link.wav")); err != nil {
+		t.Fatal(err)
+	}
+
+	config := AdminConfig{
+		AudioDir:  dir,
+		AudioURLs: []string{"https://cdn.example.com/prompts/"},
+	}
+	tests := []struct {
+		source string
+		want   string // Empty if refused
+	}{
+		{"hold.wav", filepath.Join(dir, "hold.wav")},
+		{"sub/hold.wav", filepath.Join(dir, "sub/hold.wav")},
+		{filepath.Join(dir, "hold.wav"), filepath.Join(dir, "hold.wav")},
+		{"../hold.wav", ""},
+		{"/etc/passwd", ""},
+		{"link.wav", ""},
+		{"https://cdn.example.com/prompts/hold.wav", "https://cdn.example.com/prompts/hold.wav"},
+		{"https://cdn.example.com/prompts/../admin/secret.wav", ""},
+		{"https://cdn.example.com/other.wav", ""},
+		{"https://cdn.example.com.evil.test/prompts/hold.wav", ""},
+		{"http://cdn.example.com/prompts/hold.wav", ""},
+		{"http://169.254.169.254/latest/meta-data/", ""},
+	}
+	for _, tt := range tests {
+		got, err := config.resolveAudio(tt.source)
+		if tt.want == "" {
+			if !errors.Is(err, errAudioSourceNotAllowed) {
+				t.Errorf("%q: resolved to %q, want it refused (error %v)", tt.source, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.source, got, err, tt.want)
+		}
+	}
+
+	// Without an audio directory no file can be played
+	if _, err := (AdminConfig{}).resolveAudio("hold.wav"); !errors.Is(err, errAudioSourceNotAllowed) {
+		t.Errorf("file played without --admin-audio-dir: %v", err)
+	}
+}
+
+func TestAdminWebRTCRequiresToken(t *testing.T) {
+	tests := []struct {
+		token  string
+		header string
+		want   int
+	}{
+		{"", "", http.StatusForbidden},
+		{"", "Bearer anything", http.StatusForbidden},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusNotFound}, // Authorized, but no such call
+	}
+	for _, tt := range tests {
+		admin := NewAdminServer(AdminConfig{Token: tt.token}, &SIPServer{sessions: make(map[string]*Session)})
+		for _, req := range []*http.Request{
+			httptest.NewRequest("POST", "/sessions/call-1/webrtc", strings.NewReader(`{"type":"offer","sdp":"v=0"}`)),
+			httptest.NewRequest("DELETE", "/sessions/call-1/webrtc/p1", nil),
+			httptest.NewRequest("PUT", "/sessions/call-1/webrtc/p1/role", strings.NewReader(`{"role":"listen"}`)),
+		} {
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			admin.server.Handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("token %q, %s %s with %q: status %d, want %d", tt.token, req.Method, req.URL.Path, tt.header, rec.Code, tt.want)
+			}
+		}
+	}
+
+	// Without a token, the rest of the API stays usable on loopback
+	admin := NewAdminServer(AdminConfig{}, &SIPServer{sessions: make(map[string]*Session)})
+	rec := httptest.NewRecorder()
+	admin.server.Handler.ServeHTTP(rec, httptest.NewRequest("DELETE", "/sessions/call-1/play", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("stop play without a token: status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminWebRTCJoinRequiresMixingBridge(t *testing.T) {
+	session := &Session{CallID: "call-1", MediaBridge: NewMediaBridge(BridgeConfig{Mode: BridgeModeForward})}
+	server := &SIPServer{sessions: map[string]*Session{session.CallID: session}}
+	admin := NewAdminServer(AdminConfig{Token: "secret"}, server)
+
+	for _, role := range []string{RoleListen, RoleBarge, RoleWhisper} {
+		body := `{"type":"offer","sdp":"v=0","role":"` + role + `"}`
+		if role == RoleWhisper {
+			body = `{"type":"offer","sdp":"v=0","role":"whisper","target":"ai"}`
+		}
+		req := httptest.NewRequest("POST", "/sessions/call-1/webrtc", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		admin.server.Handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusConflict {
+			t.Errorf("%s join on a forward bridge: status %d, want %d", role, rec.Code, http.StatusConflict)
+		}
+	}
+}
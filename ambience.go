@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultAmbienceLevelDBFS is the ambience level used when none is configured
+const defaultAmbienceLevelDBFS = -40.0
+
+// AmbienceConfig selects a background track mixed under the audio sent to the caller
+type AmbienceConfig struct {
+	Audio     string  `json:"audio"`                // WAV path or URL, looped
+	LevelDBFS float64 `json:"level_dbfs,omitempty"` // RMS level of the track in the mix, e.g. -40
+}
+
+// ambienceTrack is a decoded ambience track, shared by every call that uses it
+type ambienceTrack struct {
+	samples []int16
+	rms     float64 // RMS of samples, relative to full scale
+}
+
+// ambienceLoad is a track being loaded, or loaded, for one source and sample rate
+type ambienceLoad struct {
+	done  chan struct{} // Closed once track or err is set
+	track *ambienceTrack
+	err   error
+}
+
+// ambienceCache decodes each ambience source once. Calls that start while a
+// source is loading wait for that load instead of starting their own. Failed
+// loads are not cached, so a fixed file or URL is picked up by the next call.
+type ambienceCache struct {
+	loads map[string]*ambienceLoad
+	mu    sync.Mutex
+}
+
+// ambienceTracks is the process-wide cache of ambience tracks
+var ambienceTracks = &ambienceCache{loads: make(map[string]*ambienceLoad)}
+
+// get returns the decoded track of source at sampleRate, loading it if needed
+func (c *ambienceCache) get(source string, sampleRate int) (*ambienceTrack, error) {
+	key := fmt.Sprintf("%d:%s", sampleRate, source)
+
+	c.mu.Lock()
+	load := c.loads[key]
+	if load == nil {
+		load = &ambienceLoad{done: make(chan struct{})}
+		c.loads[key] = load
+		c.mu.Unlock()
+
+		load.track, load.err = loadAmbienceTrack(source, sampleRate)
+		if load.err != nil {
+			c.mu.Lock()
+			delete(c.loads, key)
+			c.mu.Unlock()
+		}
+		close(load.done)
+	} else {
+		c.mu.Unlock()
+		<-load.done
+	}
+
+	return load.track, load.err
+}
+
+// loadAmbienceTrack decodes source and measures its level
+func loadAmbienceTrack(source string, sampleRate int) (*ambienceTrack, error) {
+	pcmData, err := loadAudio(source, sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	samples := pcmToSamples(pcmData)
+
+	var power float64
+	for _, sample := range samples {
+		power += float64(sample) * float64(sample)
+	}
+	if len(samples) == 0 || power == 0 {
+		return nil, fmt.Errorf("ambience track %s is silent", source)
+	}
+
+	return &ambienceTrack{
+		samples: samples,
+		rms:     math.Sqrt(power/float64(len(samples))) / 32768,
+	}, nil
+}
+
+// AmbienceMixer loops a background track (e.g. office noise) under the outgoing
+// audio. It is driven by the session's media clock, so it keeps playing through
+// silence and is unaffected by queue flushes on interruption.
+type AmbienceMixer struct {
+	track    atomic.Pointer[ambienceTrack] // Nil until loaded
+	gain     float64                       // Brings the track to the configured level
+	position int
+}
+
+// NewAmbienceMixer returns a mixer that starts playing once its track has
+// loaded in the background, or nil if config is nil. A track that fails to
+// load is logged and the call continues without ambience.
+func NewAmbienceMixer(config *AmbienceConfig, sampleRate int, sessionID string) *AmbienceMixer {
+	if config == nil || config.Audio == "" {
+		return nil
+	}
+
+	level := config.LevelDBFS
+	if level == 0 {
+		level = defaultAmbienceLevelDBFS
+	}
+
+	a := &AmbienceMixer{}
+	go func() {
+		track, err := ambienceTracks.get(config.Audio, sampleRate)
+		if err != nil {
+			slog.Error("Failed to load ambience track",
+				"event", "ambience_load_error",
+				"session", sessionID,
+				"audio", config.Audio,
+				"error", err.Error())
+			return
+		}
+
+		// Scale the track so its RMS sits at the configured level regardless
+		// of how loud the file itself is. The gain is written before the
+		// track is published, so Mix never sees one without the other.
+		a.gain = dbToLinear(level) / track.rms
+		a.track.Store(track)
+
+		slog.Info("Ambience enabled",
+			"event", "ambience_enabled",
+			"session", sessionID,
+			"audio", config.Audio,
+			"level_dbfs", level,
+			"track_seconds", float64(len(track.samples))/float64(sampleRate))
+	}()
+
+	return a
+}
+
+// Mix adds the next stretch of the ambience track to samples in place. It
+// does nothing until the track has loaded.
+func (a *AmbienceMixer) Mix(samples []int16) {
+	track := a.track.Load()
+	if track == nil {
+		return
+	}
+
+	for i, sample := range samples {
+		samples[i] = clampSample(float64(sample) + float64(track.samples[a.position])*a.gain)
+		a.position++
+		if a.position == len(track.samples) {
+			a.position = 0
+		}
+	}
+}
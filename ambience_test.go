@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ambienceWAV is a second of a 400Hz tone as a stereo WAV file
+func ambienceWAV() []byte {
+	samples := make([]int16, 2*recordingSampleRate)
+	for i := 0; i < len(samples); i += 2 {
+		v := int16(8000 * math.Sin(2*math.Pi*400*float64(i/2)/recordingSampleRate))
+		samples[i], samples[i+1] = v, v
+	}
+	data := make([]byte, len(samples)*2)
+	samplesToPCM(samples, data)
+	return append(wavHeader(uint32(len(data))), data...)
+}
+
+func TestAmbienceTrackLoadedOncePerSource(t *testing.T) {
+	var requests atomic.Int32
+	wav := ambienceWAV()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(50 * time.Millisecond) // Let the calls overlap
+		w.Write(wav)
+	}))
+	defer server.Close()
+
+	config := &AmbienceConfig{Audio: server.URL + "/office.wav"}
+	var wg sync.WaitGroup
+	mixers := make([]*AmbienceMixer, 5)
+	for i := range mixers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mixers[i] = NewAmbienceMixer(config, 8000, "ambience-test")
+		}(i)
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for _, mixer := range mixers {
+		for mixer.track.Load() == nil {
+			if time.Now().After(deadline) {
+				t.Fatal("ambience track not loaded")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if mixer.track.Load() != mixers[0].track.Load() {
+			t.Fatal("calls did not share the decoded track")
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("track fetched %d times, want once", n)
+	}
+
+	// A later call reuses the cached track
+	mixer := NewAmbienceMixer(config, 8000, "ambience-test")
+	for mixer.track.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("cached ambience track not loaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("track fetched %d times after it was cached, want once", n)
+	}
+}
+
+func TestAmbienceMixerSilentUntilLoaded(t *testing.T) {
+	mixer := &AmbienceMixer{}
+	samples := make([]int16, rtpSamplesPerFrame)
+	mixer.Mix(samples)
+	for _, sample := range samples {
+		if sample != 0 {
+			t.Fatal("mixed before the track loaded")
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "office.wav")
+	if err := os.WriteFile(path, ambienceWAV(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	track, err := loadAmbienceTrack(path, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mixer.gain = dbToLinear(-40) / track.rms
+	mixer.track.Store(track)
+
+	var power float64
+	samples = make([]int16, 8000)
+	mixer.Mix(samples)
+	for _, sample := range samples {
+		power += float64(sample) * float64(sample)
+	}
+	level := 20 * math.Log10(math.Sqrt(power/float64(len(samples)))/32768)
+	if math.Abs(level+40) > 0.5 {
+		t.Fatalf("ambience mixed at %.1f dBFS, want -40", level)
+	}
+}
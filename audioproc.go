@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"math/cmplx"
+)
+
+// AudioProcessor transforms a frame of 16-bit mono PCM samples in place.
+// Processors are stateful and expect to see a continuous stream.
+type AudioProcessor interface {
+	Process(samples []int16)
+}
+
+// AudioProcessingConfig selects the processing applied to caller audio before
+// it is forwarded to the AI. Every stage is off unless enabled.
+type AudioProcessingConfig struct {
+	HighPass           bool    `json:"high_pass"`
+	HighPassCutoffHz   float64 `json:"high_pass_cutoff_hz,omitempty"`
+	NoiseSuppression   bool    `json:"noise_suppression"`
+	NoiseSuppressionDB float64 `json:"noise_suppression_db,omitempty"` // Maximum attenuation of noise
+	AGC                bool    `json:"agc"`
+	AGCTargetDBFS      float64 `json:"agc_target_dbfs,omitempty"`
+	AGCMaxGainDB       float64 `json:"agc_max_gain_db,omitempty"`
+	ClipDetection      bool    `json:"clip_detection"`
+}
+
+const (
+	defaultHighPassCutoffHz   = 100.0
+	defaultNoiseSuppressionDB = 15.0
+	defaultAGCTargetDBFS      = -20.0
+	defaultAGCMaxGainDB       = 20.0
+)
+
+// AudioProcessingChain runs a sequence of processors over each frame
+type AudioProcessingChain struct {
+	processors []AudioProcessor
+}
+
+// NewAudioProcessingChain builds the caller-side chain for a session. The stages
+// run in a fixed order: clipping detection on the raw signal, high-pass filter,
+// noise suppression and finally gain control. It returns nil when no stage is
+// enabled so callers can skip the conversion to samples entirely.
+func NewAudioProcessingChain(config *AudioProcessingConfig, sampleRate int, sessionID string) *AudioProcessingChain {
+	if config == nil {
+		return nil
+	}
+
+	chain := &AudioProcessingChain{}
+	if config.ClipDetection {
+		chain.Add(NewClipDetector(sessionID))
+	}
+	if config.HighPass {
+		cutoff := config.HighPassCutoffHz
+		if cutoff <= 0 {
+			cutoff = defaultHighPassCutoffHz
+		}
+		chain.Add(NewHighPassFilter(cutoff, sampleRate))
+	}
+	if config.NoiseSuppression {
+		attenuation := config.NoiseSuppressionDB
+		if attenuation <= 0 {
+			attenuation = defaultNoiseSuppressionDB
+		}
+		chain.Add(NewNoiseSuppressor(attenuation))
+	}
+	if config.AGC {
+		target := config.AGCTargetDBFS
+		if target == 0 {
+			target = defaultAGCTargetDBFS
+		}
+		maxGain := config.AGCMaxGainDB
+		if maxGain <= 0 {
+			maxGain = defaultAGCMaxGainDB
+		}
+		chain.Add(NewAutomaticGainControl(target, maxGain))
+	}
+
+	if len(chain.processors) == 0 {
+		return nil
+	}
+	return chain
+}
+
+// Add appends a processor to the end of the chain
+func (c *AudioProcessingChain) Add(processor AudioProcessor) {
+	c.processors = append(c.processors, processor)
+}
+
+// Process runs every processor over the frame in order
+func (c *AudioProcessingChain) Process(samples []int16) {
+	for _, processor := range c.processors {
+		processor.Process(samples)
+	}
+}
+
+// ProcessPCM runs the chain over little-endian 16-bit PCM in place
+func (c *AudioProcessingChain) ProcessPCM(pcmData []byte) {
+	samples := pcmToSamples(pcmData)
+	c.Process(samples)
+	samplesToPCM(samples, pcmData)
+}
+
+// pcmToSamples converts little-endian 16-bit PCM bytes to samples
+func pcmToSamples(pcmData []byte) []int16 {
+	samples := make([]int16, len(pcmData)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(pcmData[2*i:]))
+	}
+	return samples
+}
+
+// samplesToPCM writes samples as little-endian 16-bit PCM into dst
+func samplesToPCM(samples []int16, dst []byte) {
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(dst[2*i:], uint16(sample))
+	}
+}
+
+// clampSample saturates a float sample to the 16-bit range
+func clampSample(v float64) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(math.Round(v))
+}
+
+// dbToLinear converts decibels to a linear amplitude ratio
+func dbToLinear(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+// HighPassFilter removes rumble and DC offset with a second-order Butterworth biquad
+type HighPassFilter struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+// NewHighPassFilter creates a high-pass filter with the given cutoff frequency
+func NewHighPassFilter(cutoffHz float64, sampleRate int) *HighPassFilter {
+	// RBJ audio EQ cookbook coefficients with Q = 1/sqrt(2)
+	w0 := 2 * math.Pi * cutoffHz / float64(sampleRate)
+	alpha := math.Sin(w0) / math.Sqrt2 // sin(w0) / (2Q)
+	cosW0 := math.Cos(w0)
+	a0 := 1 + alpha
+
+	return &HighPassFilter{
+		b0: (1 + cosW0) / 2 / a0,
+		b1: -(1 + cosW0) / a0,
+		b2: (1 + cosW0) / 2 / a0,
+		a1: -2 * cosW0 / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+// Process filters the frame in place
+func (f *HighPassFilter) Process(samples []int16) {
+	for i, sample := range samples {
+		x := float64(sample)
+		y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+		f.x2, f.x1 = f.x1, x
+		f.y2, f.y1 = f.y1, y
+		samples[i] = clampSample(y)
+	}
+}
+
+const (
+	// noiseFFTSize is the analysis window of the noise suppressor (32ms at 8kHz)
+	noiseFFTSize = 256
+	// noiseHopSize is the step between analysis windows (50% overlap)
+	noiseHopSize = noiseFFTSize / 2
+)
+
+// NoiseSuppressor attenuates stationary background noise with spectral
+// subtraction. It tracks a per-bin noise floor that falls quickly and rises
+// slowly, so speech does not get absorbed into the estimate, and applies a
+// smoothed Wiener-style gain to each bin. Processing uses a square-root Hann
+// window with 50% overlap-add and delays the signal by one window (32ms).
+type NoiseSuppressor struct {
+	window   []float64
+	input    []float64 // Last noiseFFTSize input samples
+	pending  []float64 // New input samples not yet analysed
+	overlap  []float64 // Tail of the previous synthesis frame
+	output   []float64 // Finished output samples
+	smoothed []float64 // Time-smoothed power per bin
+	noise    []float64 // Noise power estimate per bin
+	gains    []float64 // Previous gain per bin, for smoothing
+	minGain  float64
+	frames   int
+	spectrum []complex128
+}
+
+// NewNoiseSuppressor creates a noise suppressor limited to maxAttenuationDB of reduction
+func NewNoiseSuppressor(maxAttenuationDB float64) *NoiseSuppressor {
+	window := make([]float64, noiseFFTSize)
+	for i := range window {
+		window[i] = math.Sqrt(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/noiseFFTSize))
+	}
+
+	bins := noiseFFTSize/2 + 1
+	gains := make([]float64, bins)
+	for i := range gains {
+		gains[i] = 1
+	}
+
+	return &NoiseSuppressor{
+		window:   window,
+		input:    make([]float64, noiseFFTSize),
+		overlap:  make([]float64, noiseHopSize),
+		output:   make([]float64, noiseHopSize), // Primed with one hop of silence
+		smoothed: make([]float64, bins),
+		noise:    make([]float64, bins),
+		gains:    gains,
+		minGain:  dbToLinear(-maxAttenuationDB),
+		spectrum: make([]complex128, noiseFFTSize),
+	}
+}
+
+// Process denoises the frame in place, returning audio delayed by one window
+func (n *NoiseSuppressor) Process(samples []int16) {
+	for _, sample := range samples {
+		n.pending = append(n.pending, float64(sample))
+	}
+
+	for len(n.pending) >= noiseHopSize {
+		copy(n.input, n.input[noiseHopSize:])
+		copy(n.input[noiseFFTSize-noiseHopSize:], n.pending[:noiseHopSize])
+		n.pending = n.pending[noiseHopSize:]
+		n.processFrame()
+	}
+
+	for i := range samples {
+		samples[i] = clampSample(n.output[i])
+	}
+	n.output = n.output[len(samples):]
+}
+
+// processFrame analyses the current window and appends one hop of output
+func (n *NoiseSuppressor) processFrame() {
+	for i := range n.spectrum {
+		n.spectrum[i] = complex(n.input[i]*n.window[i], 0)
+	}
+	fft(n.spectrum, false)
+
+	n.frames++
+	for k := 0; k <= noiseFFTSize/2; k++ {
+		power := real(n.spectrum[k])*real(n.spectrum[k]) + imag(n.spectrum[k])*imag(n.spectrum[k])
+
+		// Noise floor tracking on the time-smoothed power: follow drops
+		// immediately and creep up slowly so speech is not absorbed
+		n.smoothed[k] = 0.7*n.smoothed[k] + 0.3*power
+		switch {
+		case n.frames <= 10:
+			// Assume the first frames of a call are mostly background
+			n.smoothed[k] = power
+			n.noise[k] += (power - n.noise[k]) / float64(n.frames)
+		case n.smoothed[k] < n.noise[k]:
+			n.noise[k] = n.smoothed[k]
+		default:
+			n.noise[k] *= 1.01
+			if n.noise[k] > n.smoothed[k] {
+				n.noise[k] = n.smoothed[k]
+			}
+		}
+
+		// Spectral subtraction gain, smoothed over time to avoid musical noise
+		gain := 1.0
+		if power > 0 {
+			gain = 1 - 2*n.noise[k]/power
+		}
+		if gain < n.minGain {
+			gain = n.minGain
+		}
+		gain = 0.6*n.gains[k] + 0.4*gain
+		n.gains[k] = gain
+
+		n.spectrum[k] *= complex(gain, 0)
+		if k > 0 && k < noiseFFTSize/2 {
+			n.spectrum[noiseFFTSize-k] = cmplx.Conj(n.spectrum[k])
+		}
+	}
+
+	fft(n.spectrum, true)
+
+	// Overlap-add the synthesis frame
+	for i := 0; i < noiseHopSize; i++ {
+		n.output = append(n.output, n.overlap[i]+real(n.spectrum[i])*n.window[i])
+	}
+	for i := 0; i < noiseHopSize; i++ {
+		j := i + noiseHopSize
+		n.overlap[i] = real(n.spectrum[j]) * n.window[j]
+	}
+}
+
+// fft computes an in-place radix-2 FFT. The length must be a power of two.
+// When inverse is true the result is scaled by 1/N.
+func fft(x []complex128, inverse bool) {
+	size := len(x)
+
+	// Bit-reversal permutation
+	for i, j := 1, 0; i < size; i++ {
+		bit := size >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	sign := -1.0
+	if inverse {
+		sign = 1.0
+	}
+	for length := 2; length <= size; length <<= 1 {
+		angle := sign * 2 * math.Pi / float64(length)
+		wLen := complex(math.Cos(angle), math.Sin(angle))
+		for i := 0; i < size; i += length {
+			w := complex(1, 0)
+			for k := 0; k < length/2; k++ {
+				u := x[i+k]
+				v := x[i+k+length/2] * w
+				x[i+k] = u + v
+				x[i+k+length/2] = u - v
+				w *= wLen
+			}
+		}
+	}
+
+	if inverse {
+		scale := complex(1/float64(size), 0)
+		for i := range x {
+			x[i] *= scale
+		}
+	}
+}
+
+// AutomaticGainControl brings speech towards a target RMS level. The gain only
+// changes while the input is above a noise gate, rises slowly and falls quickly,
+// and never exceeds the configured maximum.
+type AutomaticGainControl struct {
+	targetRMS float64
+	maxGain   float64
+	gateRMS   float64
+	gain      float64
+	attack    float64 // Smoothing coefficient when reducing gain
+	release   float64 // Smoothing coefficient when increasing gain
+}
+
+// NewAutomaticGainControl creates an AGC aiming for targetDBFS with at most maxGainDB of boost
+func NewAutomaticGainControl(targetDBFS, maxGainDB float64) *AutomaticGainControl {
+	return &AutomaticGainControl{
+		targetRMS: dbToLinear(targetDBFS) * math.MaxInt16,
+		maxGain:   dbToLinear(maxGainDB),
+		gateRMS:   dbToLinear(-55) * math.MaxInt16,
+		gain:      1,
+		attack:    0.5,
+		release:   0.05,
+	}
+}
+
+// Process applies gain to the frame in place
+func (a *AutomaticGainControl) Process(samples []int16) {
+	if len(samples) == 0 {
+		return
+	}
+
+	var sum float64
+	for _, sample := range samples {
+		sum += float64(sample) * float64(sample)
+	}
+	rms := math.Sqrt(sum / float64(len(samples)))
+
+	if rms > a.gateRMS {
+		desired := a.targetRMS / rms
+		if desired > a.maxGain {
+			desired = a.maxGain
+		}
+		coeff := a.release
+		if desired < a.gain {
+			coeff = a.attack
+		}
+		a.gain += (desired - a.gain) * coeff
+	}
+
+	// Never push the loudest sample of the frame into clipping
+	peak := 0.0
+	for _, sample := range samples {
+		peak = math.Max(peak, math.Abs(float64(sample)))
+	}
+	gain := a.gain
+	if peak*gain > math.MaxInt16 {
+		gain = math.MaxInt16 / peak
+	}
+
+	for i, sample := range samples {
+		samples[i] = clampSample(float64(sample) * gain)
+	}
+}
+
+// clipThreshold is the magnitude at which a sample is considered clipped
+const clipThreshold = 32000
+
+// ClipDetector counts clipped samples in the incoming signal. It does not
+// modify audio; it reports callers whose gateway or handset is overdriven.
+type ClipDetector struct {
+	sessionID      string
+	clippedSamples int
+	clippedFrames  int
+	totalFrames    int
+}
+
+// NewClipDetector creates a clipping detector that logs against the given session
+func NewClipDetector(sessionID string) *ClipDetector {
+	return &ClipDetector{sessionID: sessionID}
+}
+
+// Process inspects the frame and logs when clipping is detected
+func (c *ClipDetector) Process(samples []int16) {
+	c.totalFrames++
+
+	clipped := 0
+	for _, sample := range samples {
+		if sample >= clipThreshold || sample <= -clipThreshold {
+			clipped++
+		}
+	}
+	if clipped == 0 {
+		return
+	}
+
+	c.clippedSamples += clipped
+	c.clippedFrames++
+
+	// Log the first occurrence and then periodically to avoid flooding
+	if c.clippedFrames == 1 || c.clippedFrames%250 == 0 {
+		slog.Warn("Clipping detected in caller audio",
+			"event", "audio_clipping",
+			"session", c.sessionID,
+			"clipped_samples", c.clippedSamples,
+			"clipped_frames", c.clippedFrames,
+			"total_frames", c.totalFrames)
+	}
+}
+
+// OutputLoudnessConfig controls gain staging of AI audio sent to the caller
+type OutputLoudnessConfig struct {
+	TargetDBFS  float64 `json:"target_dbfs"`            // Target speech RMS level, e.g. -18
+	MaxGainDB   float64 `json:"max_gain_db,omitempty"`  // Maximum boost or cut applied
+	LimiterDBFS float64 `json:"limiter_dbfs,omitempty"` // Peak ceiling of the limiter
+}
+
+const (
+	defaultOutputMaxGainDB   = 12.0
+	defaultOutputLimiterDBFS = -1.0
+)
+
+// LoudnessNormalizer keeps AI speech at a consistent level. It measures the
+// speech level over roughly a second of active audio, moves a smoothed gain
+// towards the target within +/- the maximum gain, and then runs a peak limiter
+// (instant attack, 50ms release) so the boosted signal never clips in G.711.
+type LoudnessNormalizer struct {
+	targetRMS   float64
+	maxGain     float64
+	ceiling     float64
+	gateRMS     float64
+	levelPower  float64 // Smoothed mean square of active frames
+	primed      bool
+	gain        float64
+	limiterGain float64
+	release     float64
+}
+
+// NewLoudnessNormalizer creates an outbound normalizer, or nil if config is nil
+func NewLoudnessNormalizer(config *OutputLoudnessConfig, sampleRate int) *LoudnessNormalizer {
+	if config == nil || config.TargetDBFS == 0 {
+		return nil
+	}
+
+	maxGain := config.MaxGainDB
+	if maxGain <= 0 {
+		maxGain = defaultOutputMaxGainDB
+	}
+	ceiling := config.LimiterDBFS
+	if ceiling == 0 {
+		ceiling = defaultOutputLimiterDBFS
+	}
+
+	return &LoudnessNormalizer{
+		targetRMS:   dbToLinear(config.TargetDBFS) * math.MaxInt16,
+		maxGain:     dbToLinear(maxGain),
+		ceiling:     dbToLinear(ceiling) * math.MaxInt16,
+		gateRMS:     dbToLinear(-50) * math.MaxInt16,
+		gain:        1,
+		limiterGain: 1,
+		release:     1 - math.Exp(-1/(0.05*float64(sampleRate))),
+	}
+}
+
+// Process normalizes the frame in place
+func (l *LoudnessNormalizer) Process(samples []int16) {
+	if len(samples) == 0 {
+		return
+	}
+
+	var sum float64
+	for _, sample := range samples {
+		sum += float64(sample) * float64(sample)
+	}
+	meanSquare := sum / float64(len(samples))
+
+	// Only speech contributes to the level estimate
+	if math.Sqrt(meanSquare) > l.gateRMS {
+		if !l.primed {
+			l.levelPower = meanSquare
+			l.primed = true
+		} else {
+			l.levelPower += (meanSquare - l.levelPower) * 0.02
+		}
+	}
+
+	if l.primed {
+		desired := l.targetRMS / math.Sqrt(l.levelPower)
+		desired = math.Min(math.Max(desired, 1/l.maxGain), l.maxGain)
+		l.gain += (desired - l.gain) * 0.1
+	}
+
+	for i, sample := range samples {
+		// Recover before checking the ceiling, so the gain the sample is
+		// scaled by is the one that was checked
+		v := float64(sample) * l.gain
+		l.limiterGain += (1 - l.limiterGain) * l.release
+		if math.Abs(v)*l.limiterGain > l.ceiling {
+			l.limiterGain = l.ceiling / math.Abs(v)
+		}
+		samples[i] = clampSample(v * l.limiterGain)
+	}
+}
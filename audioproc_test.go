@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// sine returns n samples of a tone at freq Hz with the given peak amplitude
+func sine(freq, amplitude float64, sampleRate, n int) []int16 {
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = clampSample(amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(sampleRate)))
+	}
+	return samples
+}
+
+// rmsOf returns the RMS level of samples
+func rmsOf(samples []int16) float64 {
+	var sum float64
+	for _, sample := range samples {
+		sum += float64(sample) * float64(sample)
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+// processFrames runs p over samples in place, one 20ms frame at 8kHz at a time
+func processFrames(p AudioProcessor, samples []int16) {
+	for offset := 0; offset < len(samples); offset += rtpSamplesPerFrame {
+		p.Process(samples[offset:min(offset+rtpSamplesPerFrame, len(samples))])
+	}
+}
+
+func TestHighPassFilterRemovesDCAndHum(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		input   []int16
+		maxGain float64 // Largest output/input RMS once settled
+		minGain float64
+	}{
+		{"dc", func() []int16 {
+			samples := make([]int16, 8000)
+			for i := range samples {
+				samples[i] = 5000
+			}
+			return samples
+		}(), 0.01, 0},
+		{"50Hz hum", sine(50, 10000, 8000, 8000), 0.3, 0},
+		{"1kHz speech band", sine(1000, 10000, 8000, 8000), 1.05, 0.95},
+	} {
+		input := append([]int16(nil), test.input...)
+		processFrames(NewHighPassFilter(defaultHighPassCutoffHz, 8000), test.input)
+
+		// Skip the first half second while the filter settles
+		gain := rmsOf(test.input[4000:]) / rmsOf(input[4000:])
+		if gain > test.maxGain || gain < test.minGain {
+			t.Errorf("%s: gain %.3f, want %.3f to %.3f", test.name, gain, test.minGain, test.maxGain)
+		}
+	}
+}
+
+func TestNoiseSuppressorAttenuatesStationaryNoise(t *testing.T) {
+	const maxAttenuationDB = 12.0
+	random := rand.New(rand.NewSource(1))
+	noise := make([]int16, 3*8000)
+	for i := range noise {
+		noise[i] = int16(random.NormFloat64() * 1000)
+	}
+	input := append([]int16(nil), noise...)
+
+	processFrames(NewNoiseSuppressor(maxAttenuationDB), noise)
+
+	// Compare the last second, well after the noise floor has been learnt
+	attenuationDB := 20 * math.Log10(rmsOf(input[2*8000:])/rmsOf(noise[2*8000:]))
+	if attenuationDB < 6 {
+		t.Fatalf("noise attenuated by %.1f dB, want at least 6", attenuationDB)
+	}
+	if attenuationDB > maxAttenuationDB+1 {
+		t.Fatalf("noise attenuated by %.1f dB, more than the %.0f dB maximum", attenuationDB, maxAttenuationDB)
+	}
+}
+
+func TestAutomaticGainControlCapsGain(t *testing.T) {
+	const maxGainDB = 12.0
+
+	// -50 dBFS is above the gate but needs 30 dB to reach the target
+	quiet := sine(440, dbToLinear(-50)*math.MaxInt16*math.Sqrt2, 8000, 2*8000)
+	input := append([]int16(nil), quiet...)
+	processFrames(NewAutomaticGainControl(defaultAGCTargetDBFS, maxGainDB), quiet)
+
+	gainDB := 20 * math.Log10(rmsOf(quiet[8000:])/rmsOf(input[8000:]))
+	if math.Abs(gainDB-maxGainDB) > 0.5 {
+		t.Fatalf("gain %.1f dB on near-silence, want the %.0f dB maximum", gainDB, maxGainDB)
+	}
+
+	// Below the gate the gain is left alone
+	silent := sine(440, 5, 8000, 8000)
+	input = append([]int16(nil), silent...)
+	processFrames(NewAutomaticGainControl(defaultAGCTargetDBFS, maxGainDB), silent)
+	for i := range silent {
+		if silent[i] != input[i] {
+			t.Fatalf("sample %d below the gate changed from %d to %d", i, input[i], silent[i])
+		}
+	}
+}
+
+func TestClipDetectorCountsFullScaleSamples(t *testing.T) {
+	detector := NewClipDetector("test")
+
+	frame := make([]int16, rtpSamplesPerFrame)
+	detector.Process(frame)
+	frame[3] = math.MaxInt16
+	frame[50] = math.MinInt16
+	frame[90] = clipThreshold
+	frame[100] = clipThreshold - 1
+	detector.Process(frame)
+	detector.Process(frame)
+
+	if detector.clippedSamples != 6 || detector.clippedFrames != 2 || detector.totalFrames != 3 {
+		t.Fatalf("counted %d clipped samples in %d of %d frames, want 6 in 2 of 3",
+			detector.clippedSamples, detector.clippedFrames, detector.totalFrames)
+	}
+}
+
+func TestLoudnessNormalizer(t *testing.T) {
+	config := &OutputLoudnessConfig{TargetDBFS: -18, MaxGainDB: 12}
+	levelDB := func(samples []int16) float64 {
+		return 20 * math.Log10(rmsOf(samples)/math.MaxInt16)
+	}
+
+	for _, test := range []struct {
+		name         string
+		inputDBFS    float64
+		minDB, maxDB float64 // Output level once settled
+	}{
+		{"quiet tone raised", -36, -24.5, -23.5}, // Boost capped at 12 dB
+		{"hot tone reduced", -6, -18.5, -17.5},
+	} {
+		tone := sine(440, dbToLinear(test.inputDBFS)*math.MaxInt16*math.Sqrt2, 8000, 3*8000)
+		processFrames(NewLoudnessNormalizer(config, 8000), tone)
+		if level := levelDB(tone[2*8000:]); level < test.minDB || level > test.maxDB {
+			t.Errorf("%s: output at %.1f dBFS, want %.1f to %.1f", test.name, level, test.minDB, test.maxDB)
+		}
+	}
+}
+
+func TestLoudnessNormalizerLimitsPeaks(t *testing.T) {
+	normalizer := NewLoudnessNormalizer(&OutputLoudnessConfig{TargetDBFS: -18, MaxGainDB: 12}, 8000)
+	ceiling := dbToLinear(defaultOutputLimiterDBFS) * math.MaxInt16
+
+	// A quiet passage builds up gain, then a full-scale burst hits it
+	quiet := sine(440, 1000, 8000, 2*8000)
+	burst := sine(440, math.MaxInt16, 8000, 8000)
+	processFrames(normalizer, quiet)
+	processFrames(normalizer, burst)
+
+	for i, sample := range append(quiet, burst...) {
+		if math.Abs(float64(sample)) > ceiling+1 {
+			t.Fatalf("sample %d at %d exceeds the limiter ceiling %.0f", i, sample, ceiling)
+		}
+	}
+}
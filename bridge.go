@@ -4,12 +4,17 @@ import (
 	"io"
 	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // MediaChunk represents a media payload (e.g., PCM audio) with sender information
 type MediaChunk struct {
-	Data     []byte
-	SenderID string
+	Data        []byte
+	SenderID    string
+	RecipientID string        // Optional: deliver only to this participant instead of everyone else
+	Format      MediaFormat   // Zero value means DefaultMediaFormat
+	Timestamp   time.Duration // Media time of the first sample since the start of the sender's stream
 }
 
 // Participant represents a participant that can send and receive RTP packets
@@ -27,6 +32,13 @@ type QueueFlusher interface {
 	FlushQueue()
 }
 
+// PassiveParticipant is an optional interface for taps (e.g. a media fork).
+// A passive participant receives every sender's audio separately, even from a
+// mixing bridge, and is excluded from mixes.
+type PassiveParticipant interface {
+	Passive() bool
+}
+
 // MediaBridge handles N-way media broadcasting
 type MediaBridge interface {
 	// AddParticipant adds a new participant to the bridge
@@ -35,12 +47,21 @@ type MediaBridge interface {
 	// RemoveParticipant removes a participant from the bridge
 	RemoveParticipant(participantID string) error
 
-	// Broadcast sends a media chunk to all participants except the sender
+	// Broadcast sends a media chunk to all participants except the sender,
+	// or only to chunk.RecipientID if it is set
 	Broadcast(chunk *MediaChunk) error
 
 	// FlushQueues notifies all participants that implement QueueFlusher to flush their queues
 	FlushQueues() error
 
+	// SetAudience limits who hears a sender to the given participants. A nil
+	// audience (the default) means everyone; an empty one means nobody.
+	SetAudience(senderID string, audience []string) error
+
+	// Subscribe returns a channel of the bridge's lifecycle events and a
+	// function that cancels the subscription, see BridgeEvents.Subscribe
+	Subscribe(buffer int) (<-chan BridgeEvent, func())
+
 	// Start begins processing packets
 	Start() error
 
@@ -48,35 +69,72 @@ type MediaBridge interface {
 	Stop() error
 }
 
-// DefaultMediaBridge implements MediaBridge for N-way broadcasting
+// Drop policies for full participant queues
+const (
+	DropOldest = "oldest" // Discard the oldest queued chunk to make room (keeps latency low)
+	DropNewest = "newest" // Discard the incoming chunk (keeps already queued audio intact)
+)
+
+// defaultBridgeQueueSize is the number of chunks buffered per participant
+const defaultBridgeQueueSize = 200
+
+// BridgeConfig configures a session's media bridge
+type BridgeConfig struct {
+	Mode       string // BridgeModeForward or BridgeModeMix
+	QueueSize  int    // Chunks buffered per participant
+	DropPolicy string // DropOldest or DropNewest
+}
+
+// DefaultMediaBridge implements MediaBridge for N-way broadcasting. Every
+// participant has its own bounded queue drained by its own writer goroutine,
+// so a slow participant (e.g. a stalled WebSocket) only delays itself.
 type DefaultMediaBridge struct {
-	participants map[string]Participant
-	chunkChan    chan *MediaChunk
-	stopChan     chan struct{}
-	wg           sync.WaitGroup
-	mu           sync.RWMutex
+	queues    map[string]*participantQueue
+	audiences audiences
+	config    BridgeConfig
+	events    *BridgeEvents
+	stopped   bool
+	wg        sync.WaitGroup
+	mu        sync.RWMutex
 }
 
 // NewMediaBridge creates a new media bridge
-func NewMediaBridge() *DefaultMediaBridge {
+func NewMediaBridge(config BridgeConfig) *DefaultMediaBridge {
 	return &DefaultMediaBridge{
-		participants: make(map[string]Participant),
-		chunkChan:    make(chan *MediaChunk, 200),
-		stopChan:     make(chan struct{}),
+		queues:    make(map[string]*participantQueue),
+		audiences: make(audiences),
+		config:    config,
+		events:    newBridgeEvents(),
 	}
 }
 
-// AddParticipant adds a new participant to the bridge
+// AddParticipant adds a new participant to the bridge and starts its writer
 func (m *DefaultMediaBridge) AddParticipant(participant Participant) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.stopped {
+		return io.ErrClosedPipe
+	}
+
 	id := participant.ID()
-	m.participants[id] = participant
+	if existing := m.queues[id]; existing != nil {
+		existing.close()
+	}
+
+	queue := newParticipantQueue(participant, m.config, m.events)
+	m.queues[id] = queue
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		queue.run(m.removeClosed)
+	}()
+
 	slog.Info("Added participant to media bridge",
 		"event", "participant_added",
 		"participant", id,
-		"total", len(m.participants))
+		"total", len(m.queues))
+	m.events.publish(BridgeEvent{Type: BridgeEventParticipantJoined, Participant: id, Total: len(m.queues)})
 
 	return nil
 }
@@ -86,161 +144,365 @@ func (m *DefaultMediaBridge) RemoveParticipant(participantID string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if _, exists := m.participants[participantID]; exists {
-		delete(m.participants, participantID)
+	delete(m.audiences, participantID)
+	if queue, exists := m.queues[participantID]; exists {
+		delete(m.queues, participantID)
+		queue.release()
 		slog.Info("Removed participant from media bridge",
 			"event", "participant_removed",
 			"participant", participantID,
-			"total", len(m.participants))
+			"total", len(m.queues))
+		m.events.publish(BridgeEvent{Type: BridgeEventParticipantLeft, Participant: participantID, Reason: "removed", Total: len(m.queues)})
 	}
 
 	return nil
 }
 
-// Broadcast sends a media chunk to all participants except the sender
+// removeClosed removes a participant whose writer returned io.ErrClosedPipe
+func (m *DefaultMediaBridge) removeClosed(queue *participantQueue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := queue.participant.ID()
+	if m.queues[id] != queue {
+		return
+	}
+	delete(m.queues, id)
+	delete(m.audiences, id)
+	queue.release()
+	slog.Info("Auto-removed closed participant",
+		"event", "participant_auto_removed",
+		"participant", id,
+		"total", len(m.queues))
+	m.events.publish(BridgeEvent{Type: BridgeEventParticipantClosed, Participant: id, Total: len(m.queues)})
+}
+
+// Broadcast queues a media chunk for all participants except the sender,
+// or only for chunk.RecipientID if it is set. It never blocks.
 func (m *DefaultMediaBridge) Broadcast(chunk *MediaChunk) error {
-	select {
-	case m.chunkChan <- chunk:
-		return nil
-	case <-m.stopChan:
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.stopped {
 		return io.ErrClosedPipe
-	default:
-		// Channel full, drop chunk
-		slog.Warn("Media chunk dropped, channel full",
-			"event", "chunk_dropped",
-			"sender", chunk.SenderID)
-		return nil
 	}
+
+	for id, queue := range m.queues {
+		// Skip the sender
+		if id == chunk.SenderID {
+			continue
+		}
+
+		// Targeted chunks only go to their recipient
+		if chunk.RecipientID != "" && id != chunk.RecipientID {
+			continue
+		}
+
+		// Senders with a restricted audience are only heard by it
+		if !m.audiences.allows(chunk.SenderID, id) {
+			continue
+		}
+
+		queue.enqueue(chunk)
+	}
+
+	return nil
 }
 
-// FlushQueues notifies all participants that implement QueueFlusher to flush their queues
+// FlushQueues drops audio queued for participants that implement QueueFlusher
+// and notifies them to flush their own queues
 func (m *DefaultMediaBridge) FlushQueues() error {
 	m.mu.RLock()
-	participantsSnapshot := make(map[string]Participant, len(m.participants))
-	for id, p := range m.participants {
-		participantsSnapshot[id] = p
+	queuesSnapshot := make([]*participantQueue, 0, len(m.queues))
+	for _, queue := range m.queues {
+		queuesSnapshot = append(queuesSnapshot, queue)
 	}
 	m.mu.RUnlock()
 
-	flushedCount := 0
-	for id, participant := range participantsSnapshot {
-		// Check if participant implements QueueFlusher interface
-		if flusher, ok := participant.(QueueFlusher); ok {
-			flusher.FlushQueue()
-			flushedCount++
-			slog.Info("Flushed queue for participant",
-				"event", "mediabridge_flush",
-				"participant", id)
-		}
-	}
+	flushedCount := flushParticipantQueues(queuesSnapshot, m.events)
 
 	slog.Info("Flushed queues for participants",
 		"event", "mediabridge_flush_complete",
 		"flushed_count", flushedCount,
-		"total_participants", len(participantsSnapshot))
+		"total_participants", len(queuesSnapshot))
+	m.events.publish(BridgeEvent{Type: BridgeEventFlushed, Count: flushedCount, Total: len(queuesSnapshot)})
 	return nil
 }
 
-// Start begins processing media chunks
-func (m *DefaultMediaBridge) Start() error {
-	m.wg.Add(1)
-	go func() {
-		defer m.wg.Done()
-		for {
-			select {
-			case chunk := <-m.chunkChan:
-				m.broadcastChunk(chunk)
+// SetAudience limits who hears a sender
+func (m *DefaultMediaBridge) SetAudience(senderID string, audience []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-			case <-m.stopChan:
-				return
-			}
-		}
-	}()
+	m.audiences.set(senderID, audience)
+	return nil
+}
+
+// Subscribe returns a channel of the bridge's lifecycle events
+func (m *DefaultMediaBridge) Subscribe(buffer int) (<-chan BridgeEvent, func()) {
+	return m.events.Subscribe(buffer)
+}
 
+// Start begins processing media chunks. Participant writers run from the
+// moment they are added, so there is nothing else to start.
+func (m *DefaultMediaBridge) Start() error {
 	slog.Info("Media bridge started",
-		"event", "media_bridge_started")
+		"event", "media_bridge_started",
+		"queue_size", m.config.QueueSize,
+		"drop_policy", m.config.DropPolicy)
 	return nil
 }
 
-// broadcastChunk sends chunk to all participants except the sender
-func (m *DefaultMediaBridge) broadcastChunk(chunk *MediaChunk) {
-	m.mu.RLock()
-	participantsSnapshot := make(map[string]Participant, len(m.participants))
-	for id, p := range m.participants {
-		participantsSnapshot[id] = p
+// Stop closes the bridge and waits for the participant writers to exit
+func (m *DefaultMediaBridge) Stop() error {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return nil
 	}
-	m.mu.RUnlock()
+	m.stopped = true
+	for id, queue := range m.queues {
+		queue.release()
+		delete(m.queues, id)
+		m.events.publish(BridgeEvent{Type: BridgeEventParticipantLeft, Participant: id, Reason: "bridge_stopped", Total: len(m.queues)})
+	}
+	m.mu.Unlock()
 
-	sentCount := 0
-	var participantsToRemove []string
+	m.wg.Wait()
 
-	for id, participant := range participantsSnapshot {
-		// Skip the sender
-		if id == chunk.SenderID {
+	slog.Info("Media bridge stopped",
+		"event", "media_bridge_stopped")
+	m.events.close()
+	return nil
+}
+
+// audiences maps senders to the set of participants allowed to hear them.
+// Senders without an entry are heard by everyone.
+type audiences map[string]map[string]bool
+
+// set replaces a sender's audience; nil removes the restriction. The inner
+// set is never modified in place, so callers may read a shallow copy.
+func (a audiences) set(senderID string, audience []string) {
+	if audience == nil {
+		delete(a, senderID)
+		return
+	}
+	allowed := make(map[string]bool, len(audience))
+	for _, id := range audience {
+		allowed[id] = true
+	}
+	a[senderID] = allowed
+}
+
+// allows reports whether listenerID may hear senderID
+func (a audiences) allows(senderID, listenerID string) bool {
+	allowed, restricted := a[senderID]
+	return !restricted || allowed[listenerID]
+}
+
+// flushParticipantQueues drains the queues of participants that implement
+// QueueFlusher and asks them to flush. Other participants (e.g. the AI, which
+// is receiving the caller's speech) keep their queued audio.
+func flushParticipantQueues(queues []*participantQueue, events *BridgeEvents) int {
+	flushedCount := 0
+	for _, queue := range queues {
+		flusher, ok := queue.participant.(QueueFlusher)
+		if !ok {
 			continue
 		}
+		dropped := queue.flush()
+		flusher.FlushQueue()
+		flushedCount++
+		slog.Info("Flushed queue for participant",
+			"event", "mediabridge_flush",
+			"participant", queue.participant.ID(),
+			"bridge_chunks", dropped)
+		events.publish(BridgeEvent{Type: BridgeEventQueueFlushed, Participant: queue.participant.ID(), Count: dropped})
+	}
+	return flushedCount
+}
+
+// queuedChunk is audio waiting in a participant queue
+type queuedChunk struct {
+	chunk    *MediaChunk
+	enqueued time.Time
+}
+
+// participantQueue is a participant's bounded outbound queue and writer.
+// Chunks are converted to a format the participant accepts on the writer
+// goroutine, so conversion cost is paid by the listener, not the sender.
+type participantQueue struct {
+	participant  Participant
+	converter    *chunkConverter
+	passive      bool
+	events       *BridgeEvents
+	dropPolicy   string
+	chunks       chan queuedChunk
+	stop         chan struct{}
+	stopOnce     sync.Once
+	droppedCount atomic.Uint64
+	dropped      *Counter
+	delivered    *Counter
+	depth        *Gauge
+	latency      *Histogram
+}
 
-		writer := participant.Writer()
-		if writer != nil {
-			if _, err := writer.Write(chunk.Data); err != nil {
-				// If it's a terminal error (closed pipe), mark for removal
+// newParticipantQueue creates a queue for participant that reports drops to events
+func newParticipantQueue(participant Participant, config BridgeConfig, events *BridgeEvents) *participantQueue {
+	size := config.QueueSize
+	if size <= 0 {
+		size = defaultBridgeQueueSize
+	}
+	policy := config.DropPolicy
+	if policy != DropNewest {
+		policy = DropOldest
+	}
+
+	id := participant.ID()
+	passive, ok := participant.(PassiveParticipant)
+	return &participantQueue{
+		participant: participant,
+		passive:     ok && passive.Passive(),
+		events:      events,
+		converter:   newChunkConverter(id, acceptedFormats(participant)),
+		dropPolicy:  policy,
+		chunks:      make(chan queuedChunk, size),
+		stop:        make(chan struct{}),
+		dropped: metrics.Counter("sip_proxy_bridge_chunks_dropped_total",
+			"Chunks dropped because a participant's bridge queue was full", "participant", id, "policy", policy),
+		delivered: metrics.Counter("sip_proxy_bridge_chunks_delivered_total",
+			"Chunks written to a participant", "participant", id),
+		depth: metrics.Gauge("sip_proxy_bridge_queue_depth",
+			"Chunks waiting in a participant's bridge queue", "participant", id),
+		latency: metrics.Histogram("sip_proxy_bridge_queue_latency_seconds",
+			"Time chunks wait in a participant's bridge queue before being written", defaultLatencyBuckets, "participant", id),
+	}
+}
+
+// enqueue adds a chunk to the queue, applying the drop policy when it is full
+func (q *participantQueue) enqueue(chunk *MediaChunk) {
+	queued := queuedChunk{chunk: chunk, enqueued: time.Now()}
+	for {
+		select {
+		case q.chunks <- queued:
+			q.depth.Set(float64(len(q.chunks)))
+			return
+		default:
+		}
+
+		if q.dropPolicy == DropNewest {
+			q.recordDrop()
+			return
+		}
+
+		// Make room by discarding the oldest chunk, then try again
+		select {
+		case <-q.chunks:
+			q.recordDrop()
+		default:
+		}
+	}
+}
+
+// recordDrop counts a dropped chunk, logging and publishing the first and every 100th
+func (q *participantQueue) recordDrop() {
+	q.dropped.Inc()
+	if n := q.droppedCount.Add(1); n == 1 || n%100 == 0 {
+		slog.Warn("Media chunk dropped, participant queue full",
+			"event", "chunk_dropped",
+			"participant", q.participant.ID(),
+			"policy", q.dropPolicy,
+			"dropped_total", n)
+		q.events.publish(BridgeEvent{Type: BridgeEventChunkDropped, Participant: q.participant.ID(), Reason: q.dropPolicy, Count: int(n)})
+	}
+}
+
+// run writes queued chunks to the participant until the queue is closed.
+// onClosed is called if the participant's writer reports io.ErrClosedPipe.
+func (q *participantQueue) run(onClosed func(*participantQueue)) {
+	defer q.converter.Reset()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+
+		case queued := <-q.chunks:
+			q.depth.Set(float64(len(q.chunks)))
+
+			writer := q.participant.Writer()
+			if writer == nil {
+				continue
+			}
+
+			chunk := q.converter.Convert(queued.chunk)
+			if chunk == nil {
+				continue
+			}
+
+			q.latency.Observe(time.Since(queued.enqueued).Seconds())
+			var err error
+			if chunkWriter, ok := q.participant.(ChunkWriter); ok {
+				err = chunkWriter.WriteChunk(chunk)
+			} else {
+				_, err = writer.Write(chunk.Data)
+			}
+			if err != nil {
+				// If it's a terminal error (closed pipe), remove the participant
 				if err == io.ErrClosedPipe {
 					slog.Info("Participant closed, will be removed from bridge",
 						"event", "participant_closed",
-						"participant", id)
-					participantsToRemove = append(participantsToRemove, id)
-				} else {
-					slog.Error("Error writing to participant",
-						"event", "write_error",
-						"participant", id,
-						"error", err.Error())
+						"participant", q.participant.ID())
+					onClosed(q)
+					return
 				}
-			} else {
-				sentCount++
+				slog.Error("Error writing to participant",
+					"event", "write_error",
+					"participant", q.participant.ID(),
+					"error", err.Error())
+				continue
 			}
+			q.delivered.Inc()
 		}
 	}
+}
 
-	// Remove participants that returned ErrClosedPipe
-	if len(participantsToRemove) > 0 {
-		m.mu.Lock()
-		for _, id := range participantsToRemove {
-			delete(m.participants, id)
-			slog.Info("Auto-removed closed participant",
-				"event", "participant_auto_removed",
-				"participant", id,
-				"total", len(m.participants))
+// flush discards everything queued and returns how many chunks were dropped.
+// Conversion state is reset too, so the next chunk does not carry the
+// resampler tail of discarded audio.
+func (q *participantQueue) flush() int {
+	flushed := 0
+	for {
+		select {
+		case <-q.chunks:
+			flushed++
+		default:
+			q.depth.Set(0)
+			q.converter.Reset()
+			return flushed
 		}
-		m.mu.Unlock()
 	}
-
-	// Commented out for performance - uncomment if debugging broadcasts
-	// if sentCount > 0 {
-	// 	slog.Debug("Broadcasted chunk to participants",
-	// 		"event", "chunk_broadcasted",
-	// 		"sender", chunk.SenderID,
-	// 		"recipients", sentCount)
-	// }
 }
 
-// Stop closes the bridge
-func (m *DefaultMediaBridge) Stop() error {
-	close(m.stopChan)
-	m.wg.Wait()
-
-	m.mu.Lock()
-	m.participants = make(map[string]Participant)
-	m.mu.Unlock()
+// close stops the writer goroutine; queued chunks are discarded
+func (q *participantQueue) close() {
+	q.stopOnce.Do(func() { close(q.stop) })
+}
 
-	slog.Info("Media bridge stopped",
-		"event", "media_bridge_stopped")
-	return nil
+// release closes the queue of a participant that is leaving the bridge and
+// deletes its metric series. A queue replaced by a participant rejoining under
+// the same ID is only closed: the series are shared with its replacement.
+// Callers hold the bridge lock, so a rejoin cannot interleave.
+func (q *participantQueue) release() {
+	q.close()
+	metrics.RemoveSeries("participant", q.participant.ID())
 }
 
 // BaseParticipant provides a basic implementation of Participant
 type BaseParticipant struct {
-	id     string
-	writer io.Writer
+	id       string
+	writer   io.Writer
+	accepted []MediaFormat
 }
 
 // NewParticipant creates a new base participant
@@ -265,3 +527,17 @@ func (p *BaseParticipant) Writer() io.Writer {
 func (p *BaseParticipant) SetWriter(writer io.Writer) {
 	p.writer = writer
 }
+
+// SetAcceptedFormats declares the formats this participant can receive, most
+// preferred first. Call before adding the participant to a bridge.
+func (p *BaseParticipant) SetAcceptedFormats(formats ...MediaFormat) {
+	p.accepted = formats
+}
+
+// AcceptedFormats returns the formats this participant can receive
+func (p *BaseParticipant) AcceptedFormats() []MediaFormat {
+	if len(p.accepted) == 0 {
+		return []MediaFormat{DefaultMediaFormat}
+	}
+	return p.accepted
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hasParticipantSeries reports whether the metrics registry has series for participant id
+func hasParticipantSeries(t *testing.T, id string) bool {
+	t.Helper()
+	var out bytes.Buffer
+	if _, err := metrics.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Contains(out.String(), `participant="`+id+`"`)
+}
+
+func TestBridgeKeepsSeriesOfReplacedParticipant(t *testing.T) {
+	for name, bridge := range map[string]MediaBridge{
+		"forward": NewMediaBridge(BridgeConfig{}),
+		"mix":     NewSessionBridge(BridgeConfig{Mode: BridgeModeMix}, 8000),
+	} {
+		t.Run(name, func(t *testing.T) {
+			id := "series-test-" + name
+			bridge.Start()
+			defer bridge.Stop()
+
+			bridge.AddParticipant(NewParticipant(id, io.Discard))
+			bridge.AddParticipant(NewParticipant(id, io.Discard))
+
+			// Give the replaced queue's writer time to exit
+			time.Sleep(50 * time.Millisecond)
+			if !hasParticipantSeries(t, id) {
+				t.Fatal("replaced participant's writer deleted the series of its replacement")
+			}
+
+			bridge.RemoveParticipant(id)
+			if hasParticipantSeries(t, id) {
+				t.Fatal("series survived the participant leaving")
+			}
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// Built-in call-control tools
+const (
+	ToolEndCall      = "end_call"
+	ToolTransferCall = "transfer_call"
+	ToolSendDTMF     = "send_dtmf"
+	ToolHold         = "hold"
+	ToolUnhold       = "unhold"
+)
+
+const (
+	// playoutQuietPeriod is how long outgoing audio must have run dry before
+	// the AI's current utterance counts as played out
+	playoutQuietPeriod = time.Second
+	// maxPlayoutWait bounds the wait for an utterance to finish playing
+	maxPlayoutWait = 30 * time.Second
+)
+
+// CallControlConfig lets the AI control the call itself through built-in tools
+type CallControlConfig struct {
+	Tools           []string          `json:"tools,omitempty"`            // Tools to enable, all of them if empty
+	TransferTargets map[string]string `json:"transfer_targets,omitempty"` // Names the AI may transfer to, by SIP URI or number; any target if empty
+}
+
+// callControl executes the call-control tools of one session
+type callControl struct {
+	server    *SIPServer
+	session   *Session
+	tools     *ToolDispatcher
+	config    CallControlConfig
+	holdAudio string // Looped to the caller while on hold, empty for silence
+	// Closed to call off the pending end_call hangup, nil if none is pending
+	ending chan struct{}
+	held   bool
+	mu     sync.Mutex // Guards ending and held
+}
+
+// registerCallControl adds the call-control tools enabled by config to tools
+func (s *SIPServer) registerCallControl(session *Session, tools *ToolDispatcher, config CallControlConfig, holdAudio string) {
+	c := &callControl{
+		server:    s,
+		session:   session,
+		tools:     tools,
+		config:    config,
+		holdAudio: holdAudio,
+	}
+
+	enabled := config.Tools
+	if len(enabled) == 0 {
+		enabled = []string{ToolEndCall, ToolTransferCall, ToolSendDTMF, ToolHold, ToolUnhold}
+	}
+
+	for _, name := range enabled {
+		switch name {
+		case ToolEndCall:
+			tools.registerBuiltin(&genai.FunctionDeclaration{
+				Name:        ToolEndCall,
+				Description: "Hang up the call. Say goodbye first: the call ends once you finish speaking.",
+			}, builtinTool{run: c.endCall, timeout: time.Second})
+		case ToolTransferCall:
+			if len(config.TransferTargets) == 0 && len(s.config.TransferAllow) == 0 {
+				// Free-form targets would let a caller talk the AI into dialing
+				// premium-rate or international numbers through our carrier
+				slog.Warn("Not offering transfer_call without transfer_targets or --transfer-allow",
+					"event", "call_control_transfer_disabled",
+					"session", session.CallID)
+				continue
+			}
+			tools.registerBuiltin(c.transferDeclaration(), builtinTool{
+				run:     c.transferCall,
+				timeout: maxPlayoutWait + transferRingTimeout + 10*time.Second,
+			})
+		case ToolSendDTMF:
+			tools.registerBuiltin(&genai.FunctionDeclaration{
+				Name:        ToolSendDTMF,
+				Description: "Press keys on the phone keypad, e.g. to navigate a phone menu.",
+				ParametersJsonSchema: map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"digits": map[string]any{
+							"type":        "string",
+							"description": "Keys to press in order: 0-9, * and #",
+						},
+					},
+					"required": []string{"digits"},
+				},
+			}, builtinTool{run: c.sendDTMF, timeout: 30 * time.Second})
+		case ToolHold:
+			tools.registerBuiltin(&genai.FunctionDeclaration{
+				Name:        ToolHold,
+				Description: "Put the caller on hold. Neither of you hears the other until unhold is called.",
+			}, builtinTool{run: c.hold, timeout: 5 * time.Second})
+		case ToolUnhold:
+			tools.registerBuiltin(&genai.FunctionDeclaration{
+				Name:        ToolUnhold,
+				Description: "Take the caller off hold.",
+			}, builtinTool{run: c.unhold, timeout: 5 * time.Second})
+		default:
+			slog.Warn("Ignoring unknown call-control tool",
+				"event", "call_control_unknown_tool",
+				"session", session.CallID,
+				"tool", name)
+		}
+	}
+}
+
+// transferAllowed reports whether a free-form transfer target matches one of
+// the patterns of --transfer-allow: a phone number or SIP URI, matched
+// exactly, or a prefix of one followed by "*"
+func transferAllowed(target string, patterns []string) bool {
+	target = strings.TrimPrefix(strings.TrimSpace(target), "tel:")
+	if target == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(target, prefix) {
+				return true
+			}
+		} else if target == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// transferDeclaration declares transfer_call, listing the allowed targets if any
+func (c *callControl) transferDeclaration() *genai.FunctionDeclaration {
+	target := map[string]any{
+		"type":        "string",
+		"description": "Where to transfer the caller: a phone number or SIP URI",
+	}
+	if len(c.config.TransferTargets) > 0 {
+		names := make([]string, 0, len(c.config.TransferTargets))
+		for name := range c.config.TransferTargets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		target["description"] = "Where to transfer the caller"
+		target["enum"] = names
+	}
+
+	return &genai.FunctionDeclaration{
+		Name:        ToolTransferCall,
+		Description: "Transfer the caller to someone else. Tell the caller first: the transfer starts once you finish speaking.",
+		ParametersJsonSchema: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{"target": target},
+			"required":   []string{"target"},
+		},
+	}
+}
+
+// endCall hangs up once the current utterance has played. The hangup runs in
+// the background: ending the session closes the AI, which waits for its tool
+// calls to return. If the caller interrupts the turn that called end_call, the
+// AI cancels the call and the hangup is called off.
+func (c *callControl) endCall(ctx context.Context, args map[string]any) (map[string]any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	output := map[string]any{"output": "The call will end once you finish speaking. Do not say anything else."}
+	if c.ending != nil {
+		return output, nil
+	}
+
+	slog.Info("AI ending the call",
+		"event", "call_control_end_call",
+		"session", c.session.CallID)
+
+	cancelled := make(chan struct{})
+	c.ending = cancelled
+	release := c.tools.OnCancel(toolCallID(ctx), func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.ending == cancelled {
+			close(cancelled)
+			c.ending = nil
+		}
+	})
+
+	go func() {
+		defer release()
+
+		c.session.waitForPlayout(maxPlayoutWait)
+		select {
+		case <-cancelled:
+			slog.Info("AI end of call cancelled by an interruption",
+				"event", "call_control_end_call_cancelled",
+				"session", c.session.CallID)
+			return
+		default:
+		}
+		if c.server.getSession(c.session.CallID) == c.session {
+			c.server.hangupSession(c.session, "ai_end_call", "")
+		}
+	}()
+	return output, nil
+}
+
+// transferCall blind-transfers the caller with REFER, or by calling the target
+// and bridging the caller to it if the far end does not support REFER
+func (c *callControl) transferCall(ctx context.Context, args map[string]any) (map[string]any, error) {
+	target, _ := args["target"].(string)
+	if len(c.config.TransferTargets) > 0 {
+		named, ok := c.config.TransferTargets[target]
+		if !ok {
+			return nil, fmt.Errorf("unknown transfer target %q", target)
+		}
+		target = named
+	} else if !transferAllowed(target, c.server.config.TransferAllow) {
+		slog.Warn("AI asked to transfer to a target that is not allowed",
+			"event", "call_control_transfer_refused",
+			"session", c.session.CallID,
+			"target", target)
+		return nil, fmt.Errorf("transfers to %q are not allowed", target)
+	}
+
+	uri, err := transferTargetURI(c.session, target)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("AI transferring the call",
+		"event", "call_control_transfer",
+		"session", c.session.CallID,
+		"target", uri.String())
+
+	c.session.waitForPlayout(maxPlayoutWait)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	res, err := c.server.sendRefer(c.session, uri)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.IsSuccess():
+		go c.server.awaitReferOutcome(c.session, uri)
+		return map[string]any{"output": "The transfer is in progress."}, nil
+	case !referUnsupported(res):
+		return nil, fmt.Errorf("transfer refused: %d %s", res.StatusCode, res.Reason)
+	}
+
+	slog.Info("Far end does not support REFER, calling the transfer target",
+		"event", "call_transfer_fallback",
+		"session", c.session.CallID,
+		"status_code", res.StatusCode)
+
+	leg, err := c.server.dialTransferLeg(ctx, c.session, uri)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.server.joinTransferLeg(c.session, leg); err != nil {
+		leg.Close(c.server)
+		return nil, err
+	}
+	return map[string]any{"output": "The caller is now connected to the transfer target."}, nil
+}
+
+// sendDTMF sends digits to the far end and waits until they have been sent
+func (c *callControl) sendDTMF(ctx context.Context, args map[string]any) (map[string]any, error) {
+	digits, _ := args["digits"].(string)
+	done, err := c.session.SendDTMF(digits)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("AI sending DTMF",
+		"event", "call_control_dtmf",
+		"session", c.session.CallID,
+		"digits", len(digits))
+
+	select {
+	case <-done:
+		return map[string]any{"output": "Sent."}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.session.stopRTP:
+		return nil, fmt.Errorf("the call has ended")
+	}
+}
+
+// hold stops the caller and the AI from hearing each other and plays the
+// hold audio to the caller
+func (c *callControl) hold(ctx context.Context, args map[string]any) (map[string]any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.held {
+		return map[string]any{"output": "The caller is already on hold."}, nil
+	}
+	if err := c.setHeld(true); err != nil {
+		return nil, err
+	}
+	c.held = true
+	return map[string]any{"output": "The caller is on hold and cannot hear you."}, nil
+}
+
+// unhold reconnects the caller and the AI
+func (c *callControl) unhold(ctx context.Context, args map[string]any) (map[string]any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.held {
+		return map[string]any{"output": "The caller is not on hold."}, nil
+	}
+	if err := c.setHeld(false); err != nil {
+		return nil, err
+	}
+	c.held = false
+	return map[string]any{"output": "The caller is off hold and can hear you again."}, nil
+}
+
+// setHeld pauses or resumes the media between the caller and the AI
+func (c *callControl) setHeld(held bool) error {
+	bridge := c.session.MediaBridge
+	callerID := c.session.SIPParticipant.ID()
+	aiID := c.session.MediaHandler.ParticipantID()
+
+	// An empty audience mutes a sender for everyone, nil restores it
+	var audience []string
+	if held {
+		audience = []string{}
+	}
+	if err := bridge.SetAudience(callerID, audience); err != nil {
+		return err
+	}
+	if err := bridge.SetAudience(aiID, audience); err != nil {
+		return err
+	}
+
+	slog.Info("Call-control hold state updated",
+		"event", "call_control_hold",
+		"session", c.session.CallID,
+		"held", held)
+
+	if !held {
+		c.session.promptPlayer.Stop()
+		return nil
+	}
+	if c.holdAudio != "" {
+		if _, err := c.session.promptPlayer.Play(c.holdAudio, true, false); err != nil {
+			slog.Error("Failed to play hold audio",
+				"event", "prompt_hold_error",
+				"session", c.session.CallID,
+				"source", c.holdAudio,
+				"error", err.Error())
+		}
+	}
+	return nil
+}
+
+// joinTransferLeg replaces the AI with an answered transfer leg. The call
+// ends when either side hangs up.
+func (s *SIPServer) joinTransferLeg(session *Session, leg *TransferLeg) error {
+	session.mediaStateMux.Lock()
+	if session.transferLeg != nil {
+		session.mediaStateMux.Unlock()
+		return fmt.Errorf("the call has already been transferred")
+	}
+	session.transferLeg = leg
+	session.mediaStateMux.Unlock()
+
+	// The AI leaves the call. Closing it waits for its tool calls, including
+	// the one that is transferring, so it cannot happen inline.
+	session.MediaBridge.RemoveParticipant(session.MediaHandler.ParticipantID())
+	go session.MediaHandler.Close()
+
+	if err := session.MediaBridge.AddParticipant(leg); err != nil {
+		return err
+	}
+	go leg.run()
+
+	slog.Info("Call transferred to outbound leg",
+		"event", "call_transferred",
+		"session", session.CallID,
+		"target", leg.dialog.InviteRequest.Recipient.String(),
+		"codec", leg.codec)
+
+	go func() {
+		select {
+		case <-leg.dialog.Done():
+			if s.getSession(session.CallID) == session {
+				s.hangupSession(session, "transfer_target_bye", "")
+			}
+		case <-session.stopRTP:
+		}
+	}()
+	return nil
+}
+
+// getTransferLeg returns the session's outbound transfer leg, or nil
+func (s *Session) getTransferLeg() *TransferLeg {
+	s.mediaStateMux.Lock()
+	defer s.mediaStateMux.Unlock()
+	return s.transferLeg
+}
+
+// waitForPlayout waits until the audio queued for the caller has drained and
+// stayed empty for playoutQuietPeriod, the session ends or timeout elapses
+func (s *Session) waitForPlayout(timeout time.Duration) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(rtpFrameDuration)
+	defer ticker.Stop()
+
+	quietSince := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		case <-s.stopRTP:
+			return
+		}
+		if len(s.rtpPacketQueue) > 0 {
+			quietSince = time.Now()
+		} else if time.Since(quietSince) >= playoutQuietPeriod {
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// newTestCallControl registers the end_call tool of a live session
+func newTestCallControl() (*SIPServer, *Session, *ToolDispatcher) {
+	session := &Session{
+		CallID:         "call-1",
+		rtpPacketQueue: make(chan []byte, 4),
+		stopRTP:        make(chan struct{}),
+		stopRTPSender:  make(chan struct{}),
+	}
+	server := &SIPServer{config: &Config{}, sessions: map[string]*Session{session.CallID: session}}
+	tools := NewToolDispatcher(session.CallID, nil, ToolConfig{}, http.DefaultClient)
+	server.registerCallControl(session, tools, CallControlConfig{Tools: []string{ToolEndCall}}, "")
+	return server, session, tools
+}
+
+// callEndCall makes an end_call tool call and waits for its response
+func callEndCall(t *testing.T, tools *ToolDispatcher, id string) {
+	responded := make(chan struct{})
+	tools.Dispatch(&genai.FunctionCall{ID: id, Name: ToolEndCall}, func(*genai.FunctionResponse) {
+		close(responded)
+	})
+	select {
+	case <-responded:
+	case <-time.After(time.Second):
+		t.Fatal("end_call did not respond")
+	}
+}
+
+func TestEndCallHangsUpAfterPlayout(t *testing.T) {
+	_, session, tools := newTestCallControl()
+	callEndCall(t, tools, "fc-1")
+
+	// Ending the session stops its media after setting the end reason
+	select {
+	case <-session.stopRTP:
+	case <-time.After(playoutQuietPeriod + 2*time.Second):
+		t.Fatal("call not ended after end_call")
+	}
+	if session.EndReason != "ai_end_call" {
+		t.Fatalf("end reason %q, want ai_end_call", session.EndReason)
+	}
+}
+
+func TestEndCallCancelledByInterruption(t *testing.T) {
+	server, session, tools := newTestCallControl()
+	callEndCall(t, tools, "fc-1")
+
+	// The caller interrupts the turn that called end_call
+	tools.Cancel([]string{"fc-1"})
+
+	time.Sleep(playoutQuietPeriod + 500*time.Millisecond)
+	if server.getSession(session.CallID) == nil {
+		t.Fatal("call ended although end_call was cancelled")
+	}
+
+	// The AI may still end the call later
+	callEndCall(t, tools, "fc-2")
+	select {
+	case <-session.stopRTP:
+	case <-time.After(playoutQuietPeriod + 2*time.Second):
+		t.Fatal("call not ended by a second end_call")
+	}
+}
+
+func TestTransferAllowed(t *testing.T) {
+	patterns := []string{"+15551234567", "+1555*", "sip:support@pbx.example.com"}
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"+15551234567", true},
+		{"tel:+15551234567", true},
+		{"+15559990000", true},
+		{"+19005550100", false}, // Premium rate
+		{"+882123456", false},   // International
+		{"sip:support@pbx.example.com", true},
+		{"sip:support@pbx.example.com.evil.test", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := transferAllowed(tt.target, patterns); got != tt.want {
+			t.Errorf("transferAllowed(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+	if transferAllowed("+15551234567", nil) {
+		t.Error("free-form target allowed without --transfer-allow")
+	}
+}
+
+func TestTransferCallRequiresAllowedTargets(t *testing.T) {
+	session := &Session{CallID: "call-1"}
+	tests := []struct {
+		name          string
+		targets       map[string]string
+		transferAllow []string
+		offered       bool
+	}{
+		{"free-form by default", nil, nil, false},
+		{"named targets", map[string]string{"billing": "+15551234567"}, nil, true},
+		{"server allow-list", nil, []string{"+1555*"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &SIPServer{config: &Config{TransferAllow: tt.transferAllow}}
+			tools := NewToolDispatcher(session.CallID, nil, ToolConfig{}, http.DefaultClient)
+			server.registerCallControl(session, tools, CallControlConfig{TransferTargets: tt.targets}, "")
+
+			_, offered := tools.builtins[ToolTransferCall]
+			if offered != tt.offered {
+				t.Fatalf("transfer_call offered = %v, want %v", offered, tt.offered)
+			}
+		})
+	}
+
+	// With an allow-list, other free-form targets are refused before dialing
+	server := &SIPServer{config: &Config{TransferAllow: []string{"+1555*"}}}
+	c := &callControl{server: server, session: session}
+	if _, err := c.transferCall(context.Background(), map[string]any{"target": "+19005550100"}); err == nil {
+		t.Fatal("transfer to a number outside --transfer-allow accepted")
+	}
+}
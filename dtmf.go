@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+const (
+	// dtmfToneFrames is how many 20ms frames each digit lasts (100ms)
+	dtmfToneFrames = 5
+	// dtmfEndRepeats is how many times the end packet of an event is sent (RFC 4733 section 2.5.1.4)
+	dtmfEndRepeats = 3
+	// dtmfGapFrames is the silence between digits (60ms)
+	dtmfGapFrames = 3
+	// dtmfVolume is the power level of the tones in -dBm0 (RFC 4733 section 2.3.4)
+	dtmfVolume = 10
+	// maxDTMFDigits bounds a single send_dtmf request
+	maxDTMFDigits = 32
+)
+
+// dtmfEventCode returns the RFC 4733 event code of a DTMF digit
+func dtmfEventCode(digit rune) (byte, bool) {
+	switch {
+	case digit >= '0' && digit <= '9':
+		return byte(digit - '0'), true
+	case digit == '*':
+		return 10, true
+	case digit == '#':
+		return 11, true
+	case digit >= 'A' && digit <= 'D':
+		return byte(digit-'A') + 12, true
+	}
+	return 0, false
+}
+
+// dtmfRequest is a sequence of digits to send
+type dtmfRequest struct {
+	events []byte
+	done   chan struct{} // Closed once every digit has been sent
+}
+
+// dtmfFrame is what the media clock sends on one tick while digits are pending
+type dtmfFrame struct {
+	payload []byte // RFC 4733 event payload, nil for inter-digit silence
+	start   bool   // First packet of an event: new RTP timestamp and marker bit
+}
+
+// dtmfSender sequences queued digits into RFC 4733 telephone-events, one
+// frame per media clock tick. Outgoing audio waits while digits are sent.
+type dtmfSender struct {
+	queue    []*dtmfRequest
+	position int // Index of the current digit in queue[0]
+	frame    int // Frames sent of the current digit, including its gap
+	mu       sync.Mutex
+}
+
+// Enqueue validates digits and queues them. The returned channel is closed
+// once they have all been sent.
+func (d *dtmfSender) Enqueue(digits string) (<-chan struct{}, error) {
+	digits = strings.ToUpper(strings.TrimSpace(digits))
+	if digits == "" {
+		return nil, fmt.Errorf("no digits to send")
+	}
+	if len(digits) > maxDTMFDigits {
+		return nil, fmt.Errorf("at most %d digits can be sent at once", maxDTMFDigits)
+	}
+
+	request := &dtmfRequest{done: make(chan struct{})}
+	for _, digit := range digits {
+		code, ok := dtmfEventCode(digit)
+		if !ok {
+			return nil, fmt.Errorf("invalid DTMF digit %q (want 0-9, *, #, A-D)", digit)
+		}
+		request.events = append(request.events, code)
+	}
+
+	d.mu.Lock()
+	d.queue = append(d.queue, request)
+	d.mu.Unlock()
+
+	return request.done, nil
+}
+
+// next returns the frame for this tick, or false if no digits are pending
+func (d *dtmfSender) next() (dtmfFrame, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.queue) == 0 {
+		return dtmfFrame{}, false
+	}
+
+	request := d.queue[0]
+	event := request.events[d.position]
+	toneFrames := dtmfToneFrames + dtmfEndRepeats - 1
+
+	var frame dtmfFrame
+	if d.frame < toneFrames {
+		// The duration grows with every packet until the end packet, which is repeated
+		elapsed := d.frame + 1
+		if elapsed > dtmfToneFrames {
+			elapsed = dtmfToneFrames
+		}
+		payload := make([]byte, 4)
+		payload[0] = event
+		payload[1] = dtmfVolume
+		if d.frame >= dtmfToneFrames-1 {
+			payload[1] |= 0x80 // End bit
+		}
+		binary.BigEndian.PutUint16(payload[2:], uint16(elapsed*rtpSamplesPerFrame))
+		frame = dtmfFrame{payload: payload, start: d.frame == 0}
+	}
+
+	d.frame++
+	if d.frame == toneFrames+dtmfGapFrames {
+		d.frame = 0
+		d.position++
+		if d.position == len(request.events) {
+			d.position = 0
+			d.queue = d.queue[1:]
+			close(request.done)
+		}
+	}
+
+	return frame, true
+}
+
+// parseSDPTelephoneEvent returns the payload type of telephone-event/8000
+// (RFC 4733) in the first audio stream of an SDP body, or 0 if it is not offered
+func parseSDPTelephoneEvent(sdpBody string) uint8 {
+	var sd sdp.SessionDescription
+	if err := sd.Unmarshal([]byte(sdpBody)); err != nil {
+		return 0
+	}
+
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Media != "audio" {
+			continue
+		}
+		for _, format := range md.MediaName.Formats {
+			var payloadType uint8
+			if _, err := fmt.Sscanf(format, "%d", &payloadType); err != nil {
+				continue
+			}
+			codecInfo, err := sd.GetCodecForPayloadType(payloadType)
+			if err != nil {
+				continue
+			}
+			if strings.EqualFold(codecInfo.Name, "telephone-event") && codecInfo.ClockRate == 8000 {
+				return payloadType
+			}
+		}
+		break
+	}
+
+	return 0
+}
+
+// SendDTMF queues digits to be sent to the far end as RFC 4733 events. The
+// returned channel is closed once they have been sent.
+func (s *Session) SendDTMF(digits string) (<-chan struct{}, error) {
+	if s.dtmfPayloadType == 0 {
+		return nil, fmt.Errorf("the far end did not offer telephone-event, DTMF cannot be sent")
+	}
+	return s.dtmf.Enqueue(digits)
+}
+
+// sendDTMFFrame sends the next telephone-event packet (or inter-digit
+// silence) if digits are pending, and reports whether it used this tick.
+// Like sendRTPFrame it advances the media clock whether or not it can send.
+func (s *Session) sendDTMFFrame(silence []byte) bool {
+	frame, ok := s.dtmf.next()
+	if !ok {
+		return false
+	}
+	if frame.payload == nil {
+		s.sendRTPFrame(nil, silence)
+		return true
+	}
+
+	// All packets of an event carry the timestamp of its start
+	s.rtpStateMux.Lock()
+	sequenceNumber := s.rtpSequence
+	if frame.start {
+		s.dtmfTimestamp = s.rtpTimestamp
+	}
+	timestamp := s.dtmfTimestamp
+	ssrc := s.rtpSSRC
+	s.rtpSequence++
+	s.rtpTimestamp += rtpSamplesPerFrame
+	// Audio after the digits starts a new talkspurt
+	s.rtpInTalkspurt = false
+	s.rtpStateMux.Unlock()
+
+	// Keep the recording's channels aligned
+	if s.recorder != nil {
+		s.recorder.WriteFrame(silence)
+	}
+
+	remoteAddr := s.getRemoteRTPAddr()
+	if remoteAddr == nil || s.IsOnHold() {
+		return true
+	}
+
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         frame.start,
+			PayloadType:    s.dtmfPayloadType,
+			SequenceNumber: sequenceNumber,
+			Timestamp:      timestamp,
+			SSRC:           ssrc,
+		},
+		Payload: frame.payload,
+	}
+	rtpBytes, err := packet.Marshal()
+	if err != nil {
+		slog.Error("Failed to marshal DTMF packet",
+			"event", "marshal_failed",
+			"session", s.CallID,
+			"error", err.Error())
+		return true
+	}
+
+	if _, err := s.rtpConn.WriteToUDP(rtpBytes, remoteAddr); err != nil {
+		slog.Error("RTP send error",
+			"event", "rtp_send_error",
+			"session", s.CallID,
+			"to", remoteAddr.String(),
+			"error", err.Error())
+	}
+	return true
+}
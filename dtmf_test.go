@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func TestDTMFSenderSequence(t *testing.T) {
+	var d dtmfSender
+	done, err := d.Enqueue("5#")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every digit: the duration grows by a frame per packet, the end packet
+	// is sent three times, then 60ms of silence
+	type packet struct {
+		duration int
+		end      bool
+		start    bool
+	}
+	digit := []packet{
+		{160, false, true}, {320, false, false}, {480, false, false}, {640, false, false},
+		{800, true, false}, {800, true, false}, {800, true, false},
+		{}, {}, {}, // Gap
+	}
+
+	for i, event := range []byte{5, 11} {
+		for j, want := range digit {
+			frame, ok := d.next()
+			if !ok {
+				t.Fatalf("digit %d frame %d: no frame", i, j)
+			}
+			if want.duration == 0 {
+				if frame.payload != nil {
+					t.Fatalf("digit %d frame %d: event during the gap", i, j)
+				}
+				continue
+			}
+			if len(frame.payload) != 4 {
+				t.Fatalf("digit %d frame %d: payload of %d bytes", i, j, len(frame.payload))
+			}
+			end := frame.payload[1]&0x80 != 0
+			duration := int(binary.BigEndian.Uint16(frame.payload[2:]))
+			if frame.payload[0] != event || frame.payload[1]&0x3f != dtmfVolume || duration != want.duration || end != want.end || frame.start != want.start {
+				t.Fatalf("digit %d frame %d: event %d volume %d duration %d end %v start %v, want event %d duration %d end %v start %v",
+					i, j, frame.payload[0], frame.payload[1]&0x3f, duration, end, frame.start, event, want.duration, want.end, want.start)
+			}
+		}
+
+		select {
+		case <-done:
+			if i == 0 {
+				t.Fatal("done closed before the last digit was sent")
+			}
+		default:
+			if i == 1 {
+				t.Fatal("done not closed after the last digit")
+			}
+		}
+	}
+
+	if _, ok := d.next(); ok {
+		t.Fatal("frame returned with no digits pending")
+	}
+}
+
+func TestDTMFEnqueueValidation(t *testing.T) {
+	tests := []struct {
+		digits string
+		valid  bool
+	}{
+		{"0123456789*#ABCD", true},
+		{" abcd ", true},
+		{"", false},
+		{"12E", false},
+		{"1 2", false},
+		{"123456789012345678901234567890123", false}, // Over maxDTMFDigits
+	}
+	for _, test := range tests {
+		var d dtmfSender
+		if _, err := d.Enqueue(test.digits); (err == nil) != test.valid {
+			t.Errorf("Enqueue(%q) error %v, want valid %v", test.digits, err, test.valid)
+		}
+	}
+}
+
+func TestParseSDPTelephoneEvent(t *testing.T) {
+	offer := "v=0\r\no=- 1 1 IN IP4 192.0.2.1\r\ns=-\r\nc=IN IP4 192.0.2.1\r\nt=0 0\r\n" +
+		"m=audio 4000 RTP/AVP 0 8 %s\r\na=rtpmap:0 PCMU/8000\r\na=rtpmap:8 PCMA/8000\r\n%s"
+
+	tests := []struct {
+		name string
+		sdp  string
+		want uint8
+	}{
+		{"offered", fmt.Sprintf(offer, "101", "a=rtpmap:101 telephone-event/8000\r\na=fmtp:101 0-16\r\n"), 101},
+		{"wideband only", fmt.Sprintf(offer, "102", "a=rtpmap:102 telephone-event/16000\r\n"), 0},
+		{"not offered", fmt.Sprintf(offer, "", ""), 0},
+		{"invalid", "not sdp", 0},
+	}
+	for _, test := range tests {
+		if got := parseSDPTelephoneEvent(test.sdp); got != test.want {
+			t.Errorf("%s: payload type %d, want %d", test.name, got, test.want)
+		}
+	}
+}
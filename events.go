@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Bridge event types
+const (
+	BridgeEventParticipantJoined = "participant_joined" // A participant was added
+	BridgeEventParticipantLeft   = "participant_left"   // A participant was removed, or the bridge stopped
+	BridgeEventParticipantClosed = "participant_closed" // A participant's writer reported io.ErrClosedPipe and it was removed
+	BridgeEventQueueFlushed      = "queue_flushed"      // A participant's queue was flushed (one per participant)
+	BridgeEventFlushed           = "bridge_flushed"     // FlushQueues completed, e.g. on interruption
+	BridgeEventChunkDropped      = "chunk_dropped"      // A participant's queue was full and a chunk was dropped
+	BridgeEventStopped           = "bridge_stopped"     // The bridge stopped; the last event of every subscription
+)
+
+// defaultBridgeEventBuffer is the channel size of a subscription
+const defaultBridgeEventBuffer = 64
+
+// BridgeEvent is a lifecycle event of a media bridge
+type BridgeEvent struct {
+	Type        string
+	Time        time.Time
+	Participant string // Empty for bridge-wide events
+	Reason      string // participant_left: "removed" or "bridge_stopped"; chunk_dropped: the drop policy
+	Count       int    // chunk_dropped: drops so far; queue_flushed: chunks discarded; bridge_flushed: participants flushed
+	Total       int    // Participants in the bridge after joins, leaves and bridge_flushed
+}
+
+// BridgeEvents fans bridge events out to subscribers. Publishing never blocks
+// the media path: a subscriber that does not keep up misses events.
+type BridgeEvents struct {
+	subscribers map[chan BridgeEvent]struct{}
+	closed      bool
+	mu          sync.Mutex
+}
+
+// newBridgeEvents creates an event bus without subscribers
+func newBridgeEvents() *BridgeEvents {
+	return &BridgeEvents{subscribers: make(map[chan BridgeEvent]struct{})}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// and a function that cancels the subscription. The channel is closed after
+// BridgeEventStopped or on cancel. buffer <= 0 uses defaultBridgeEventBuffer.
+func (b *BridgeEvents) Subscribe(buffer int) (<-chan BridgeEvent, func()) {
+	if buffer <= 0 {
+		buffer = defaultBridgeEventBuffer
+	}
+	events := make(chan BridgeEvent, buffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(events)
+		return events, func() {}
+	}
+	b.subscribers[events] = struct{}{}
+
+	return events, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[events]; ok {
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// publish sends an event to every subscriber that has room for it
+func (b *BridgeEvents) publish(event BridgeEvent) {
+	event.Time = time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+			slog.Warn("Bridge event subscriber full, dropping event",
+				"event", "bridge_event_dropped",
+				"type", event.Type,
+				"participant", event.Participant)
+		}
+	}
+}
+
+// close publishes BridgeEventStopped and ends every subscription. The stop
+// event is delivered even to a full subscriber, replacing its oldest event.
+func (b *BridgeEvents) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	stopped := BridgeEvent{Type: BridgeEventStopped, Time: time.Now()}
+	for events := range b.subscribers {
+		select {
+		case events <- stopped:
+		default:
+			select {
+			case <-events:
+			default:
+			}
+			events <- stopped
+		}
+		close(events)
+		delete(b.subscribers, events)
+	}
+}
+
+// watchBridgeEvents exports a session bridge's events as metrics: a count of
+// events by type, and the bridge's participants in a gauge summed over all
+// calls. It returns once the bridge has stopped.
+func watchBridgeEvents(events <-chan BridgeEvent) {
+	participants := metrics.Gauge("sip_proxy_bridge_participants",
+		"Participants in the media bridges of active calls")
+	total := 0
+	for event := range events {
+		metrics.Counter("sip_proxy_bridge_events_total",
+			"Media bridge lifecycle events, by type", "type", event.Type).Inc()
+
+		switch event.Type {
+		case BridgeEventParticipantJoined, BridgeEventParticipantLeft, BridgeEventParticipantClosed, BridgeEventFlushed:
+			// Totals are absolute, so a missed event is corrected by the next one
+			participants.Add(float64(event.Total - total))
+			total = event.Total
+		}
+	}
+	participants.Add(float64(-total))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// receive returns the next event of a subscription
+func receive(t *testing.T, events <-chan BridgeEvent) BridgeEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+		return BridgeEvent{}
+	}
+}
+
+// seriesValue reads the current value of a counter or gauge series
+func seriesValue(s *metricSeries) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.value
+}
+
+func TestBridgeEventsOrdering(t *testing.T) {
+	bus := newBridgeEvents()
+	first, _ := bus.Subscribe(0)
+	second, _ := bus.Subscribe(0)
+
+	types := []string{BridgeEventParticipantJoined, BridgeEventQueueFlushed, BridgeEventFlushed, BridgeEventParticipantLeft}
+	for _, eventType := range types {
+		bus.publish(BridgeEvent{Type: eventType})
+	}
+	bus.close()
+
+	for _, events := range []<-chan BridgeEvent{first, second} {
+		for _, want := range append(types, BridgeEventStopped) {
+			if event := receive(t, events); event.Type != want {
+				t.Fatalf("got %s, want %s", event.Type, want)
+			}
+		}
+		if _, ok := <-events; ok {
+			t.Fatal("subscription not closed after bridge_stopped")
+		}
+	}
+}
+
+func TestBridgeEventsSlowSubscriber(t *testing.T) {
+	bus := newBridgeEvents()
+	slow, _ := bus.Subscribe(2)
+	fast, _ := bus.Subscribe(10)
+
+	for i := 1; i <= 5; i++ {
+		bus.publish(BridgeEvent{Type: BridgeEventChunkDropped, Count: i})
+	}
+
+	// The slow subscriber misses what did not fit without holding up the others
+	for _, want := range []int{1, 2} {
+		if event := receive(t, slow); event.Count != want {
+			t.Fatalf("slow subscriber got event %d, want %d", event.Count, want)
+		}
+	}
+	for want := 1; want <= 5; want++ {
+		if event := receive(t, fast); event.Count != want {
+			t.Fatalf("fast subscriber got event %d, want %d", event.Count, want)
+		}
+	}
+
+	// bridge_stopped is delivered even to a full subscriber
+	bus.publish(BridgeEvent{Type: BridgeEventFlushed})
+	bus.publish(BridgeEvent{Type: BridgeEventFlushed})
+	bus.close()
+	var last BridgeEvent
+	for event := range slow {
+		last = event
+	}
+	if last.Type != BridgeEventStopped {
+		t.Fatalf("last event of a full subscriber is %s, want %s", last.Type, BridgeEventStopped)
+	}
+}
+
+func TestBridgeEventsUnsubscribe(t *testing.T) {
+	bus := newBridgeEvents()
+	events, cancel := bus.Subscribe(0)
+	cancel()
+	cancel() // Idempotent
+
+	if _, ok := <-events; ok {
+		t.Fatal("subscription not closed on cancel")
+	}
+	bus.publish(BridgeEvent{Type: BridgeEventParticipantJoined})
+	bus.close()
+
+	late, _ := bus.Subscribe(0)
+	if _, ok := <-late; ok {
+		t.Fatal("subscription to a stopped bridge not closed")
+	}
+}
+
+func TestWatchBridgeEventsCountsParticipants(t *testing.T) {
+	participants := metrics.Gauge("sip_proxy_bridge_participants", "")
+	joined := metrics.Counter("sip_proxy_bridge_events_total", "", "type", BridgeEventParticipantJoined)
+	before, joinedBefore := seriesValue(participants.series), seriesValue(joined.series)
+
+	bus := newBridgeEvents()
+	events, _ := bus.Subscribe(0)
+	done := make(chan struct{})
+	go func() {
+		watchBridgeEvents(events)
+		close(done)
+	}()
+
+	bus.publish(BridgeEvent{Type: BridgeEventParticipantJoined, Total: 1})
+	bus.publish(BridgeEvent{Type: BridgeEventParticipantJoined, Total: 2})
+	bus.publish(BridgeEvent{Type: BridgeEventParticipantLeft, Total: 1})
+	deadline := time.Now().Add(time.Second)
+	for seriesValue(participants.series) != before+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("participants gauge is %v, want %v", seriesValue(participants.series), before+1)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := seriesValue(joined.series) - joinedBefore; got != 2 {
+		t.Fatalf("counted %v joins, want 2", got)
+	}
+
+	// Participants still in the bridge are subtracted when it stops
+	bus.close()
+	<-done
+	if got := seriesValue(participants.series); got != before {
+		t.Fatalf("participants gauge is %v after the bridge stopped, want %v", got, before)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session end reasons of extractors
+const (
+	endReasonExtractionMatched = "extraction_matched"
+	endReasonExtractionTimeout = "extraction_timeout"
+)
+
+// ExtractorConfig extracts a value from what the AI says, e.g. an intent
+// category the instructions ask the model to state as "[INTENT] 2"
+type ExtractorConfig struct {
+	Name           string   `json:"name"`                      // Key the value is stored and reported under
+	Tag            string   `json:"tag,omitempty"`             // Extracts the text after "[TAG]", or TAG starting a sentence (case-insensitive)
+	Pattern        string   `json:"pattern,omitempty"`         // Or a regular expression; the value is its first group, or the whole match
+	EndValues      []string `json:"end_values,omitempty"`      // Values that end the call once extracted
+	TimeoutSeconds float64  `json:"timeout_seconds,omitempty"` // End the call if no end value is extracted within this long
+}
+
+// ExtractedValue is the latest value of an extractor
+type ExtractedValue struct {
+	Value string    `json:"value"`
+	Text  string    `json:"text"` // The AI turn it was extracted from
+	At    time.Time `json:"at"`
+}
+
+// ExtractionPayload is POSTed to the extraction webhook for every extracted value
+type ExtractionPayload struct {
+	CallID string    `json:"call_id"`
+	Name   string    `json:"name"`
+	Value  string    `json:"value"`
+	Text   string    `json:"text"`
+	At     time.Time `json:"at"`
+	Ends   bool      `json:"ends_call"` // The value is an end value and the call is being ended
+}
+
+// extractor is a compiled ExtractorConfig
+type extractor struct {
+	config  ExtractorConfig
+	pattern *regexp.Regexp
+}
+
+// newExtractor compiles an extractor configuration
+func newExtractor(config ExtractorConfig) (*extractor, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("extractor name is required")
+	}
+
+	var expr string
+	switch {
+	case config.Tag != "" && config.Pattern != "":
+		return nil, fmt.Errorf("set either tag or pattern, not both")
+	case config.Tag != "":
+		// Transcriptions may drop the brackets, but an unbracketed tag only
+		// counts at the start of a line or sentence, so the AI merely saying
+		// the word does not match. The value runs to the end of its line or
+		// sentence, or to the next tag; punctuation inside a word or number
+		// (e.g. "2.5") does not end it.
+		tag := regexp.QuoteMeta(config.Tag)
+		expr = `(?im)(?:\[\s*` + tag + `\s*\]|(?:^\s*|[.!?]\s+)` + tag + `\b)\s*:?\s*` +
+			`([^\[\]\n.!?]+(?:[.!?][^\s\[\]][^\[\]\n.!?]*)*)`
+	case config.Pattern != "":
+		expr = config.Pattern
+	default:
+		return nil, fmt.Errorf("a tag or a pattern is required")
+	}
+
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	return &extractor{config: config, pattern: pattern}, nil
+}
+
+// extract returns the last value found in text
+func (e *extractor) extract(text string) (string, bool) {
+	matches := e.pattern.FindAllStringSubmatch(text, -1)
+	if len(matches) == 0 {
+		return "", false
+	}
+	match := matches[len(matches)-1]
+	value := match[0]
+	if len(match) > 1 {
+		value = match[1]
+	}
+	value = strings.TrimSpace(value)
+	return value, value != ""
+}
+
+// isEndValue reports whether value is one of the end values. A value also
+// matches when it starts with an end value followed by a non-alphanumeric
+// character, so "2 + promises to pay" matches the category "2".
+func (e *extractor) isEndValue(value string) bool {
+	for _, end := range e.config.EndValues {
+		if len(value) < len(end) || !strings.EqualFold(value[:len(end)], end) {
+			continue
+		}
+		if len(value) == len(end) {
+			return true
+		}
+		next := value[len(end)]
+		if !(next >= '0' && next <= '9' || next >= 'a' && next <= 'z' || next >= 'A' && next <= 'Z') {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyIntentExtractor converts the end_on_intent fields of the callback
+// response into an extractor of "[INTENT] <category>" lines
+func legacyIntentExtractor(sessionConfig *SessionConfig) *ExtractorConfig {
+	if !sessionConfig.EndOnIntent {
+		return nil
+	}
+
+	config := &ExtractorConfig{
+		Name:           "intent",
+		Tag:            "INTENT",
+		TimeoutSeconds: float64(sessionConfig.IntentTimeoutSeconds),
+	}
+	for _, category := range sessionConfig.IntentEndCategories {
+		config.EndValues = append(config.EndValues, strconv.Itoa(category))
+	}
+	return config
+}
+
+// Extraction runs a session's extractors on every AI turn of its transcript
+type Extraction struct {
+	server     *SIPServer
+	session    *Session
+	extractors []*extractor
+	webhookURL string
+	values     map[string]ExtractedValue // Latest value by extractor name
+	ending     bool
+	started    sync.Once
+	mu         sync.Mutex
+}
+
+// startExtraction sets up the extractors requested by the session config, if
+// any. Invalid extractors are logged and skipped. Their timeouts only start
+// with startTimeouts, once the AI has opened the conversation.
+func (s *SIPServer) startExtraction(session *Session, sessionConfig *SessionConfig) {
+	configs := sessionConfig.Extractors
+	if legacy := legacyIntentExtractor(sessionConfig); legacy != nil {
+		configs = append(configs, *legacy)
+	}
+	if len(configs) == 0 {
+		return
+	}
+
+	x := &Extraction{
+		server:     s,
+		session:    session,
+		webhookURL: extractionWebhookURL(s.config, sessionConfig),
+		values:     make(map[string]ExtractedValue),
+	}
+	for _, config := range configs {
+		e, err := newExtractor(config)
+		if err != nil {
+			slog.Error("Skipping invalid extractor",
+				"event", "extractor_invalid",
+				"session", session.CallID,
+				"extractor", config.Name,
+				"error", err.Error())
+			continue
+		}
+		x.extractors = append(x.extractors, e)
+	}
+	if len(x.extractors) == 0 {
+		return
+	}
+
+	session.extraction = x
+	session.MediaHandler.Transcript().OnTurn(x.onTurn)
+}
+
+// startTimeouts starts the timeout of every extractor that has one. It is
+// called when the AI opens the conversation, so that time spent on the intro
+// prompt and connecting the AI does not count against the timeout.
+func (x *Extraction) startTimeouts() {
+	x.started.Do(func() {
+		for _, e := range x.extractors {
+			if e.config.TimeoutSeconds > 0 && len(e.config.EndValues) > 0 {
+				go x.timeout(e, time.Duration(e.config.TimeoutSeconds*float64(time.Second)))
+			}
+		}
+	})
+}
+
+// extractionWebhookURL returns where extracted values are pushed: the session
+// config's URL, --extraction-webhook-url, or else the callback URL's /intent
+// endpoint
+func extractionWebhookURL(config *Config, sessionConfig *SessionConfig) string {
+	switch {
+	case sessionConfig.ExtractionWebhookURL != "":
+		return sessionConfig.ExtractionWebhookURL
+	case config.ExtractionWebhookURL != "":
+		return config.ExtractionWebhookURL
+	case config.CallbackURL != "":
+		return strings.TrimSuffix(config.CallbackURL, "/") + "/intent"
+	}
+	return ""
+}
+
+// onTurn runs the extractors on a closed AI turn. It is called on the
+// AI's receive goroutine, so webhooks and hangups run in the background.
+func (x *Extraction) onTurn(turn TranscriptTurn) {
+	if turn.Speaker != SpeakerAI {
+		return
+	}
+
+	for _, e := range x.extractors {
+		value, ok := e.extract(turn.Text)
+		if !ok {
+			continue
+		}
+
+		ends := e.isEndValue(value)
+		x.mu.Lock()
+		x.values[e.config.Name] = ExtractedValue{Value: value, Text: turn.Text, At: turn.EndedAt}
+		if ends {
+			ends = !x.ending
+			x.ending = true
+		}
+		x.mu.Unlock()
+
+		slog.Info("Extracted value from AI speech",
+			"event", "extraction_value",
+			"session", x.session.CallID,
+			"extractor", e.config.Name,
+			"value", value,
+			"ends_call", ends)
+
+		payload := ExtractionPayload{
+			CallID: x.session.CallID,
+			Name:   e.config.Name,
+			Value:  value,
+			Text:   turn.Text,
+			At:     turn.EndedAt,
+			Ends:   ends,
+		}
+		go x.notify(payload)
+
+		if ends {
+			go x.end(endReasonExtractionMatched)
+		}
+	}
+}
+
+// timeout ends the call unless an end value of e is extracted within timeout
+func (x *Extraction) timeout(e *extractor, timeout time.Duration) {
+	select {
+	case <-time.After(timeout):
+	case <-x.session.stopRTP:
+		return
+	}
+
+	x.mu.Lock()
+	value, extracted := x.values[e.config.Name]
+	if x.ending || (extracted && e.isEndValue(value.Value)) {
+		x.mu.Unlock()
+		return
+	}
+	x.ending = true
+	x.mu.Unlock()
+
+	slog.Info("No end value extracted in time, ending the call",
+		"event", "extraction_timeout",
+		"session", x.session.CallID,
+		"extractor", e.config.Name,
+		"timeout", timeout.String())
+	x.end(endReasonExtractionTimeout)
+}
+
+// end hangs up once the AI has finished speaking
+func (x *Extraction) end(reason string) {
+	x.session.waitForPlayout(maxPlayoutWait)
+	if x.server.getSession(x.session.CallID) == x.session {
+		x.server.hangupSession(x.session, reason, "")
+	}
+}
+
+// notify pushes an extracted value to the extraction webhook
+func (x *Extraction) notify(payload ExtractionPayload) {
+	if x.webhookURL == "" {
+		return
+	}
+	if err := x.server.postWebhook(x.webhookURL, payload); err != nil {
+		slog.Error("Extraction webhook failed",
+			"event", "extraction_webhook_failed",
+			"session", x.session.CallID,
+			"extractor", payload.Name,
+			"error", err.Error())
+	}
+}
+
+// Values returns the latest value of every extractor that has matched
+func (x *Extraction) Values() map[string]ExtractedValue {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	values := make(map[string]ExtractedValue, len(x.values))
+	for name, value := range x.values {
+		values[name] = value
+	}
+	return values
+}
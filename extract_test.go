@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExtractorTag(t *testing.T) {
+	e, err := newExtractor(ExtractorConfig{Name: "intent", Tag: "INTENT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text  string
+		value string // Empty for no match
+	}{
+		{"Great, tomorrow it is. [INTENT] 2 + promises to pay tomorrow", "2 + promises to pay tomorrow"},
+		{"[intent]: 5", "5"},
+		{"[ INTENT ] 3. Is there anything else?", "3"},
+		{"Intent: 4", "4"},
+		{"Thanks for calling. INTENT 1. Goodbye!", "1"},
+		{"Noted.\nINTENT 2 - wants a callback\nAnything else?", "2 - wants a callback"},
+		{"[INTENT] 2.5 partial payment", "2.5 partial payment"},
+		{"[INTENT] 1 [NOTE] prefers email", "1"},
+		{"[INTENT] 1, then later [INTENT] 3", "3"}, // The last value wins
+		// The word alone, mid-sentence, is not a tag
+		{"What is the intent of your call?", ""},
+		{"I understand your intent 2 pay.", ""},
+		{"[INTENT]", ""},
+	}
+	for _, test := range tests {
+		value, ok := e.extract(test.text)
+		if ok != (test.value != "") || value != test.value {
+			t.Errorf("extract(%q) = %q, %v; want %q", test.text, value, ok, test.value)
+		}
+	}
+}
+
+func TestExtractorPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		text    string
+		value   string
+	}{
+		{`call back on (\w+)`, "Sure, I'll call back on Friday.", "Friday"},
+		{`\d{4}-\d{2}-\d{2}`, "Booked for 2025-01-03 at noon", "2025-01-03"},
+		{`call back on (\w+)`, "No callback needed", ""},
+	}
+	for _, test := range tests {
+		e, err := newExtractor(ExtractorConfig{Name: "x", Pattern: test.pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := e.extract(test.text); value != test.value {
+			t.Errorf("pattern %s on %q = %q, want %q", test.pattern, test.text, value, test.value)
+		}
+	}
+}
+
+func TestNewExtractorErrors(t *testing.T) {
+	for _, config := range []ExtractorConfig{
+		{Tag: "INTENT"},
+		{Name: "x"},
+		{Name: "x", Tag: "INTENT", Pattern: "x"},
+		{Name: "x", Pattern: "("},
+	} {
+		if _, err := newExtractor(config); err == nil {
+			t.Errorf("newExtractor(%+v) succeeded", config)
+		}
+	}
+}
+
+func TestExtractorIsEndValue(t *testing.T) {
+	e := &extractor{config: ExtractorConfig{EndValues: []string{"2", "done"}}}
+	tests := []struct {
+		value string
+		ends  bool
+	}{
+		{"2", true},
+		{"2 + promises to pay", true},
+		{"2-wants a callback", true},
+		{"DONE", true},
+		{"done, thanks", true},
+		{"20", false},
+		{"2a", false},
+		{"doneness", false},
+		{"12", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := e.isEndValue(test.value); got != test.ends {
+			t.Errorf("isEndValue(%q) = %v, want %v", test.value, got, test.ends)
+		}
+	}
+}
+
+func TestLegacyIntentExtractor(t *testing.T) {
+	if legacyIntentExtractor(&SessionConfig{IntentEndCategories: []int{2}}) != nil {
+		t.Fatal("extractor created without end_on_intent")
+	}
+
+	config := legacyIntentExtractor(&SessionConfig{EndOnIntent: true, IntentEndCategories: []int{2, 5}, IntentTimeoutSeconds: 90})
+	if config.Tag != "INTENT" || config.TimeoutSeconds != 90 || len(config.EndValues) != 2 || config.EndValues[1] != "5" {
+		t.Fatalf("unexpected legacy extractor %+v", config)
+	}
+}
+
+// newTestExtraction runs one extractor on a live session
+func newTestExtraction(t *testing.T, config ExtractorConfig) (*Extraction, *Session) {
+	session := &Session{
+		CallID:         "call-1",
+		rtpPacketQueue: make(chan []byte, 4),
+		stopRTP:        make(chan struct{}),
+		stopRTPSender:  make(chan struct{}),
+	}
+	server := &SIPServer{config: &Config{}, sessions: map[string]*Session{session.CallID: session}}
+	e, err := newExtractor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := &Extraction{
+		server:     server,
+		session:    session,
+		extractors: []*extractor{e},
+		values:     make(map[string]ExtractedValue),
+	}
+	return x, session
+}
+
+func TestExtractionTimeoutStartsWhenOpened(t *testing.T) {
+	x, session := newTestExtraction(t, ExtractorConfig{Name: "intent", Tag: "INTENT", EndValues: []string{"2"}, TimeoutSeconds: 0.05})
+
+	// The intro prompt and connecting the AI do not count
+	select {
+	case <-session.stopRTP:
+		t.Fatal("call ended before the conversation was opened")
+	case <-time.After(150 * time.Millisecond):
+	}
+
+	x.startTimeouts()
+	x.startTimeouts() // Once per session
+	select {
+	case <-session.stopRTP:
+	case <-time.After(playoutQuietPeriod + 2*time.Second):
+		t.Fatal("call not ended after the extraction timeout")
+	}
+	if session.EndReason != endReasonExtractionTimeout {
+		t.Fatalf("end reason %q, want %s", session.EndReason, endReasonExtractionTimeout)
+	}
+}
+
+func TestExtractionEndsOnEndValue(t *testing.T) {
+	x, session := newTestExtraction(t, ExtractorConfig{Name: "intent", Tag: "INTENT", EndValues: []string{"2"}})
+
+	x.onTurn(TranscriptTurn{Speaker: SpeakerCaller, Text: "[INTENT] 2"})
+	x.onTurn(TranscriptTurn{Speaker: SpeakerAI, Text: "Let me check. [INTENT] 1"})
+	if value := x.Values()["intent"].Value; value != "1" {
+		t.Fatalf("extracted %q, want 1 (and not from the caller)", value)
+	}
+
+	x.onTurn(TranscriptTurn{Speaker: SpeakerAI, Text: "See you tomorrow. [INTENT] 2 + promises to pay"})
+	select {
+	case <-session.stopRTP:
+	case <-time.After(playoutQuietPeriod + 2*time.Second):
+		t.Fatal("call not ended on an end value")
+	}
+	if session.EndReason != endReasonExtractionMatched {
+		t.Fatalf("end reason %q, want %s", session.EndReason, endReasonExtractionMatched)
+	}
+}
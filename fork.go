@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// forkConnectTimeout bounds the WebSocket handshake with the consumer
+	forkConnectTimeout = 10 * time.Second
+	// forkWriteTimeout bounds a single write; a consumer that stalls longer is disconnected
+	forkWriteTimeout = 2 * time.Second
+	// forkOutboundQueueSize is how many 20ms frames of the AI's audio wait for the consumer
+	forkOutboundQueueSize = 50
+)
+
+// Media fork framings
+const (
+	ForkFramingJSON   = "json"   // Every message is JSON; audio is base64 in "media" events
+	ForkFramingBinary = "binary" // Control messages are JSON; audio is sent as binary frames
+)
+
+// Media fork tracks, as in Twilio Media Streams
+const (
+	forkTrackInbound  = "inbound"  // The caller
+	forkTrackOutbound = "outbound" // The AI
+)
+
+// MediaForkConfig enables streaming a call's audio to a WebSocket consumer
+type MediaForkConfig struct {
+	URL        string            `json:"url"`                   // ws:// or wss:// URL of the consumer
+	Framing    string            `json:"framing,omitempty"`     // "json" (default) or "binary"
+	Encoding   string            `json:"encoding,omitempty"`    // "pcmu" (default) or "pcm16"
+	SampleRate int               `json:"sample_rate,omitempty"` // Default 8000
+	Headers    map[string]string `json:"headers,omitempty"`     // Sent with the handshake, e.g. Authorization
+	Parameters map[string]string `json:"parameters,omitempty"`  // Passed through in the start message
+}
+
+// forkMessage is a JSON message sent to the consumer. The shape follows
+// Twilio Media Streams so that existing consumers work unchanged.
+type forkMessage struct {
+	Event          string     `json:"event"`
+	SequenceNumber string     `json:"sequenceNumber,omitempty"`
+	StreamSID      string     `json:"streamSid,omitempty"`
+	Protocol       string     `json:"protocol,omitempty"`
+	Version        string     `json:"version,omitempty"`
+	Start          *forkStart `json:"start,omitempty"`
+	Media          *forkMedia `json:"media,omitempty"`
+	Stop           *forkStop  `json:"stop,omitempty"`
+}
+
+// forkStart is the metadata of a "start" event
+type forkStart struct {
+	StreamSID        string            `json:"streamSid"`
+	CallSID          string            `json:"callSid"`
+	From             string            `json:"from"`
+	To               string            `json:"to"`
+	Tracks           []string          `json:"tracks"`
+	CustomParameters map[string]string `json:"customParameters,omitempty"`
+	MediaFormat      forkMediaFormat   `json:"mediaFormat"`
+}
+
+// forkMediaFormat describes the audio in "media" events
+type forkMediaFormat struct {
+	Encoding   string `json:"encoding"`
+	SampleRate int    `json:"sampleRate"`
+	Channels   int    `json:"channels"`
+}
+
+// forkMedia is the payload of a "media" event
+type forkMedia struct {
+	Track     string `json:"track"`
+	Chunk     string `json:"chunk"`
+	Timestamp string `json:"timestamp"` // Media time of the chunk within its track, in ms
+	Payload   string `json:"payload"`
+}
+
+// forkStop is the metadata of a "stop" event
+type forkStop struct {
+	CallSID string `json:"callSid"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// MediaFork is a passive bridge participant that streams the caller's and the
+// AI's audio to a WebSocket consumer, labeled by direction. It is never heard.
+//
+// The caller's audio is written from the fork's bridge queue. The AI's audio
+// is tapped from the RTP sender as it goes out, like the recorder does, so
+// audio the AI generated but that was flushed on barge-in never reaches the
+// consumer. A consumer that falls behind loses audio (inbound under the
+// bridge's drop policy, outbound once forkOutboundQueueSize frames wait);
+// one that stalls for longer than forkWriteTimeout is disconnected.
+type MediaFork struct {
+	id              string
+	config          MediaForkConfig
+	format          MediaFormat
+	streamSID       string
+	session         *Session
+	inbound         string           // Participant ID of the caller
+	outbound        chan *MediaChunk // AI frames tapped from the RTP sender
+	outboundOrigin  uint32           // RTP timestamp the outbound track's media time counts from
+	outboundDropped int
+	converter       *chunkConverter // Converts outbound frames to the consumer's format
+	done            chan struct{}
+	conn            *websocket.Conn // Nil until connected
+	sequence        int
+	chunks          map[string]int // Chunks sent per track
+	closed          bool
+	mu              sync.Mutex
+}
+
+// NewMediaFork validates the configuration and creates a fork for session.
+// Call Connect to start streaming.
+func NewMediaFork(config MediaForkConfig, session *Session) (*MediaFork, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("media fork url is required")
+	}
+	if config.Framing == "" {
+		config.Framing = ForkFramingJSON
+	}
+	if config.Framing != ForkFramingJSON && config.Framing != ForkFramingBinary {
+		return nil, fmt.Errorf("invalid media fork framing %q (want %q or %q)", config.Framing, ForkFramingJSON, ForkFramingBinary)
+	}
+	if config.Encoding == "" {
+		config.Encoding = EncodingPCMU
+	}
+	if config.Encoding != EncodingPCMU && config.Encoding != EncodingPCM16 {
+		return nil, fmt.Errorf("invalid media fork encoding %q (want %q or %q)", config.Encoding, EncodingPCMU, EncodingPCM16)
+	}
+	if config.SampleRate <= 0 {
+		config.SampleRate = 8000
+	}
+
+	session.rtpStateMux.Lock()
+	origin := session.rtpTimestamp
+	session.rtpStateMux.Unlock()
+
+	id := "fork-" + session.CallID
+	format := MediaFormat{Encoding: config.Encoding, SampleRate: config.SampleRate, Channels: 1}
+	return &MediaFork{
+		id:             id,
+		config:         config,
+		format:         format,
+		streamSID:      fmt.Sprintf("MZ%016x", rand.Uint64()),
+		session:        session,
+		inbound:        session.SIPParticipant.ID(),
+		outbound:       make(chan *MediaChunk, forkOutboundQueueSize),
+		outboundOrigin: origin,
+		converter:      newChunkConverter(id, []MediaFormat{format}),
+		done:           make(chan struct{}),
+		chunks:         make(map[string]int),
+	}, nil
+}
+
+// ID returns the participant's unique identifier
+func (f *MediaFork) ID() string {
+	return f.id
+}
+
+// Writer returns io.Discard: audio is written through WriteChunk, which
+// knows which track it belongs to
+func (f *MediaFork) Writer() io.Writer {
+	return io.Discard
+}
+
+// Passive marks the fork as a tap: a mixing bridge sends it every sender's
+// audio separately instead of a mix
+func (f *MediaFork) Passive() bool {
+	return true
+}
+
+// AcceptedFormats returns the format the consumer asked for
+func (f *MediaFork) AcceptedFormats() []MediaFormat {
+	return []MediaFormat{f.format}
+}
+
+// Connect dials the consumer in the background and sends the start metadata.
+// Audio arriving before the connection is up is dropped.
+func (f *MediaFork) Connect() {
+	go f.writeOutbound()
+	go func() {
+		header := http.Header{}
+		for name, value := range f.config.Headers {
+			header.Set(name, value)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), forkConnectTimeout)
+		defer cancel()
+
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, f.config.URL, header)
+		if err != nil {
+			slog.Error("Failed to connect media fork",
+				"event", "media_fork_connect_error",
+				"session", f.session.CallID,
+				"url", f.config.URL,
+				"error", err.Error())
+			f.mu.Lock()
+			if !f.closed {
+				f.closed = true
+				close(f.done)
+			}
+			f.mu.Unlock()
+			return
+		}
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if f.closed {
+			// The call ended while connecting
+			conn.Close()
+			return
+		}
+		f.conn = conn
+
+		encoding := "audio/x-mulaw"
+		if f.format.Encoding == EncodingPCM16 {
+			encoding = "audio/x-l16"
+		}
+		err = f.sendLocked(forkMessage{Event: "connected", Protocol: "Call", Version: "1.0.0"})
+		if err == nil {
+			err = f.sendLocked(forkMessage{
+				Event:     "start",
+				StreamSID: f.streamSID,
+				Start: &forkStart{
+					StreamSID:        f.streamSID,
+					CallSID:          f.session.CallID,
+					From:             f.session.From,
+					To:               f.session.To,
+					Tracks:           []string{forkTrackInbound, forkTrackOutbound},
+					CustomParameters: f.config.Parameters,
+					MediaFormat: forkMediaFormat{
+						Encoding:   encoding,
+						SampleRate: f.format.SampleRate,
+						Channels:   f.format.Channels,
+					},
+				},
+			})
+		}
+		if err != nil {
+			f.failLocked(err)
+			return
+		}
+
+		// Control frames (ping, close) are only processed while reading
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		slog.Info("Media fork connected",
+			"event", "media_fork_start",
+			"session", f.session.CallID,
+			"stream", f.streamSID,
+			"url", f.config.URL,
+			"framing", f.config.Framing,
+			"format", f.format.String())
+	}()
+}
+
+// WriteChunk sends the caller's audio to the consumer. Other senders (e.g.
+// supervisors) are not forked, and the AI's audio is taken from WriteOutbound.
+func (f *MediaFork) WriteChunk(chunk *MediaChunk) error {
+	if chunk.SenderID != f.inbound {
+		return nil
+	}
+	return f.writeTrack(forkTrackInbound, chunk)
+}
+
+// WriteOutbound queues a frame of AI speech sent to the caller with the given
+// RTP timestamp. It is called on the RTP sender's tick and never blocks.
+func (f *MediaFork) WriteOutbound(pcmData []byte, timestamp uint32) {
+	chunk := &MediaChunk{
+		Data:      append([]byte(nil), pcmData...),
+		SenderID:  f.session.MediaHandler.ParticipantID(),
+		Format:    DefaultMediaFormat,
+		Timestamp: time.Duration(timestamp-f.outboundOrigin) * time.Second / time.Duration(DefaultMediaFormat.SampleRate),
+	}
+	select {
+	case f.outbound <- chunk:
+	default:
+		f.mu.Lock()
+		f.outboundDropped++
+		f.mu.Unlock()
+	}
+}
+
+// writeOutbound sends the tapped AI frames to the consumer until the fork is closed
+func (f *MediaFork) writeOutbound() {
+	defer f.converter.Reset()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case chunk := <-f.outbound:
+			converted := f.converter.Convert(chunk)
+			if converted == nil {
+				continue
+			}
+			if err := f.writeTrack(forkTrackOutbound, converted); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeTrack sends a chunk of one track to the consumer
+func (f *MediaFork) writeTrack(track string, chunk *MediaChunk) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return io.ErrClosedPipe
+	}
+	if f.conn == nil {
+		return nil
+	}
+
+	f.chunks[track]++
+	timestamp := chunk.Timestamp.Milliseconds()
+
+	var err error
+	if f.config.Framing == ForkFramingBinary {
+		// 1 byte track (0 inbound, 1 outbound), 4 byte big-endian timestamp in ms, audio
+		frame := make([]byte, 5+len(chunk.Data))
+		if track == forkTrackOutbound {
+			frame[0] = 1
+		}
+		binary.BigEndian.PutUint32(frame[1:5], uint32(timestamp))
+		copy(frame[5:], chunk.Data)
+		f.conn.SetWriteDeadline(time.Now().Add(forkWriteTimeout))
+		err = f.conn.WriteMessage(websocket.BinaryMessage, frame)
+	} else {
+		err = f.sendLocked(forkMessage{
+			Event:     "media",
+			StreamSID: f.streamSID,
+			Media: &forkMedia{
+				Track:     track,
+				Chunk:     strconv.Itoa(f.chunks[track]),
+				Timestamp: strconv.FormatInt(timestamp, 10),
+				Payload:   base64.StdEncoding.EncodeToString(chunk.Data),
+			},
+		})
+	}
+	if err != nil {
+		f.failLocked(err)
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+// sendLocked sends a JSON message with the next sequence number. Caller must hold the lock.
+func (f *MediaFork) sendLocked(message forkMessage) error {
+	f.sequence++
+	message.SequenceNumber = strconv.Itoa(f.sequence)
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(forkWriteTimeout))
+	return f.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// failLocked disconnects after a write error. Caller must hold the lock.
+func (f *MediaFork) failLocked(err error) {
+	slog.Error("Media fork write failed, disconnecting",
+		"event", "media_fork_error",
+		"session", f.session.CallID,
+		"stream", f.streamSID,
+		"error", err.Error())
+	f.closed = true
+	f.conn.Close()
+	close(f.done)
+}
+
+// Close sends the stop event and disconnects
+func (f *MediaFork) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return
+	}
+	f.closed = true
+	close(f.done)
+	if f.conn == nil {
+		return
+	}
+
+	err := f.sendLocked(forkMessage{
+		Event:     "stop",
+		StreamSID: f.streamSID,
+		Stop: &forkStop{
+			CallSID: f.session.CallID,
+			Reason:  f.session.EndReason,
+		},
+	})
+	if err == nil {
+		f.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(forkWriteTimeout))
+	}
+	f.conn.Close()
+
+	slog.Info("Media fork stopped",
+		"event", "media_fork_stop",
+		"session", f.session.CallID,
+		"stream", f.streamSID,
+		"inbound_chunks", f.chunks[forkTrackInbound],
+		"outbound_chunks", f.chunks[forkTrackOutbound],
+		"outbound_dropped", f.outboundDropped)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testMediaHandler is a MediaHandler that only has a participant ID
+type testMediaHandler struct {
+	MediaHandler
+	id string
+}
+
+func (h *testMediaHandler) ParticipantID() string {
+	return h.id
+}
+
+func TestMediaForkTapsOutboundAudio(t *testing.T) {
+	messages := make(chan []byte, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- data
+		}
+	}))
+	defer server.Close()
+
+	session := &Session{CallID: "fork-test", MediaHandler: &testMediaHandler{id: "ai"}, rtpTimestamp: 1000}
+	session.SIPParticipant = NewSIPParticipant("caller", nil, session)
+	fork, err := NewMediaFork(MediaForkConfig{
+		URL:      "ws" + strings.TrimPrefix(server.URL, "http"),
+		Framing:  ForkFramingBinary,
+		Encoding: EncodingPCM16,
+	}, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork.Connect()
+
+	next := func() []byte {
+		t.Helper()
+		select {
+		case data := <-messages:
+			return data
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message from the fork")
+			return nil
+		}
+	}
+	for _, event := range []string{`"connected"`, `"start"`} {
+		if data := next(); !bytes.Contains(data, []byte(event)) {
+			t.Fatalf("got %s, want the %s event", data, event)
+		}
+	}
+
+	caller := bytes.Repeat([]byte{1, 0}, rtpSamplesPerFrame)
+	ai := bytes.Repeat([]byte{2, 0}, rtpSamplesPerFrame)
+	// Audio the AI sends into the bridge may still be flushed; only what the
+	// RTP sender plays out is forked
+	fork.WriteChunk(&MediaChunk{Data: ai, SenderID: "ai"})
+	fork.WriteChunk(&MediaChunk{Data: caller, SenderID: "caller"})
+	fork.WriteOutbound(ai, 1000+rtpSamplesPerFrame)
+
+	for _, want := range []struct {
+		track     byte
+		timestamp uint32
+		audio     []byte
+	}{
+		{0, 0, caller},
+		{1, 20, ai},
+	} {
+		data := next()
+		if len(data) < 5 {
+			t.Fatalf("short frame %v", data)
+		}
+		if data[0] != want.track || binary.BigEndian.Uint32(data[1:5]) != want.timestamp || !bytes.Equal(data[5:], want.audio) {
+			t.Fatalf("got track %d at %dms, want track %d at %dms", data[0], binary.BigEndian.Uint32(data[1:5]), want.track, want.timestamp)
+		}
+	}
+
+	fork.Close()
+	if data := next(); !bytes.Contains(data, []byte(`"stop"`)) {
+		t.Fatalf("got %s, want the stop event", data)
+	}
+}
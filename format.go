@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Audio encodings carried in a MediaChunk
+const (
+	EncodingPCM16 = "pcm16" // Signed 16-bit little-endian linear PCM
+	EncodingPCMU  = "pcmu"  // G.711 μ-law
+	EncodingPCMA  = "pcma"  // G.711 A-law
+)
+
+// MediaFormat describes the audio carried in a MediaChunk
+type MediaFormat struct {
+	Encoding   string
+	SampleRate int
+	Channels   int
+}
+
+// DefaultMediaFormat is the format of the SIP leg (narrowband telephony). It is
+// assumed for chunks without a format and participants that do not declare one.
+var DefaultMediaFormat = MediaFormat{Encoding: EncodingPCM16, SampleRate: 8000, Channels: 1}
+
+// PCM16Format returns 16-bit mono PCM at sampleRate
+func PCM16Format(sampleRate int) MediaFormat {
+	return MediaFormat{Encoding: EncodingPCM16, SampleRate: sampleRate, Channels: 1}
+}
+
+// String renders the format as e.g. "pcm16/16000/1"
+func (f MediaFormat) String() string {
+	return fmt.Sprintf("%s/%d/%d", f.Encoding, f.SampleRate, f.Channels)
+}
+
+// orDefault fills in unset fields from DefaultMediaFormat
+func (f MediaFormat) orDefault() MediaFormat {
+	if f.Encoding == "" {
+		f.Encoding = DefaultMediaFormat.Encoding
+	}
+	if f.SampleRate == 0 {
+		f.SampleRate = DefaultMediaFormat.SampleRate
+	}
+	if f.Channels == 0 {
+		f.Channels = DefaultMediaFormat.Channels
+	}
+	return f
+}
+
+// FormatAcceptor is an optional interface for participants that declare which
+// formats they can receive, most preferred first. The bridge converts audio to
+// one of them. Participants without it receive DefaultMediaFormat.
+type FormatAcceptor interface {
+	AcceptedFormats() []MediaFormat
+}
+
+// ChunkWriter is an optional interface for participants that want converted
+// chunks with their format and timestamp instead of raw bytes on Writer()
+type ChunkWriter interface {
+	WriteChunk(chunk *MediaChunk) error
+}
+
+// acceptedFormats returns the formats a participant can receive
+func acceptedFormats(participant Participant) []MediaFormat {
+	if acceptor, ok := participant.(FormatAcceptor); ok {
+		if formats := acceptor.AcceptedFormats(); len(formats) > 0 {
+			normalized := make([]MediaFormat, len(formats))
+			for i, format := range formats {
+				normalized[i] = format.orDefault()
+			}
+			return normalized
+		}
+	}
+	return []MediaFormat{DefaultMediaFormat}
+}
+
+// chooseFormat picks the target format for a source: the source itself if it
+// is accepted, otherwise the most preferred accepted format at the source's
+// sample rate (to avoid resampling), otherwise the most preferred format
+func chooseFormat(source MediaFormat, accepted []MediaFormat) MediaFormat {
+	for _, format := range accepted {
+		if format == source {
+			return format
+		}
+	}
+	for _, format := range accepted {
+		if format.SampleRate == source.SampleRate {
+			return format
+		}
+	}
+	return accepted[0]
+}
+
+// formatConverter converts one continuous stream from one format to another.
+// It is stateful (the resampler carries filter state across chunks), so each
+// sender's stream needs its own converter.
+type formatConverter struct {
+	from      MediaFormat
+	to        MediaFormat
+	resampler *StreamResampler
+}
+
+// newFormatConverter creates a converter between two formats
+func newFormatConverter(from, to MediaFormat) (*formatConverter, error) {
+	for _, format := range []MediaFormat{from, to} {
+		switch format.Encoding {
+		case EncodingPCM16, EncodingPCMU, EncodingPCMA:
+		default:
+			return nil, fmt.Errorf("unsupported encoding %q", format.Encoding)
+		}
+		if format.SampleRate <= 0 || format.Channels <= 0 {
+			return nil, fmt.Errorf("invalid format %s", format)
+		}
+	}
+
+	c := &formatConverter{from: from, to: to}
+	if from.SampleRate != to.SampleRate {
+		resampler, err := NewStreamResampler(float64(from.SampleRate), float64(to.SampleRate))
+		if err != nil {
+			return nil, err
+		}
+		c.resampler = resampler
+	}
+	return c, nil
+}
+
+// Convert converts the next piece of the stream. The result may be empty
+// while the resampler is priming.
+func (c *formatConverter) Convert(data []byte) ([]byte, error) {
+	if c.from == c.to {
+		return data, nil
+	}
+
+	var samples []int16
+	switch c.from.Encoding {
+	case EncodingPCMU:
+		samples = pcmToSamples(decodeG711(data, "PCMU"))
+	case EncodingPCMA:
+		samples = pcmToSamples(decodeG711(data, "PCMA"))
+	default:
+		samples = pcmToSamples(data[:len(data)/2*2])
+	}
+
+	if c.from.Channels != c.to.Channels || c.resampler != nil {
+		samples = downmix(samples, c.from.Channels)
+		if c.resampler != nil {
+			pcmData := make([]byte, len(samples)*2)
+			samplesToPCM(samples, pcmData)
+			resampled, err := c.resampler.Process(pcmData)
+			if err != nil {
+				return nil, err
+			}
+			samples = pcmToSamples(resampled)
+		}
+		samples = upmix(samples, c.to.Channels)
+	}
+
+	pcmData := make([]byte, len(samples)*2)
+	samplesToPCM(samples, pcmData)
+	switch c.to.Encoding {
+	case EncodingPCMU:
+		return encodeG711(pcmData, "PCMU"), nil
+	case EncodingPCMA:
+		return encodeG711(pcmData, "PCMA"), nil
+	default:
+		return pcmData, nil
+	}
+}
+
+// Close releases the converter's resampler
+func (c *formatConverter) Close() {
+	if c.resampler != nil {
+		c.resampler.Close()
+	}
+}
+
+// downmix averages interleaved channels into mono
+func downmix(samples []int16, channels int) []int16 {
+	if channels <= 1 {
+		return samples
+	}
+	mono := make([]int16, len(samples)/channels)
+	for i := range mono {
+		sum := 0
+		for c := 0; c < channels; c++ {
+			sum += int(samples[i*channels+c])
+		}
+		mono[i] = int16(sum / channels)
+	}
+	return mono
+}
+
+// upmix copies mono samples into every channel
+func upmix(samples []int16, channels int) []int16 {
+	if channels <= 1 {
+		return samples
+	}
+	interleaved := make([]int16, len(samples)*channels)
+	for i, sample := range samples {
+		for c := 0; c < channels; c++ {
+			interleaved[i*channels+c] = sample
+		}
+	}
+	return interleaved
+}
+
+// streamKey identifies a sender's stream in a given format
+type streamKey struct {
+	sender string
+	format MediaFormat
+}
+
+// chunkConverter converts chunks from any number of senders into formats
+// accepted by one destination, keeping a converter per sender stream
+type chunkConverter struct {
+	destination string
+	accepted    []MediaFormat
+	converters  map[streamKey]*formatConverter
+	mu          sync.Mutex
+}
+
+// newChunkConverter creates a converter for a destination accepting the given formats
+func newChunkConverter(destination string, accepted []MediaFormat) *chunkConverter {
+	return &chunkConverter{
+		destination: destination,
+		accepted:    accepted,
+		converters:  make(map[streamKey]*formatConverter),
+	}
+}
+
+// Convert returns chunk in a format the destination accepts, or nil if there
+// is nothing to deliver yet (or the chunk cannot be converted)
+func (c *chunkConverter) Convert(chunk *MediaChunk) *MediaChunk {
+	source := chunk.Format.orDefault()
+	target := chooseFormat(source, c.accepted)
+	if target == source {
+		if chunk.Format == source {
+			return chunk
+		}
+		converted := *chunk
+		converted.Format = source
+		return &converted
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := streamKey{sender: chunk.SenderID, format: source}
+	converter := c.converters[key]
+	if converter == nil || converter.to != target {
+		if converter != nil {
+			converter.Close()
+		}
+		var err error
+		converter, err = newFormatConverter(source, target)
+		if err != nil {
+			slog.Error("Cannot convert media for participant",
+				"event", "format_convert_error",
+				"participant", c.destination,
+				"sender", chunk.SenderID,
+				"from", source.String(),
+				"to", target.String(),
+				"error", err.Error())
+			delete(c.converters, key)
+			return nil
+		}
+		c.converters[key] = converter
+		slog.Info("Converting media for participant",
+			"event", "format_convert",
+			"participant", c.destination,
+			"sender", chunk.SenderID,
+			"from", source.String(),
+			"to", target.String())
+	}
+
+	data, err := converter.Convert(chunk.Data)
+	if err != nil {
+		slog.Error("Failed to convert media chunk",
+			"event", "format_convert_error",
+			"participant", c.destination,
+			"sender", chunk.SenderID,
+			"error", err.Error())
+		return nil
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	return &MediaChunk{
+		Data:        data,
+		SenderID:    chunk.SenderID,
+		RecipientID: chunk.RecipientID,
+		Format:      target,
+		Timestamp:   chunk.Timestamp,
+	}
+}
+
+// Reset drops all converter state, e.g. when queued audio is discarded on
+// interruption and the next chunk from a sender is unrelated to the last
+func (c *chunkConverter) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, converter := range c.converters {
+		converter.Close()
+		delete(c.converters, key)
+	}
+}
+
+// Forget drops the converter state of one sender, e.g. one that has left
+func (c *chunkConverter) Forget(sender string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, converter := range c.converters {
+		if key.sender == sender {
+			converter.Close()
+			delete(c.converters, key)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChooseFormat(t *testing.T) {
+	pcm8k, pcm16k, pcm24k := PCM16Format(8000), PCM16Format(16000), PCM16Format(24000)
+	pcmu := MediaFormat{Encoding: EncodingPCMU, SampleRate: 8000, Channels: 1}
+	stereo16k := MediaFormat{Encoding: EncodingPCM16, SampleRate: 16000, Channels: 2}
+
+	tests := []struct {
+		name     string
+		source   MediaFormat
+		accepted []MediaFormat
+		want     MediaFormat
+	}{
+		{"exact match over preference", pcm16k, []MediaFormat{pcm8k, pcm16k}, pcm16k},
+		{"same rate avoids resampling", pcmu, []MediaFormat{pcm16k, pcm8k}, pcm8k},
+		{"same rate, other channels", stereo16k, []MediaFormat{pcm8k, pcm16k}, pcm16k},
+		{"most preferred without a rate match", pcm24k, []MediaFormat{pcm16k, pcm8k}, pcm16k},
+	}
+	for _, test := range tests {
+		if got := chooseFormat(test.source, test.accepted); got != test.want {
+			t.Errorf("%s: chose %s for %s, want %s", test.name, got, test.source, test.want)
+		}
+	}
+}
+
+func TestChunkConverterConvertsFormats(t *testing.T) {
+	pcmu := MediaFormat{Encoding: EncodingPCMU, SampleRate: 8000, Channels: 1}
+	stereo := MediaFormat{Encoding: EncodingPCM16, SampleRate: 8000, Channels: 2}
+
+	tests := []struct {
+		name        string
+		from        MediaFormat
+		chunkBytes  int // Bytes of one 20ms chunk in from
+		wantSamples int // 8kHz mono samples out per second
+	}{
+		{"pcm16 24kHz", PCM16Format(24000), 480 * 2, 8000},
+		{"pcm16 8kHz stereo", stereo, 160 * 4, 8000},
+		{"pcmu 8kHz", pcmu, 160, 8000},
+	}
+	for _, test := range tests {
+		converter := newChunkConverter("sip", []MediaFormat{DefaultMediaFormat})
+
+		// One second of 20ms chunks
+		samples := 0
+		for i := 0; i < 50; i++ {
+			chunk := converter.Convert(&MediaChunk{
+				Data:      make([]byte, test.chunkBytes),
+				SenderID:  "ai",
+				Format:    test.from,
+				Timestamp: time.Duration(i) * rtpFrameDuration,
+			})
+			if chunk == nil {
+				continue
+			}
+			if chunk.Format != DefaultMediaFormat || chunk.SenderID != "ai" || chunk.Timestamp != time.Duration(i)*rtpFrameDuration {
+				t.Fatalf("%s: converted chunk %s from %s at %s", test.name, chunk.Format, chunk.SenderID, chunk.Timestamp)
+			}
+			samples += len(chunk.Data) / 2
+		}
+
+		// The resampler may still hold a few milliseconds in its filter
+		if diff := test.wantSamples - samples; diff < 0 || diff > test.wantSamples/100 {
+			t.Errorf("%s: %d samples out for a second of audio, want %d", test.name, samples, test.wantSamples)
+		}
+		converter.Reset()
+	}
+}
+
+func TestChunkConverterForgetAndReset(t *testing.T) {
+	converter := newChunkConverter("sip", []MediaFormat{DefaultMediaFormat})
+	for _, sender := range []string{"ai", "webrtc-1"} {
+		converter.Convert(&MediaChunk{Data: make([]byte, 960), SenderID: sender, Format: PCM16Format(24000)})
+	}
+	// Chunks already in an accepted format need no converter
+	converter.Convert(&MediaChunk{Data: make([]byte, 320), SenderID: "prompt", Format: DefaultMediaFormat})
+	if len(converter.converters) != 2 {
+		t.Fatalf("%d converters, want one per resampled sender", len(converter.converters))
+	}
+
+	converter.Forget("ai")
+	if len(converter.converters) != 1 {
+		t.Fatalf("%d converters after Forget, want 1", len(converter.converters))
+	}
+	for key := range converter.converters {
+		if key.sender != "webrtc-1" {
+			t.Fatalf("Forget(ai) kept the converter of %s", key.sender)
+		}
+	}
+
+	converter.Reset()
+	if len(converter.converters) != 0 {
+		t.Fatalf("%d converters after Reset, want none", len(converter.converters))
+	}
+}
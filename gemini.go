@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -10,7 +9,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/zaf/resample"
+	"cloud.google.com/go/auth/credentials"
 	"google.golang.org/genai"
 )
 
@@ -19,25 +18,199 @@ const (
 	GEMINI_DEBUG = false
 )
 
+const (
+	// maxGeminiReconnectAttempts bounds the attempts to resume a dropped Live session
+	maxGeminiReconnectAttempts = 3
+	// geminiReconnectBackoff is the delay before the second attempt, doubled after each
+	geminiReconnectBackoff = 500 * time.Millisecond
+	// maxReconnectBufferBytes bounds the caller audio held while reconnecting (10s at 16kHz)
+	maxReconnectBufferBytes = 10 * 16000 * 2
+)
+
+// Backends serving the Live API
+const (
+	GeminiBackendAPI    = "gemini-api" // Gemini Developer API, authenticated with GOOGLE_API_KEY
+	GeminiBackendVertex = "vertex"     // Vertex AI, authenticated with a service account or default credentials
+)
+
+// Default Live models, per backend
+const (
+	defaultGeminiModel = "gemini-live-2.5-flash-preview"
+	defaultVertexModel = "gemini-live-2.5-flash"
+)
+
+// GeminiConfig selects the backend that serves the Live API and the model
+// used unless the session config names one
+type GeminiConfig struct {
+	Backend         string // GeminiBackendAPI or GeminiBackendVertex
+	Model           string // Empty for the backend's default
+	Project         string // Vertex AI project
+	Location        string // Vertex AI location, e.g. europe-west4
+	CredentialsFile string // Vertex AI service-account key, Application Default Credentials if empty
+}
+
+// DefaultModel returns the configured model, or the backend's default
+func (c GeminiConfig) DefaultModel() string {
+	switch {
+	case c.Model != "":
+		return c.Model
+	case c.Backend == GeminiBackendVertex:
+		return defaultVertexModel
+	default:
+		return defaultGeminiModel
+	}
+}
+
+// SessionModel returns the model for a call: the one the session config
+// names, or DefaultModel
+func (c GeminiConfig) SessionModel(sessionConfig *SessionConfig) string {
+	if sessionConfig != nil && sessionConfig.Model != "" {
+		return sessionConfig.Model
+	}
+	return c.DefaultModel()
+}
+
+// NewGeminiClient creates a client for the configured backend. It is shared
+// by all calls.
+func NewGeminiClient(ctx context.Context, config GeminiConfig) (*genai.Client, error) {
+	switch config.Backend {
+	case GeminiBackendAPI, "":
+		apiKey := os.Getenv("GOOGLE_API_KEY")
+		if apiKey == "" {
+			return nil, fmt.Errorf("GOOGLE_API_KEY environment variable is not set")
+		}
+
+		slog.Info("Using Google API key from environment",
+			"event", "api_key_loaded",
+			"key_length", len(apiKey))
+
+		return genai.NewClient(ctx, &genai.ClientConfig{
+			Backend: genai.BackendGeminiAPI,
+			APIKey:  apiKey,
+		})
+
+	case GeminiBackendVertex:
+		if config.Project == "" || config.Location == "" {
+			return nil, fmt.Errorf("the Vertex AI backend requires a project and a location")
+		}
+
+		// Without a key file, Application Default Credentials are detected
+		// (GOOGLE_APPLICATION_CREDENTIALS, gcloud or the metadata server)
+		creds, err := credentials.DetectDefault(&credentials.DetectOptions{
+			Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform"},
+			CredentialsFile: config.CredentialsFile,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Vertex AI credentials: %w", err)
+		}
+
+		slog.Info("Using Vertex AI backend",
+			"event", "vertex_backend",
+			"project", config.Project,
+			"location", config.Location,
+			"credentials_file", config.CredentialsFile)
+
+		return genai.NewClient(ctx, &genai.ClientConfig{
+			Backend:     genai.BackendVertexAI,
+			Project:     config.Project,
+			Location:    config.Location,
+			Credentials: creds,
+		})
+	}
+
+	return nil, fmt.Errorf("unknown Gemini backend %q (want %q or %q)", config.Backend, GeminiBackendAPI, GeminiBackendVertex)
+}
+
+// Call opening modes
+const (
+	OpeningInstruction = "instruction" // Text is sent to the model as the caller's first turn, so the AI speaks first
+	OpeningGreeting    = "greeting"    // The AI says Text verbatim
+	OpeningNone        = "none"        // The AI waits for the caller to speak
+)
+
+// defaultOpeningInstruction starts the conversation when the session config
+// does not say how
+const defaultOpeningInstruction = "Hello"
+
+// OpeningConfig sets how the conversation starts once the call is answered
+type OpeningConfig struct {
+	Mode string `json:"mode,omitempty"` // OpeningInstruction (default), OpeningGreeting or OpeningNone
+	Text string `json:"text,omitempty"` // The instruction or greeting
+}
+
+// opening returns the text to send as the first user turn, or "" for none
+func (c *OpeningConfig) opening() (string, error) {
+	if c == nil {
+		return defaultOpeningInstruction, nil
+	}
+
+	switch c.Mode {
+	case OpeningInstruction, "":
+		if c.Text == "" {
+			return defaultOpeningInstruction, nil
+		}
+		return c.Text, nil
+	case OpeningGreeting:
+		if c.Text == "" {
+			return "", fmt.Errorf("the %q opening needs a text", OpeningGreeting)
+		}
+		return fmt.Sprintf("The call has just been answered. Greet the caller by saying exactly this, then wait for their reply: %q", c.Text), nil
+	case OpeningNone:
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown opening mode %q (want %q, %q or %q)", c.Mode, OpeningInstruction, OpeningGreeting, OpeningNone)
+}
+
+// AIStats summarizes the AI's side of a call
+type AIStats struct {
+	Model            string
+	Interruptions    int // Times the caller cut the AI off
+	Usage            TokenUsage
+	ConnectedSeconds float64 // How long the AI was connected to the call
+}
+
 // GeminiHandler manages Gemini AI connections for audio processing
 type GeminiHandler struct {
-	mediaBridge       MediaBridge
-	participant       *BaseParticipant
-	participantID     string
-	stopChan          chan struct{}
-	ctx               context.Context
-	cancel            context.CancelFunc
-	client            *genai.Client
-	session           *genai.Session
+	mediaBridge   MediaBridge
+	participant   *BaseParticipant
+	participantID string
+	stopChan      chan struct{}
+	ctx           context.Context
+	cancel        context.CancelFunc
+	client        *genai.Client
+	model         string
+	session       *genai.Session
+	liveConfig    *genai.LiveConnectConfig // Reused to resume the session
+	resumeHandle  string                   // Latest session resumption handle, guarded by sessionMu
+	sendMu        sync.Mutex               // Serializes writes to session, which is not safe for concurrent use
+	// While reconnecting, caller audio and tool responses are held here,
+	// guarded by sendMu, and sent to the new session in order
+	reconnecting      bool
+	pendingAudio      [][]byte
+	pendingAudioBytes int
+	pendingResponses  []*genai.FunctionResponse
+	tools             *ToolDispatcher // Nil if the session declares no tools
 	wg                sync.WaitGroup
 	audioWriter       *GeminiAudioWriter
 	sessionClosed     bool
 	sessionMu         sync.RWMutex
 	sessionConfig     *SessionConfig
-	firstDataReceived bool
-	firstDataMu       sync.Mutex
+	openOnce          sync.Once
+	transcript        *Transcript
+	stats             AIStats   // Guarded by statsMu
+	connectedAt       time.Time // When the AI joined the call, guarded by statsMu
+	disconnectedAt    time.Time // When it left, guarded by statsMu
+	statsMu           sync.Mutex
+	outputSamples     int64 // Samples of model audio sent, for chunk timestamps
 }
 
+// Gemini Live audio formats. The bridge converts the caller's audio to the
+// input format and the model's audio to whatever each listener accepts.
+var (
+	geminiInputFormat  = PCM16Format(16000)
+	geminiOutputFormat = PCM16Format(24000)
+)
+
 // GeminiAudioWriter implements io.Writer to forward PCM audio to Gemini
 type GeminiAudioWriter struct {
 	handler *GeminiHandler
@@ -56,10 +229,14 @@ func (w *GeminiAudioWriter) Write(pcmData []byte) (n int, err error) {
 	session := w.handler.session
 	w.handler.sessionMu.RUnlock()
 
-	if session == nil || sessionClosed {
+	if sessionClosed {
 		// Return io.ErrClosedPipe to signal a terminal error that should stop retries
 		return 0, io.ErrClosedPipe
 	}
+	if session == nil {
+		// Not connected yet (e.g. an intro prompt is still playing); drop the audio
+		return len(pcmData), nil
+	}
 
 	if len(pcmData) == 0 {
 		slog.Warn("Empty PCM data received",
@@ -68,79 +245,25 @@ func (w *GeminiAudioWriter) Write(pcmData []byte) (n int, err error) {
 		return len(pcmData), nil // Don't treat as error
 	}
 
-	// Check if this is the first data received and send Hello message
-	w.handler.firstDataMu.Lock()
-	if !w.handler.firstDataReceived {
-		w.handler.firstDataReceived = true
-		w.handler.firstDataMu.Unlock()
-
-		// Send initial "Hello" message to start the conversation
-		turnComplete := true
-		err := session.SendClientContent(genai.LiveClientContentInput{
-			Turns: []*genai.Content{
-				genai.NewContentFromText("Hello", genai.RoleUser),
-			},
-			TurnComplete: &turnComplete,
-		})
-		if err != nil {
-			slog.Warn("Failed to send initial Hello message",
-				"event", "hello_message_failed",
-				"participant", w.handler.participantID,
-				"error", err.Error())
-			// Don't return error, continue anyway
-		} else {
-			slog.Info("Sent initial Hello message to Gemini",
-				"event", "hello_message_sent",
-				"participant", w.handler.participantID)
-		}
-	} else {
-		w.handler.firstDataMu.Unlock()
-	}
-
-	// Resample from 8000 Hz to 16000 Hz for Gemini
-	// Gemini expects 16kHz PCM audio
-	// Create a local resampler for this packet
-	var outputBuf bytes.Buffer
-	resampler, err := resample.New(&outputBuf, 8000.0, 16000.0, 1, resample.I16, resample.HighQ)
-	if err != nil {
-		slog.Error("Failed to create 8kHz->16kHz resampler",
-			"event", "resample_error",
-			"participant", w.handler.participantID,
-			"error", err.Error())
-		return 0, err
+	// Send to Gemini using LiveRealtimeInput, unless a reconnect is in progress
+	// The bridge has already converted the audio to 16-bit PCM at 16000 Hz
+	w.handler.sendMu.Lock()
+	if w.handler.reconnecting {
+		w.handler.bufferAudioLocked(pcmData)
+		w.handler.sendMu.Unlock()
+		return len(pcmData), nil
 	}
-
-	_, err = resampler.Write(pcmData)
-	if err != nil {
-		slog.Error("Failed to write audio for resampling to 16kHz",
-			"event", "resample_error",
-			"participant", w.handler.participantID,
-			"error", err.Error())
-		return 0, err
+	// A reconnect may have replaced the session since it was read above
+	w.handler.sessionMu.RLock()
+	session = w.handler.session
+	w.handler.sessionMu.RUnlock()
+	if session == nil {
+		w.handler.sendMu.Unlock()
+		return 0, io.ErrClosedPipe
 	}
-
-	// Close to flush the resampler buffer to outputBuf
-	err = resampler.Close()
+	err = session.SendRealtimeInput(geminiAudioInput(pcmData))
+	w.handler.sendMu.Unlock()
 	if err != nil {
-		slog.Error("Failed to resample audio to 16kHz",
-			"event", "resample_error",
-			"participant", w.handler.participantID,
-			"error", err.Error())
-		return 0, err
-	}
-
-	resampledAudio := outputBuf.Bytes()
-
-	// Send to Gemini using LiveRealtimeInput
-	// Linear PCM 16-bit at 16000 Hz sample rate
-	realtimeInput := genai.LiveRealtimeInput{
-		Audio: &genai.Blob{
-			MIMEType: "audio/pcm;rate=16000",
-			Data:     resampledAudio,
-		},
-	}
-
-	if err := w.handler.session.SendRealtimeInput(realtimeInput); err != nil {
 		slog.Error("Error sending audio to Gemini",
 			"event", "gemini_audio_error",
 			"participant", w.handler.participantID,
@@ -154,43 +277,22 @@ func (w *GeminiAudioWriter) Write(pcmData []byte) (n int, err error) {
 		slog.Debug("Successfully sent PCM to Gemini",
 		"event", "gemini_audio_sent",
 		"participant", w.handler.participantID,
-		"resampled_bytes", len(resampledAudio),
-		"original_bytes", len(pcmData))
+		"size_bytes", len(pcmData))
 	}
 
 	return len(pcmData), nil
 }
 
-// NewGeminiHandler creates a new Gemini handler
-func NewGeminiHandler(mediaBridge MediaBridge, participantID string, sessionConfig *SessionConfig) (*GeminiHandler, error) {
+// NewGeminiHandler creates a new Gemini handler that talks to model through
+// client. tools executes the session's tool calls; it may be nil.
+func NewGeminiHandler(mediaBridge MediaBridge, client *genai.Client, model string, participantID string, sessionConfig *SessionConfig, tools *ToolDispatcher) (*GeminiHandler, error) {
 	slog.Info("Creating Gemini handler",
 		"event", "gemini_handler_create",
-		"participant", participantID)
+		"participant", participantID,
+		"model", model)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	// Get API key from environment
-	apiKey := os.Getenv("GOOGLE_API_KEY")
-	if apiKey == "" {
-		cancel()
-		return nil, fmt.Errorf("GOOGLE_API_KEY environment variable is not set")
-	}
-
-	slog.Info("Using Google API key from environment",
-		"event", "api_key_loaded",
-		"key_length", len(apiKey))
-
-	// Initialize Gemini client with API key
-	// The genai package expects the API key to be set in GOOGLE_API_KEY env var
-	// or passed via ClientConfig
-	client, err := genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey: apiKey,
-	})
-	if err != nil {
-		cancel()
-		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
-	}
-
 	handler := &GeminiHandler{
 		mediaBridge:   mediaBridge,
 		participantID: participantID,
@@ -198,14 +300,20 @@ func NewGeminiHandler(mediaBridge MediaBridge, participantID string, sessionConf
 		ctx:           ctx,
 		cancel:        cancel,
 		client:        client,
+		model:         model,
 		sessionConfig: sessionConfig,
+		transcript:    NewTranscript(),
+		stats:         AIStats{Model: model},
+		tools:         tools,
 	}
 
 	// Create audio writer
 	handler.audioWriter = &GeminiAudioWriter{handler: handler}
 
 	// Create participant for Gemini with the audio writer
-	handler.participant = NewParticipant(participantID, handler.audioWriter)
+	participant := NewParticipant(participantID, handler.audioWriter)
+	participant.SetAcceptedFormats(geminiInputFormat)
+	handler.participant = participant
 
 	// Add participant to media bridge
 	if err := mediaBridge.AddParticipant(handler.participant); err != nil {
@@ -226,12 +334,10 @@ func (g *GeminiHandler) Start() error {
 		"event", "gemini_handler_start",
 		"participant", g.participantID)
 
-	// Determine model based on backend
-	model := "gemini-live-2.5-flash-preview"
-
 	slog.Info("Connecting to Gemini model",
 		"event", "gemini_connect",
-		"model", model)
+		"participant", g.participantID,
+		"model", g.model)
 
 	// Use system instructions from session config, or default if not provided
 	systemInstructions := "You are a helpful voice assistant. Respond naturally to the user's audio input."
@@ -270,8 +376,23 @@ func (g *GeminiHandler) Start() error {
 		}
 	}
 
-	// Connect to Gemini Live API
-	session, err := g.client.Live.Connect(g.ctx, model, &genai.LiveConnectConfig{
+	// Declare the session's tools, if any
+	var tools []*genai.Tool
+	if g.tools != nil {
+		tools = g.tools.Tools()
+		for _, tool := range tools {
+			for _, declaration := range tool.FunctionDeclarations {
+				slog.Info("Declaring tool",
+					"event", "tool_declared",
+					"participant", g.participantID,
+					"tool", declaration.Name)
+			}
+		}
+	}
+
+	// Connect to Gemini Live API. Sessions are resumable and their context is
+	// compressed, so that a call can outlive a single Live connection.
+	g.liveConfig = &genai.LiveConnectConfig{
 		ResponseModalities: []genai.Modality{genai.ModalityAudio},
 		SystemInstruction: &genai.Content{
 			Parts: []*genai.Part{
@@ -281,12 +402,29 @@ func (g *GeminiHandler) Start() error {
 		SpeechConfig:             speechConfig,
 		InputAudioTranscription:  &genai.AudioTranscriptionConfig{},
 		OutputAudioTranscription: &genai.AudioTranscriptionConfig{},
-	})
+		Tools:                    tools,
+		ContextWindowCompression: &genai.ContextWindowCompressionConfig{
+			SlidingWindow: &genai.SlidingWindow{},
+		},
+	}
+	session, err := g.connect(g.ctx, "")
 	if err != nil {
 		return fmt.Errorf("failed to connect to Gemini Live: %w", err)
 	}
 
+	// The call may have ended while we were connecting
+	g.sessionMu.Lock()
+	if g.sessionClosed {
+		g.sessionMu.Unlock()
+		session.Close()
+		return fmt.Errorf("handler closed while connecting to Gemini Live")
+	}
 	g.session = session
+	g.sessionMu.Unlock()
+
+	g.statsMu.Lock()
+	g.connectedAt = time.Now()
+	g.statsMu.Unlock()
 
 	slog.Info("Successfully connected to Gemini Live session",
 		"event", "gemini_connected",
@@ -343,22 +481,63 @@ func (g *GeminiHandler) receiveResponses() {
 			}()
 
 			if err != nil {
+				select {
+				case <-g.stopChan:
+					// Closed by us
+					return
+				default:
+				}
+
 				if err == io.EOF {
-					slog.Info("Gemini session ended gracefully",
+					slog.Info("Gemini session ended by the server",
 						"event", "gemini_recv_eof",
 						"participant", g.participantID)
+				} else {
+					slog.Error("Error receiving from Gemini",
+						"event", "gemini_recv_error",
+						"participant", g.participantID,
+						"error", err.Error())
+				}
+
+				// Resume the conversation on a new connection so the caller is
+				// not left in silence
+				if err := g.reconnect("connection_lost"); err != nil {
+					slog.Error("Failed to resume Gemini session, closing",
+						"event", "gemini_reconnect_failed",
+						"participant", g.participantID,
+						"error", err.Error())
+					// Mark session as closed to prevent further attempts
 					g.markSessionClosed()
 					g.removeFromBridge()
 					return
 				}
-				slog.Error("Error receiving from Gemini, closing session",
-					"event", "gemini_recv_error",
+				continue
+			}
+
+			// Keep the latest handle to resume from
+			if update := message.SessionResumptionUpdate; update != nil && update.Resumable && update.NewHandle != "" {
+				g.sessionMu.Lock()
+				g.resumeHandle = update.NewHandle
+				g.sessionMu.Unlock()
+			}
+
+			// The server is about to close the connection; move to a new one
+			// while it is still up
+			if message.GoAway != nil {
+				slog.Info("Gemini sent GoAway, reconnecting",
+					"event", "gemini_goaway",
 					"participant", g.participantID,
-					"error", err.Error())
-				// Mark session as closed to prevent further attempts
-				g.markSessionClosed()
-				g.removeFromBridge()
-				return
+					"time_left", message.GoAway.TimeLeft.String())
+				if err := g.reconnect("go_away"); err != nil {
+					slog.Error("Failed to resume Gemini session, closing",
+						"event", "gemini_reconnect_failed",
+						"participant", g.participantID,
+						"error", err.Error())
+					g.markSessionClosed()
+					g.removeFromBridge()
+					return
+				}
+				continue
 			}
 
 			if GEMINI_DEBUG {
@@ -378,42 +557,10 @@ func (g *GeminiHandler) receiveResponses() {
 						// Audio data is already binary PCM, no base64 decoding needed
 						audioData := blob.Data
 
-						// Resample from 24000 Hz to 8000 Hz
-						// Create a local resampler for this packet
-						var outputBuf bytes.Buffer
-						resampler, err := resample.New(&outputBuf, 24000.0, 8000.0, 1, resample.I16, resample.HighQ)
-						if err != nil {
-							slog.Error("Failed to create 24kHz->8kHz resampler",
-								"event", "gemini_resample_error",
-								"participant", g.participantID,
-								"error", err.Error())
-							continue
-						}
-
-						_, err = resampler.Write(audioData)
-						if err != nil {
-							slog.Error("Failed to write audio for resampling",
-								"event", "gemini_resample_error",
-								"participant", g.participantID,
-								"error", err.Error())
-							continue
-						}
-
-						// Close to flush the resampler buffer to outputBuf
-						err = resampler.Close()
-						if err != nil {
-							slog.Error("Failed to resample audio",
-								"event", "gemini_resample_error",
-								"participant", g.participantID,
-								"error", err.Error())
-							continue
-						}
-
-						resampledAudio := outputBuf.Bytes()
-
-						// Broadcast the full resampled audio buffer
-						// The receiving participant (SIP) will handle chunking into RTP packets
-						if err := g.BroadcastResponse(resampledAudio); err != nil {
+						// Broadcast the full audio buffer at the model's rate; the bridge
+						// converts it for each listener and the SIP participant handles
+						// chunking into RTP packets
+						if err := g.BroadcastResponse(audioData); err != nil {
 							slog.Error("Error broadcasting Gemini audio",
 								"event", "gemini_bcast_error",
 								"participant", g.participantID,
@@ -424,29 +571,54 @@ func (g *GeminiHandler) receiveResponses() {
 						slog.Info("Broadcasted Gemini audio",
 							"event", "gemini_bcast_ok",
 							"participant", g.participantID,
-							"size_bytes", len(resampledAudio))
+							"size_bytes", len(audioData))
 					}
 				}
 			}
 
-			// Log transcription events
+			// Execute tool calls; results are sent back as they complete
+			if message.ToolCall != nil && g.tools != nil {
+				for _, call := range message.ToolCall.FunctionCalls {
+					g.tools.Dispatch(call, g.sendToolResponse)
+				}
+			}
+
+			// The caller interrupted the turn that made these calls
+			if message.ToolCallCancellation != nil && g.tools != nil {
+				slog.Info("Gemini cancelled tool calls",
+					"event", "gemini_tool_cancel",
+					"participant", g.participantID,
+					"ids", message.ToolCallCancellation.IDs)
+				g.tools.Cancel(message.ToolCallCancellation.IDs)
+			}
+
+			// Count the tokens the model reports
+			if message.UsageMetadata != nil {
+				g.addUsage(message.UsageMetadata)
+			}
+
+			// Log transcription events and build the call's transcript
 			if message.ServerContent != nil {
+				now := time.Now()
 				if message.ServerContent.InputTranscription != nil {
 					slog.Info("Gemini input transcription",
 						"event", "gemini_input_transcription",
 						"participant", g.participantID,
 						"text", fmt.Sprintf("%+v", message.ServerContent.InputTranscription.Text))
+					g.transcript.Add(SpeakerCaller, message.ServerContent.InputTranscription.Text, now)
 				}
 				if message.ServerContent.OutputTranscription != nil {
 					slog.Info("Gemini output transcription",
 						"event", "gemini_output_transcription",
 						"participant", g.participantID,
 						"text", fmt.Sprintf("%+v", message.ServerContent.OutputTranscription.Text))
+					g.transcript.Add(SpeakerAI, message.ServerContent.OutputTranscription.Text, now)
 				}
 				if message.ServerContent.TurnComplete {
 					slog.Info("Gemini turn completed",
 						"event", "gemini_turn_complete",
 						"participant", g.participantID)
+					g.transcript.EndTurn()
 				}
 
 				// Check for interruption flag
@@ -454,8 +626,13 @@ func (g *GeminiHandler) receiveResponses() {
 					slog.Info("Gemini interruption detected, flushing queues",
 						"event", "gemini_interrupted",
 						"participant", g.participantID)
+					g.transcript.Interrupt()
+					g.statsMu.Lock()
+					g.stats.Interruptions++
+					g.statsMu.Unlock()
 
-					// Notify MediaBridge to flush queues for all participants
+					// Notify MediaBridge to flush queues for all participants. This
+					// also drops the interrupted utterance's conversion state.
 					if g.mediaBridge != nil {
 						if err := g.mediaBridge.FlushQueues(); err != nil {
 							slog.Error("Error flushing queues after interruption",
@@ -488,6 +665,12 @@ func (g *GeminiHandler) markSessionClosed() {
 	g.sessionMu.Lock()
 	g.sessionClosed = true
 	g.sessionMu.Unlock()
+
+	g.statsMu.Lock()
+	if !g.connectedAt.IsZero() && g.disconnectedAt.IsZero() {
+		g.disconnectedAt = time.Now()
+	}
+	g.statsMu.Unlock()
 }
 
 // removeFromBridge removes this participant from the media bridge
@@ -500,14 +683,304 @@ func (g *GeminiHandler) removeFromBridge() {
 	}
 }
 
+// sendToolResponse sends the result of a tool call to Gemini
+func (g *GeminiHandler) sendToolResponse(response *genai.FunctionResponse) {
+	g.sessionMu.RLock()
+	sessionClosed := g.sessionClosed
+	session := g.session
+	g.sessionMu.RUnlock()
+
+	if sessionClosed || session == nil {
+		return
+	}
+
+	g.sendMu.Lock()
+	if g.reconnecting {
+		g.pendingResponses = append(g.pendingResponses, response)
+		g.sendMu.Unlock()
+		return
+	}
+	err := session.SendToolResponse(genai.LiveToolResponseInput{
+		FunctionResponses: []*genai.FunctionResponse{response},
+	})
+	g.sendMu.Unlock()
+	if err != nil {
+		slog.Error("Error sending tool response to Gemini",
+			"event", "gemini_tool_response_error",
+			"participant", g.participantID,
+			"tool", response.Name,
+			"error", err.Error())
+	}
+}
+
+// Open starts the conversation as set by the session config's opening, e.g.
+// by having the AI greet the caller. It is called once the handler is started
+// and the caller's media is flowing; later calls do nothing.
+func (g *GeminiHandler) Open() error {
+	var err error
+	g.openOnce.Do(func() {
+		var opening *OpeningConfig
+		if g.sessionConfig != nil {
+			opening = g.sessionConfig.Opening
+		}
+
+		var text string
+		text, err = opening.opening()
+		if err != nil || text == "" {
+			return
+		}
+
+		g.sessionMu.RLock()
+		session := g.session
+		g.sessionMu.RUnlock()
+		if session == nil {
+			err = fmt.Errorf("not connected to Gemini Live")
+			return
+		}
+
+		turnComplete := true
+		g.sendMu.Lock()
+		err = session.SendClientContent(genai.LiveClientContentInput{
+			Turns: []*genai.Content{
+				genai.NewContentFromText(text, genai.RoleUser),
+			},
+			TurnComplete: &turnComplete,
+		})
+		g.sendMu.Unlock()
+		if err != nil {
+			return
+		}
+
+		mode := OpeningInstruction
+		if opening != nil && opening.Mode != "" {
+			mode = opening.Mode
+		}
+		slog.Info("Sent opening to Gemini",
+			"event", "opening_sent",
+			"participant", g.participantID,
+			"mode", mode)
+	})
+	return err
+}
+
+// connect opens a Live session, resuming the conversation of handle if set
+func (g *GeminiHandler) connect(ctx context.Context, handle string) (*genai.Session, error) {
+	config := *g.liveConfig
+	config.SessionResumption = &genai.SessionResumptionConfig{Handle: handle}
+	return g.client.Live.Connect(ctx, g.model, &config)
+}
+
+// reconnect replaces the Live session with a new one resuming from the latest
+// handle. It runs on the receive goroutine. Caller audio and tool responses
+// are held meanwhile and sent to the new session once it is up.
+func (g *GeminiHandler) reconnect(reason string) error {
+	g.sendMu.Lock()
+	g.reconnecting = true
+	g.sendMu.Unlock()
+
+	g.sessionMu.RLock()
+	old := g.session
+	handle := g.resumeHandle
+	g.sessionMu.RUnlock()
+
+	slog.Info("Reconnecting to Gemini Live",
+		"event", "gemini_reconnect",
+		"participant", g.participantID,
+		"reason", reason,
+		"resumable", handle != "")
+
+	// Give up as soon as the handler is closed
+	ctx, cancel := context.WithCancel(g.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-g.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var session *genai.Session
+	var err error
+	backoff := geminiReconnectBackoff
+	for attempt := 1; attempt <= maxGeminiReconnectAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			backoff *= 2
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+			break
+		}
+
+		session, err = g.connect(ctx, handle)
+		if err == nil {
+			break
+		}
+		slog.Warn("Gemini reconnect attempt failed",
+			"event", "gemini_reconnect_attempt_error",
+			"participant", g.participantID,
+			"attempt", attempt,
+			"error", err.Error())
+	}
+
+	if old != nil {
+		old.Close()
+	}
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.Counter("sip_proxy_gemini_reconnects_total",
+		"Live sessions resumed on a new connection, by reason and result", "reason", reason, "result", result).Inc()
+
+	g.sendMu.Lock()
+	defer g.sendMu.Unlock()
+
+	audio, responses := g.takePendingLocked()
+
+	if err != nil {
+		return err
+	}
+
+	// The call may have ended while we were connecting
+	g.sessionMu.Lock()
+	if g.sessionClosed {
+		g.sessionMu.Unlock()
+		session.Close()
+		return fmt.Errorf("handler closed while reconnecting to Gemini Live")
+	}
+	g.session = session
+	g.sessionMu.Unlock()
+
+	for _, response := range responses {
+		if err := session.SendToolResponse(genai.LiveToolResponseInput{
+			FunctionResponses: []*genai.FunctionResponse{response},
+		}); err != nil {
+			slog.Error("Error sending tool response to Gemini",
+				"event", "gemini_tool_response_error",
+				"participant", g.participantID,
+				"tool", response.Name,
+				"error", err.Error())
+		}
+	}
+	for _, pcmData := range audio {
+		if err := session.SendRealtimeInput(geminiAudioInput(pcmData)); err != nil {
+			break
+		}
+	}
+
+	slog.Info("Reconnected to Gemini Live",
+		"event", "gemini_reconnected",
+		"participant", g.participantID,
+		"resumed", handle != "",
+		"buffered_bytes", bufferedBytes(audio))
+
+	return nil
+}
+
+// bufferAudioLocked holds caller audio during a reconnect, dropping the
+// oldest beyond maxReconnectBufferBytes. sendMu must be held.
+func (g *GeminiHandler) bufferAudioLocked(pcmData []byte) {
+	g.pendingAudio = append(g.pendingAudio, append([]byte(nil), pcmData...))
+	g.pendingAudioBytes += len(pcmData)
+
+	excess := g.pendingAudioBytes - maxReconnectBufferBytes
+	// Keep whole samples when trimming
+	excess += excess % 2
+	for excess > 0 {
+		oldest := g.pendingAudio[0]
+		if len(oldest) > excess {
+			g.pendingAudio[0] = oldest[excess:]
+			g.pendingAudioBytes -= excess
+			break
+		}
+		g.pendingAudio = g.pendingAudio[1:]
+		g.pendingAudioBytes -= len(oldest)
+		excess -= len(oldest)
+	}
+}
+
+// takePendingLocked ends a reconnect and returns the caller audio and tool
+// responses held during it, to be sent to the new session. sendMu must be held.
+func (g *GeminiHandler) takePendingLocked() ([][]byte, []*genai.FunctionResponse) {
+	audio, responses := g.pendingAudio, g.pendingResponses
+	g.reconnecting = false
+	g.pendingAudio = nil
+	g.pendingAudioBytes = 0
+	g.pendingResponses = nil
+	return audio, responses
+}
+
+// bufferedBytes returns the total size of buffered audio chunks
+func bufferedBytes(chunks [][]byte) int {
+	total := 0
+	for _, chunk := range chunks {
+		total += len(chunk)
+	}
+	return total
+}
+
+// geminiAudioInput wraps caller audio for the Live API
+func geminiAudioInput(pcmData []byte) genai.LiveRealtimeInput {
+	return genai.LiveRealtimeInput{
+		Audio: &genai.Blob{
+			MIMEType: fmt.Sprintf("audio/pcm;rate=%d", geminiInputFormat.SampleRate),
+			Data:     pcmData,
+		},
+	}
+}
+
+// addUsage adds the tokens of one usage report to the call's totals
+func (g *GeminiHandler) addUsage(usage *genai.UsageMetadata) {
+	g.statsMu.Lock()
+	defer g.statsMu.Unlock()
+
+	g.stats.Usage.add(usage)
+}
+
+// Transcript returns the call's transcript
+func (g *GeminiHandler) Transcript() *Transcript {
+	return g.transcript
+}
+
+// Stats returns the model, interruption count, token usage and connected
+// time of the call
+func (g *GeminiHandler) Stats() AIStats {
+	g.statsMu.Lock()
+	defer g.statsMu.Unlock()
+
+	stats := g.stats
+	if !g.connectedAt.IsZero() {
+		until := g.disconnectedAt
+		if until.IsZero() {
+			until = time.Now()
+		}
+		stats.ConnectedSeconds = until.Sub(g.connectedAt).Seconds()
+	}
+	return stats
+}
+
+// ParticipantID returns the handler's ID in the media bridge
+func (g *GeminiHandler) ParticipantID() string {
+	return g.participantID
+}
+
 // BroadcastResponse broadcasts Gemini's audio response to other participants
 func (g *GeminiHandler) BroadcastResponse(audioData []byte) error {
 	// The audio data from Gemini is sent as a media chunk
 	// The receiving end will handle any necessary formatting (e.g., RTP encapsulation)
 	chunk := &MediaChunk{
-		Data:     audioData,
-		SenderID: g.participantID,
+		Data:      audioData,
+		SenderID:  g.participantID,
+		Format:    geminiOutputFormat,
+		Timestamp: time.Duration(g.outputSamples) * time.Second / time.Duration(geminiOutputFormat.SampleRate),
 	}
+	g.outputSamples += int64(len(audioData) / 2)
 
 	if err := g.mediaBridge.Broadcast(chunk); err != nil {
 		if err != io.ErrClosedPipe {
@@ -556,6 +1029,11 @@ func (g *GeminiHandler) Close() error {
 			"participant", g.participantID)
 	}
 
+	// Abandon tool calls in progress; their results have nowhere to go
+	if g.tools != nil {
+		g.tools.Close()
+	}
+
 	// Close Gemini session safely
 	g.sessionMu.Lock()
 	session := g.session
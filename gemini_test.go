@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"google.golang.org/genai"
+)
+
+func TestReconnectBufferKeepsNewestWholeSamples(t *testing.T) {
+	handler := &GeminiHandler{session: &genai.Session{}, reconnecting: true}
+	writer := &GeminiAudioWriter{handler: handler}
+
+	// 12s of numbered samples in 20ms chunks, 2s more than the buffer holds
+	const chunkBytes = 640
+	var written []byte
+	for sample := 0; len(written) < maxReconnectBufferBytes+2*16000*2; {
+		chunk := make([]byte, chunkBytes)
+		for i := 0; i < chunkBytes; i += 2 {
+			binary.LittleEndian.PutUint16(chunk[i:], uint16(sample))
+			sample++
+		}
+		written = append(written, chunk...)
+		if _, err := writer.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An odd-sized write makes the excess odd
+	if _, err := writer.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	written = append(written, 1, 2, 3)
+
+	handler.sendMu.Lock()
+	audio, _ := handler.takePendingLocked()
+	replayed, _ := handler.takePendingLocked()
+	reconnecting, pendingBytes := handler.reconnecting, handler.pendingAudioBytes
+	handler.sendMu.Unlock()
+
+	buffered := bytes.Join(audio, nil)
+	if len(buffered) > maxReconnectBufferBytes {
+		t.Fatalf("buffered %d bytes, more than the %d byte cap", len(buffered), maxReconnectBufferBytes)
+	}
+	if len(buffered) < maxReconnectBufferBytes-1 {
+		t.Fatalf("buffered %d bytes, dropped more than needed for the %d byte cap", len(buffered), maxReconnectBufferBytes)
+	}
+	// The oldest audio was dropped on a sample boundary of the stream
+	if dropped := len(written) - len(buffered); dropped%2 != 0 || !bytes.Equal(buffered, written[dropped:]) {
+		t.Fatalf("buffer is not the newest %d bytes starting on a sample boundary", len(buffered))
+	}
+
+	// Held audio is handed over once, and later audio goes to the new session
+	if len(replayed) != 0 || pendingBytes != 0 || reconnecting {
+		t.Fatalf("second take returned %d chunks, reconnecting %v", len(replayed), reconnecting)
+	}
+}
+
+func TestOpeningConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *OpeningConfig
+		want    string // Exact first turn, or a substring of it for greetings
+		wantErr bool
+	}{
+		{"default", nil, defaultOpeningInstruction, false},
+		{"instruction", &OpeningConfig{Mode: OpeningInstruction, Text: "Introduce yourself"}, "Introduce yourself", false},
+		{"instruction without text", &OpeningConfig{Mode: OpeningInstruction}, defaultOpeningInstruction, false},
+		{"mode omitted", &OpeningConfig{Text: "Introduce yourself"}, "Introduce yourself", false},
+		{"greeting", &OpeningConfig{Mode: OpeningGreeting, Text: "Thanks for calling Acme"}, `"Thanks for calling Acme"`, false},
+		{"greeting without text", &OpeningConfig{Mode: OpeningGreeting}, "", true},
+		{"none", &OpeningConfig{Mode: OpeningNone, Text: "ignored"}, "", false},
+		{"invalid mode", &OpeningConfig{Mode: "shout"}, "", true},
+	}
+	for _, test := range tests {
+		got, err := test.config.opening()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: error %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		switch {
+		case test.config != nil && test.config.Mode == OpeningGreeting:
+			if !strings.Contains(got, test.want) {
+				t.Errorf("%s: opening %q does not quote the greeting %s", test.name, got, test.want)
+			}
+		case got != test.want:
+			t.Errorf("%s: opening %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGeminiModelSelection(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  GeminiConfig
+		session *SessionConfig
+		want    string
+	}{
+		{"api default", GeminiConfig{}, &SessionConfig{}, defaultGeminiModel},
+		{"vertex default", GeminiConfig{Backend: GeminiBackendVertex}, &SessionConfig{}, defaultVertexModel},
+		{"configured default", GeminiConfig{Backend: GeminiBackendVertex, Model: "gemini-custom"}, &SessionConfig{}, "gemini-custom"},
+		{"no session config", GeminiConfig{Model: "gemini-custom"}, nil, "gemini-custom"},
+		{"session override", GeminiConfig{Model: "gemini-custom"}, &SessionConfig{Model: "gemini-session"}, "gemini-session"},
+	}
+	for _, test := range tests {
+		if got := test.config.SessionModel(test.session); got != test.want {
+			t.Errorf("%s: model %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewGeminiClientBackends(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  GeminiConfig
+		apiKey  string
+		wantErr string // Empty if the client is created
+	}{
+		{"api key", GeminiConfig{Backend: GeminiBackendAPI}, "test-key", ""},
+		{"api key by default", GeminiConfig{}, "test-key", ""},
+		{"api without key", GeminiConfig{Backend: GeminiBackendAPI}, "", "GOOGLE_API_KEY"},
+		{"vertex without project", GeminiConfig{Backend: GeminiBackendVertex, Location: "europe-west4"}, "", "project and a location"},
+		{"vertex without location", GeminiConfig{Backend: GeminiBackendVertex, Project: "acme"}, "", "project and a location"},
+		{"vertex with missing credentials", GeminiConfig{Backend: GeminiBackendVertex, Project: "acme", Location: "europe-west4",
+			CredentialsFile: "/nonexistent/key.json"}, "", "Vertex AI credentials"},
+		{"unknown backend", GeminiConfig{Backend: "openai"}, "test-key", "unknown Gemini backend"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GOOGLE_API_KEY", test.apiKey)
+			client, err := NewGeminiClient(context.Background(), test.config)
+			if test.wantErr == "" {
+				if err != nil || client == nil {
+					t.Fatalf("no client: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("error %v, want one mentioning %q", err, test.wantErr)
+			}
+		})
+	}
+}
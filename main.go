@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
+	"google.golang.org/genai"
 )
 
 /*
@@ -36,8 +40,77 @@ func main() {
 	publicIP := flag.String("public-ip", "", "Public IP address (defaults to first non-localhost interface)")
 	sipURLArg := flag.String("sip-url", "", "SIP URL for Twilio (defaults to sip:PUBLIC_IP:5060)")
 	twilioFrom := flag.String("twilio-from", "+1123456789", "Caller ID for Twilio")
+	rtpTimeout := flag.Duration("rtp-timeout", 30*time.Second, "Hang up when no RTP is received for this long while not on hold (0 disables)")
+	strictRTP := flag.Bool("strict-rtp", true, "Only accept RTP from the SDP media address or a source that has proven itself with consecutive packets")
+	outputTargetDBFS := flag.Float64("output-target-dbfs", 0, "Target speech level in dBFS for AI audio sent to callers, e.g. -18 (0 disables normalization)")
+	outputMaxGainDB := flag.Float64("output-max-gain-db", defaultOutputMaxGainDB, "Maximum gain in dB applied when normalizing AI audio")
+	recordCalls := flag.Bool("record", false, "Record calls to stereo WAV files (can be overridden per call by the callback response)")
+	recordingDir := flag.String("recording-dir", "recordings", "Directory for call recordings when using local storage")
+	storageBackend := flag.String("storage", "local", "Recording storage backend: local or s3")
+	recordingKeyTemplate := flag.String("recording-key-template", "{date}/{did}/{call_id}", "Storage key for recordings; placeholders: {date} {year} {month} {day} {did} {from} {call_id}")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3 endpoint URL, e.g. http://localhost:9000 for MinIO (defaults to AWS for the region)")
+	s3Region := flag.String("s3-region", "us-east-1", "S3 region")
+	s3Bucket := flag.String("s3-bucket", "", "S3 bucket for recordings")
+	s3PathStyle := flag.Bool("s3-path-style", false, "Use path-style S3 URLs (required by MinIO and most self-hosted services)")
+	spoolDir := flag.String("spool-dir", "spool", "Local spool directory for S3 uploads; failed uploads are kept here and retried")
+	bridgeMode := flag.String("bridge-mode", BridgeModeForward, "Media bridge mode: forward (pass audio through) or mix (per-participant N-1 mixes for conferences)")
+	bridgeQueueSize := flag.Int("bridge-queue-size", defaultBridgeQueueSize, "Audio chunks buffered per media bridge participant")
+	bridgeDropPolicy := flag.String("bridge-drop-policy", DropOldest, "Which chunk to drop when a participant's queue is full: oldest or newest")
+	waitAudio := flag.String("wait-audio", "", "WAV file or URL looped to callers while the AI connects (optional)")
+	adminPort := flag.Int("admin-port", 0, "Admin API port for controlling live calls (0 disables)")
+	adminBind := flag.String("admin-bind", defaultAdminBind, "Address the admin API listens on; other than loopback requires --admin-token")
+	adminToken := flag.String("admin-token", "", "Bearer token required by the admin API (required unless --admin-bind is loopback)")
+	adminAudioDir := flag.String("admin-audio-dir", "", "Directory the admin API may play prompt files from (optional)")
+	adminAudioURLs := flag.String("admin-audio-urls", "", "Comma-separated URL prefixes the admin API may play prompts from (optional)")
+	webrtcICEServers := flag.String("webrtc-ice-servers", "", "Comma-separated STUN/TURN URLs for WebRTC participants, e.g. stun:stun.l.google.com:19302 (optional)")
+	endCallWebhookURL := flag.String("end-call-webhook-url", "", "HTTP URL notified when a call ends (optional)")
+	extractionWebhookURL := flag.String("extraction-webhook-url", "", "HTTP URL notified of values extracted from the AI's speech (defaults to <callback-url>/intent)")
+	toolWebhookURL := flag.String("tool-webhook-url", "", "HTTP URL that executes the AI's tool calls (optional)")
+	transferAllow := flag.String("transfer-allow", "", "Comma-separated numbers or SIP URIs the AI may transfer calls to without transfer_targets; a trailing * matches a prefix (optional)")
+	toolTimeout := flag.Duration("tool-timeout", defaultToolTimeout, "Timeout of a tool webhook request")
+	geminiBackend := flag.String("gemini-backend", GeminiBackendAPI, "Backend serving the Live API: gemini-api (GOOGLE_API_KEY) or vertex (Vertex AI)")
+	geminiModel := flag.String("gemini-model", "", "Default Live model, overridable per call (defaults to "+defaultGeminiModel+", or "+defaultVertexModel+" on Vertex AI)")
+	vertexProject := flag.String("vertex-project", os.Getenv("GOOGLE_CLOUD_PROJECT"), "Vertex AI project (defaults to GOOGLE_CLOUD_PROJECT)")
+	vertexLocation := flag.String("vertex-location", os.Getenv("GOOGLE_CLOUD_LOCATION"), "Vertex AI location, e.g. europe-west4 (defaults to GOOGLE_CLOUD_LOCATION)")
+	vertexCredentials := flag.String("vertex-credentials", "", "Service-account key file for Vertex AI (defaults to Application Default Credentials)")
+	priceTable := flag.String("price-table", "", "JSON file pricing Live models, for per-call cost estimates (optional)")
+	usageDIDs := flag.String("usage-dids", "", "Comma-separated dialed numbers usage metrics are labelled with; others count as \"other\" (default: the first 100 numbers called)")
 	flag.Parse()
 
+	if *bridgeMode != BridgeModeForward && *bridgeMode != BridgeModeMix {
+		fmt.Fprintf(os.Stderr, "invalid --bridge-mode %q (want %q or %q)\n", *bridgeMode, BridgeModeForward, BridgeModeMix)
+		os.Exit(2)
+	}
+	if *bridgeDropPolicy != DropOldest && *bridgeDropPolicy != DropNewest {
+		fmt.Fprintf(os.Stderr, "invalid --bridge-drop-policy %q (want %q or %q)\n", *bridgeDropPolicy, DropOldest, DropNewest)
+		os.Exit(2)
+	}
+	adminConfig := AdminConfig{
+		Bind:      *adminBind,
+		Port:      *adminPort,
+		Token:     *adminToken,
+		AudioDir:  *adminAudioDir,
+		AudioURLs: splitList(*adminAudioURLs),
+	}
+	if *adminPort != 0 {
+		if err := adminConfig.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid admin API configuration: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if *geminiBackend != GeminiBackendAPI && *geminiBackend != GeminiBackendVertex {
+		fmt.Fprintf(os.Stderr, "invalid --gemini-backend %q (want %q or %q)\n", *geminiBackend, GeminiBackendAPI, GeminiBackendVertex)
+		os.Exit(2)
+	}
+	var prices *PriceTable
+	if *priceTable != "" {
+		var err error
+		if prices, err = LoadPriceTable(*priceTable); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --price-table: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
 	// Determine public IP
 	var actualPublicIP string
 	if *publicIP != "" {
@@ -54,14 +127,73 @@ func main() {
 		sipURL = fmt.Sprintf("sip:%s:%d", actualPublicIP, *port)
 	}
 
+	// Server-wide outbound loudness, overridable per session
+	var outputLoudness *OutputLoudnessConfig
+	if *outputTargetDBFS != 0 {
+		outputLoudness = &OutputLoudnessConfig{
+			TargetDBFS: *outputTargetDBFS,
+			MaxGainDB:  *outputMaxGainDB,
+		}
+	}
+
 	config := &Config{
-		Port:        *port,
-		CallbackURL: *callbackURL,
+		Port:                *port,
+		CallbackURL:         *callbackURL,
 		DefaultInstructions: *defaultInstructions,
+		RTPTimeout:          *rtpTimeout,
+		StrictRTP:           *strictRTP,
+		OutputLoudness:      outputLoudness,
+		RecordCalls:         *recordCalls,
+		Storage: StorageConfig{
+			Backend:     *storageBackend,
+			LocalDir:    *recordingDir,
+			KeyTemplate: *recordingKeyTemplate,
+			SpoolDir:    *spoolDir,
+			S3: S3Config{
+				Endpoint:        *s3Endpoint,
+				Region:          *s3Region,
+				Bucket:          *s3Bucket,
+				AccessKeyID:     firstEnv("S3_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: firstEnv("S3_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY"),
+				PathStyle:       *s3PathStyle,
+			},
+		},
+		WaitAudio: *waitAudio,
+		Bridge: BridgeConfig{
+			Mode:       *bridgeMode,
+			QueueSize:  *bridgeQueueSize,
+			DropPolicy: *bridgeDropPolicy,
+		},
+		WebRTC: WebRTCConfig{
+			ICEServers: splitList(*webrtcICEServers),
+			PublicIP:   *publicIP,
+		},
+		EndCallWebhookURL:    *endCallWebhookURL,
+		ExtractionWebhookURL: *extractionWebhookURL,
+		TransferAllow:        splitList(*transferAllow),
+		Tools: ToolConfig{
+			WebhookURL: *toolWebhookURL,
+			Timeout:    *toolTimeout,
+		},
+		Gemini: GeminiConfig{
+			Backend:         *geminiBackend,
+			Model:           *geminiModel,
+			Project:         *vertexProject,
+			Location:        *vertexLocation,
+			CredentialsFile: *vertexCredentials,
+		},
+		Prices:    prices,
+		UsageDIDs: splitList(*usageDIDs),
 	}
 
 	// Create media handler factory
-	factory := NewMediaHandlerFactory()
+	factory, err := NewMediaHandlerFactory(config.Gemini)
+	if err != nil {
+		slog.Error("Failed to create media handler factory",
+			"event", "factory_create_error",
+			"error", err.Error())
+		os.Exit(1)
+	}
 
 	// Initialize SIP server
 	server, err := NewSIPServer(config, factory)
@@ -89,6 +221,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Initialize and start the admin API if enabled
+	var adminServer *AdminServer
+	if *adminPort != 0 {
+		adminServer = NewAdminServer(adminConfig, server)
+		if err := adminServer.Start(); err != nil {
+			slog.Error("Failed to start admin server",
+				"event", "admin_server_start_error",
+				"error", err.Error())
+			os.Exit(1)
+		}
+	}
+
 	fmt.Printf("SIP Proxy listening on port %d\n", *port)
 	if *callbackURL != "" {
 		fmt.Printf("Callback URL: %s\n", *callbackURL)
@@ -96,9 +240,12 @@ func main() {
 		fmt.Println("Callback URL: none (using default prompt)")
 	}
 	fmt.Printf("Twilio webhook server listening on port %d\n", *twilioPort)
+	if adminServer != nil {
+		fmt.Printf("Admin API listening on %s\n", adminServer.server.Addr)
+	}
 	fmt.Printf("Public IP: %s\n", actualPublicIP)
 	fmt.Printf("SIP URL: %s\n", sipURL)
-	fmt.Println("Using Gemini handler")
+	fmt.Printf("Using Gemini handler: backend %s, default model %s\n", config.Gemini.Backend, config.Gemini.DefaultModel())
 
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
@@ -106,42 +253,83 @@ func main() {
 	<-sigChan
 
 	fmt.Println("\nShutting down server...")
+	if adminServer != nil {
+		adminServer.Stop()
+	}
 	server.Stop()
 }
 
 // Config holds the server configuration
 type Config struct {
-	Port        int
-	CallbackURL string
-	DefaultInstructions string
+	Port                 int
+	CallbackURL          string
+	DefaultInstructions  string
+	RTPTimeout           time.Duration         // Hang up after this long without RTP (0 disables)
+	StrictRTP            bool                  // Validate the source of incoming RTP against the SDP
+	OutputLoudness       *OutputLoudnessConfig // Default normalization of AI audio, nil if disabled
+	RecordCalls          bool                  // Record calls unless the callback response says otherwise
+	Storage              StorageConfig         // Where recordings and their metadata are stored
+	WaitAudio            string                // Looped to callers while the AI connects, empty to disable
+	Bridge               BridgeConfig          // Media bridge mode and per-participant queueing
+	WebRTC               WebRTCConfig          // Browser participants joined through the admin API
+	EndCallWebhookURL    string                // Notified with the end reason when a call ends
+	ExtractionWebhookURL string                // Notified of extracted values, defaults to the callback URL's /intent
+	TransferAllow        []string              // Targets the AI may transfer to without transfer_targets
+	Tools                ToolConfig            // Where the AI's tool calls are executed
+	Gemini               GeminiConfig          // Live API backend and default model
+	Prices               *PriceTable           // Prices of Live models for cost estimates, nil if not configured
+	UsageDIDs            []string              // Dialed numbers usage metrics are labelled with, empty for the first maxUsageDIDs
 }
 
 // MediaHandlerFactory creates media handlers
 type MediaHandlerFactory struct {
+	client *genai.Client // Shared by all calls
+	config GeminiConfig
 }
 
-// NewMediaHandlerFactory creates a new factory instance
-func NewMediaHandlerFactory() *MediaHandlerFactory {
-	return &MediaHandlerFactory{}
+// NewMediaHandlerFactory creates a new factory instance for the configured
+// Gemini backend
+func NewMediaHandlerFactory(config GeminiConfig) (*MediaHandlerFactory, error) {
+	client, err := NewGeminiClient(context.Background(), config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
+	}
+	return &MediaHandlerFactory{client: client, config: config}, nil
 }
 
-// CreateHandler creates a Gemini handler
-func (f *MediaHandlerFactory) CreateHandler(mediaBridge MediaBridge, callID string, sessionConfig *SessionConfig) (MediaHandler, error) {
+// CreateHandler creates a Gemini handler. It is started (connected) once the
+// call has been answered, so that prompts can play while it connects. The
+// session config may choose the model. tools executes the session's tool
+// calls; it may be nil.
+func (f *MediaHandlerFactory) CreateHandler(mediaBridge MediaBridge, callID string, sessionConfig *SessionConfig, tools *ToolDispatcher) (MediaHandler, error) {
+	model := f.config.SessionModel(sessionConfig)
+
 	// Use Gemini handler
 	slog.Info("Creating Gemini handler for session",
 		"event", "gemini_handler_create",
-		"session", callID)
-	geminiHandler, err := NewGeminiHandler(mediaBridge, "gemini-"+callID, sessionConfig)
-	if err != nil {
-		return nil, err
-	}
+		"session", callID,
+		"backend", f.config.Backend,
+		"model", model)
+	return NewGeminiHandler(mediaBridge, f.client, model, "gemini-"+callID, sessionConfig, tools)
+}
 
-	// Start Gemini processing
-	if err := geminiHandler.Start(); err != nil {
-		slog.Error("Failed to start Gemini handler",
-			"event", "gemini_handler_start_error",
-			"error", err.Error())
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
 
-	return geminiHandler, nil
+// firstEnv returns the first non-empty environment variable among names
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
 }
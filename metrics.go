@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric kinds in the Prometheus text exposition format
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// defaultLatencyBuckets are histogram buckets (in seconds) for media latencies
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.02, 0.04, 0.08, 0.16, 0.32, 0.64, 1.28, 2.56}
+
+// metrics is the process-wide registry served on the admin API's /metrics
+var metrics = NewMetricsRegistry()
+
+// MetricsRegistry holds metric families and renders them in the Prometheus
+// text exposition format
+type MetricsRegistry struct {
+	families map[string]*metricFamily
+	mu       sync.Mutex
+}
+
+// metricFamily is all series of one metric name
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+// metricSeries is one labelled series of a metric
+type metricSeries struct {
+	labels  []string // Alternating names and values
+	value   float64
+	counts  []uint64 // Histogram bucket counts (non-cumulative)
+	count   uint64
+	sum     float64
+	mu      sync.Mutex
+	buckets []float64
+}
+
+// NewMetricsRegistry creates an empty registry
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{families: make(map[string]*metricFamily)}
+}
+
+// Counter returns the counter series for name and label pairs, creating it if needed
+func (r *MetricsRegistry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{series: r.series(name, help, metricCounter, nil, labels)}
+}
+
+// Gauge returns the gauge series for name and label pairs, creating it if needed
+func (r *MetricsRegistry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{series: r.series(name, help, metricGauge, nil, labels)}
+}
+
+// Histogram returns the histogram series for name and label pairs, creating it if needed
+func (r *MetricsRegistry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{series: r.series(name, help, metricHistogram, buckets, labels)}
+}
+
+// series looks up or creates a series
+func (r *MetricsRegistry) series(name, help, kind string, buckets []float64, labels []string) *metricSeries {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("metric %s: labels must be name/value pairs", name))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	family := r.families[name]
+	if family == nil {
+		family = &metricFamily{
+			name:    name,
+			help:    help,
+			kind:    kind,
+			buckets: buckets,
+			series:  make(map[string]*metricSeries),
+		}
+		r.families[name] = family
+	}
+
+	key := strings.Join(labels, "\xff")
+	s := family.series[key]
+	if s == nil {
+		s = &metricSeries{labels: append([]string(nil), labels...), buckets: family.buckets}
+		if family.kind == metricHistogram {
+			s.counts = make([]uint64, len(family.buckets))
+		}
+		family.series[key] = s
+	}
+	return s
+}
+
+// RemoveSeries deletes every series that has the given label value, e.g. all
+// series of a participant that has left
+func (r *MetricsRegistry) RemoveSeries(labelName, labelValue string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, family := range r.families {
+		for key, s := range family.series {
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				if s.labels[i] == labelName && s.labels[i+1] == labelValue {
+					delete(family.series, key)
+					break
+				}
+			}
+		}
+	}
+}
+
+// WriteTo renders all metrics in the Prometheus text exposition format
+func (r *MetricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		family := r.families[name]
+		if len(family.series) == 0 {
+			continue
+		}
+
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, family.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, family.kind)
+		for _, key := range keys {
+			family.series[key].write(&b, family)
+		}
+	}
+	r.mu.Unlock()
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// write renders one series
+func (s *metricSeries) write(b *strings.Builder, family *metricFamily) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if family.kind != metricHistogram {
+		fmt.Fprintf(b, "%s%s %s\n", family.name, formatLabels(s.labels), formatMetricValue(s.value))
+		return
+	}
+
+	var cumulative uint64
+	for i, upper := range family.buckets {
+		cumulative += s.counts[i]
+		labels := append(append([]string(nil), s.labels...), "le", formatMetricValue(upper))
+		fmt.Fprintf(b, "%s_bucket%s %d\n", family.name, formatLabels(labels), cumulative)
+	}
+	labels := append(append([]string(nil), s.labels...), "le", "+Inf")
+	fmt.Fprintf(b, "%s_bucket%s %d\n", family.name, formatLabels(labels), s.count)
+	fmt.Fprintf(b, "%s_sum%s %s\n", family.name, formatLabels(s.labels), formatMetricValue(s.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", family.name, formatLabels(s.labels), s.count)
+}
+
+// formatLabels renders label pairs as {name="value",...}
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+`="`+escaper.Replace(labels[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// formatMetricValue renders a sample value
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	series *metricSeries
+}
+
+// Inc adds one
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative
+func (c *Counter) Add(v float64) {
+	c.series.mu.Lock()
+	c.series.value += v
+	c.series.mu.Unlock()
+}
+
+// Gauge is a metric that can go up and down
+type Gauge struct {
+	series *metricSeries
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) {
+	g.series.mu.Lock()
+	g.series.value = v
+	g.series.mu.Unlock()
+}
+
+// Add adds v (which may be negative)
+func (g *Gauge) Add(v float64) {
+	g.series.mu.Lock()
+	g.series.value += v
+	g.series.mu.Unlock()
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	series *metricSeries
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64) {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+
+	for i, upper := range h.series.buckets {
+		if v <= upper {
+			h.series.counts[i]++
+			break
+		}
+	}
+	h.series.count++
+	h.series.sum += v
+}
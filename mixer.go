@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// maxMixBacklog bounds how much audio a sender may queue ahead of the mix
+	// clock (the AI sends whole utterances faster than real time)
+	maxMixBacklog = 120 * time.Second
+	// mixPartialTicks is how many ticks a partial frame waits for more audio
+	// before it is mixed padded with silence (the tail of an utterance)
+	mixPartialTicks = 2
+	// mixCeiling is the peak level the mix limiter keeps sums below (-1 dBFS)
+	mixCeiling = 0.891
+	// mixLimiterRelease is the per-frame recovery of the limiter gain (~200ms)
+	mixLimiterRelease = 0.1
+)
+
+// Bridge modes
+const (
+	BridgeModeForward = "forward" // DefaultMediaBridge: forward each chunk as-is
+	BridgeModeMix     = "mix"     // MixingMediaBridge: per-listener N-1 mixes
+)
+
+// NewSessionBridge creates the media bridge for the configured mode
+func NewSessionBridge(config BridgeConfig, sampleRate int) MediaBridge {
+	if config.Mode == BridgeModeMix {
+		return NewMixingMediaBridge(sampleRate, config)
+	}
+	return NewMediaBridge(config)
+}
+
+// mixInputKey identifies an input stream: a sender, optionally addressed to a
+// single recipient (e.g. prompts for the caller only)
+type mixInputKey struct {
+	sender    string
+	recipient string
+}
+
+// mixInput buffers audio from one sender until the mix clock consumes it
+type mixInput struct {
+	buffer       []byte
+	partialTicks int
+}
+
+// MixingMediaBridge implements MediaBridge for conferences. Senders' audio is
+// buffered per sender and, on a fixed 20ms clock, each listener receives the
+// sum of every other participant's audio (an N-1 mix). A per-listener limiter
+// keeps loud sums from clipping. Mixes are delivered through per-participant
+// queues, as in DefaultMediaBridge. Senders' audio is converted to 16-bit mono
+// PCM at sampleRate for mixing, and each mix is converted to a format its
+// listener accepts.
+type MixingMediaBridge struct {
+	queues       map[string]*participantQueue
+	config       BridgeConfig
+	format       MediaFormat
+	converter    *chunkConverter // Senders' audio to format
+	inputs       map[mixInputKey]*mixInput
+	audiences    audiences
+	events       *BridgeEvents
+	limiterGains map[string]float64 // Per listener
+	frameBytes   int
+	maxBacklog   int
+	ticks        int64 // Mix clock, for chunk timestamps
+	stopChan     chan struct{}
+	stopped      bool
+	wg           sync.WaitGroup
+	mu           sync.Mutex
+}
+
+// NewMixingMediaBridge creates a mixing bridge for PCM at sampleRate
+func NewMixingMediaBridge(sampleRate int, config BridgeConfig) *MixingMediaBridge {
+	frameSamples := sampleRate * int(rtpFrameDuration/time.Millisecond) / 1000
+	format := PCM16Format(sampleRate)
+	return &MixingMediaBridge{
+		queues:       make(map[string]*participantQueue),
+		config:       config,
+		format:       format,
+		converter:    newChunkConverter("mixer", []MediaFormat{format}),
+		inputs:       make(map[mixInputKey]*mixInput),
+		audiences:    make(audiences),
+		events:       newBridgeEvents(),
+		limiterGains: make(map[string]float64),
+		frameBytes:   frameSamples * 2,
+		maxBacklog:   sampleRate * 2 * int(maxMixBacklog/time.Second),
+		stopChan:     make(chan struct{}),
+	}
+}
+
+// AddParticipant adds a new participant to the bridge and starts its writer
+func (m *MixingMediaBridge) AddParticipant(participant Participant) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		return io.ErrClosedPipe
+	}
+
+	id := participant.ID()
+	if existing := m.queues[id]; existing != nil {
+		existing.close()
+	}
+
+	queue := newParticipantQueue(participant, m.config, m.events)
+	m.queues[id] = queue
+	m.limiterGains[id] = 1
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		queue.run(m.removeClosed)
+	}()
+
+	slog.Info("Added participant to mixing bridge",
+		"event", "participant_added",
+		"participant", id,
+		"total", len(m.queues))
+	m.events.publish(BridgeEvent{Type: BridgeEventParticipantJoined, Participant: id, Total: len(m.queues)})
+
+	return nil
+}
+
+// RemoveParticipant removes a participant and any audio it has queued
+func (m *MixingMediaBridge) RemoveParticipant(participantID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(participantID, BridgeEventParticipantLeft, "removed")
+	return nil
+}
+
+// removeClosed removes a participant whose writer returned io.ErrClosedPipe
+func (m *MixingMediaBridge) removeClosed(queue *participantQueue) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.queues[queue.participant.ID()] == queue {
+		m.removeLocked(queue.participant.ID(), BridgeEventParticipantClosed, "")
+	}
+}
+
+// removeLocked removes a participant and publishes eventType. Caller must hold the lock.
+func (m *MixingMediaBridge) removeLocked(participantID, eventType, reason string) {
+	queue, exists := m.queues[participantID]
+	if !exists {
+		return
+	}
+
+	queue.release()
+	delete(m.queues, participantID)
+	delete(m.limiterGains, participantID)
+	delete(m.audiences, participantID)
+	for key := range m.inputs {
+		if key.sender == participantID {
+			delete(m.inputs, key)
+		}
+	}
+	m.converter.Forget(participantID)
+
+	slog.Info("Removed participant from mixing bridge",
+		"event", "participant_removed",
+		"participant", participantID,
+		"total", len(m.queues))
+	m.events.publish(BridgeEvent{Type: eventType, Participant: participantID, Reason: reason, Total: len(m.queues)})
+}
+
+// Broadcast queues a chunk for mixing into every other participant's mix,
+// or only into chunk.RecipientID's mix if it is set
+func (m *MixingMediaBridge) Broadcast(chunk *MediaChunk) error {
+	converted := m.converter.Convert(chunk)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		return io.ErrClosedPipe
+	}
+	if converted == nil {
+		return nil
+	}
+	chunk = converted
+
+	// Taps get each sender's audio unmixed
+	for id, queue := range m.queues {
+		if !queue.passive || id == chunk.SenderID {
+			continue
+		}
+		if chunk.RecipientID != "" && id != chunk.RecipientID {
+			continue
+		}
+		if m.audiences.allows(chunk.SenderID, id) {
+			queue.enqueue(chunk)
+		}
+	}
+
+	key := mixInputKey{sender: chunk.SenderID, recipient: chunk.RecipientID}
+	input := m.inputs[key]
+	if input == nil {
+		input = &mixInput{}
+		m.inputs[key] = input
+	}
+	input.buffer = append(input.buffer, chunk.Data...)
+
+	if excess := len(input.buffer) - m.maxBacklog; excess > 0 {
+		// Keep whole samples when trimming
+		excess += excess % 2
+		input.buffer = input.buffer[excess:]
+		slog.Warn("Mix input backlog full, dropping oldest audio",
+			"event", "mix_backlog_dropped",
+			"sender", chunk.SenderID,
+			"dropped_bytes", excess)
+	}
+
+	return nil
+}
+
+// FlushQueues drops all audio waiting to be mixed, drains the queues of
+// participants that implement QueueFlusher and notifies them to flush
+func (m *MixingMediaBridge) FlushQueues() error {
+	m.converter.Reset()
+
+	m.mu.Lock()
+	flushedBytes := 0
+	for key, input := range m.inputs {
+		flushedBytes += len(input.buffer)
+		delete(m.inputs, key)
+	}
+	queuesSnapshot := make([]*participantQueue, 0, len(m.queues))
+	for _, queue := range m.queues {
+		queuesSnapshot = append(queuesSnapshot, queue)
+	}
+	m.mu.Unlock()
+
+	flushedCount := flushParticipantQueues(queuesSnapshot, m.events)
+
+	slog.Info("Flushed mixing bridge",
+		"event", "mediabridge_flush_complete",
+		"flushed_bytes", flushedBytes,
+		"flushed_count", flushedCount,
+		"total_participants", len(queuesSnapshot))
+	m.events.publish(BridgeEvent{Type: BridgeEventFlushed, Count: flushedCount, Total: len(queuesSnapshot)})
+	return nil
+}
+
+// SetAudience limits whose mixes a sender is included in
+func (m *MixingMediaBridge) SetAudience(senderID string, audience []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.audiences.set(senderID, audience)
+	return nil
+}
+
+// Subscribe returns a channel of the bridge's lifecycle events
+func (m *MixingMediaBridge) Subscribe(buffer int) (<-chan BridgeEvent, func()) {
+	return m.events.Subscribe(buffer)
+}
+
+// Start begins the 20ms mix clock
+func (m *MixingMediaBridge) Start() error {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(rtpFrameDuration)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.mixFrame()
+
+			case <-m.stopChan:
+				return
+			}
+		}
+	}()
+
+	slog.Info("Mixing bridge started",
+		"event", "media_bridge_started",
+		"mode", BridgeModeMix)
+	return nil
+}
+
+// mixFrame takes one frame from every input and queues each listener its mix
+func (m *MixingMediaBridge) mixFrame() {
+	m.mu.Lock()
+	timestamp := time.Duration(m.ticks) * rtpFrameDuration
+	m.ticks++
+	frames := make(map[mixInputKey][]int16, len(m.inputs))
+	for key, input := range m.inputs {
+		if frame := m.takeFrame(input); frame != nil {
+			frames[key] = frame
+		}
+	}
+	queuesSnapshot := make(map[string]*participantQueue, len(m.queues))
+	for id, queue := range m.queues {
+		queuesSnapshot[id] = queue
+	}
+	audiencesSnapshot := make(audiences, len(m.audiences))
+	for id, allowed := range m.audiences {
+		audiencesSnapshot[id] = allowed
+	}
+	m.mu.Unlock()
+
+	if len(frames) == 0 {
+		return
+	}
+
+	frameSamples := m.frameBytes / 2
+	sum := make([]int32, frameSamples)
+
+	for id, queue := range queuesSnapshot {
+		if queue.passive || queue.participant.Writer() == nil {
+			continue
+		}
+
+		// N-1: everyone's audio except the listener's own
+		for i := range sum {
+			sum[i] = 0
+		}
+		contributors := 0
+		for key, frame := range frames {
+			if key.sender == id {
+				continue
+			}
+			if key.recipient != "" && key.recipient != id {
+				continue
+			}
+			if !audiencesSnapshot.allows(key.sender, id) {
+				continue
+			}
+			for i, sample := range frame {
+				sum[i] += int32(sample)
+			}
+			contributors++
+		}
+		if contributors == 0 {
+			continue
+		}
+
+		// Never blocks: a slow listener only falls behind in its own queue
+		queue.enqueue(&MediaChunk{
+			Data:      m.limit(id, sum),
+			Format:    m.format,
+			Timestamp: timestamp,
+		})
+	}
+}
+
+// takeFrame removes one frame from an input. A short remainder is held back
+// briefly in case the rest is on its way, then mixed padded with silence.
+// Caller must hold the lock.
+func (m *MixingMediaBridge) takeFrame(input *mixInput) []int16 {
+	if len(input.buffer) == 0 {
+		return nil
+	}
+	if len(input.buffer) < m.frameBytes {
+		input.partialTicks++
+		if input.partialTicks < mixPartialTicks {
+			return nil
+		}
+	}
+	input.partialTicks = 0
+
+	frame := make([]int16, m.frameBytes/2)
+	n := len(input.buffer)
+	if n > m.frameBytes {
+		n = m.frameBytes
+	}
+	for i := 0; i+1 < n; i += 2 {
+		frame[i/2] = int16(binary.LittleEndian.Uint16(input.buffer[i:]))
+	}
+	input.buffer = input.buffer[n:]
+	if len(input.buffer) == 0 {
+		// Release the backing array once a burst has been played out
+		input.buffer = nil
+	}
+	return frame
+}
+
+// limit converts a sum to PCM, applying the listener's limiter: the gain drops
+// instantly when the sum would exceed the ceiling and recovers smoothly
+func (m *MixingMediaBridge) limit(listenerID string, sum []int32) []byte {
+	m.mu.Lock()
+	gain, ok := m.limiterGains[listenerID]
+	m.mu.Unlock()
+	if !ok {
+		gain = 1
+	}
+
+	var peak int32
+	for _, v := range sum {
+		if v < 0 {
+			v = -v
+		}
+		if v > peak {
+			peak = v
+		}
+	}
+
+	startGain := gain
+	endGain := gain + (1-gain)*mixLimiterRelease
+	if peak > 0 {
+		if required := mixCeiling * math.MaxInt16 / float64(peak); required < endGain {
+			// Attack: hold the reduced gain for the whole frame
+			startGain = math.Min(required, gain)
+			endGain = startGain
+		}
+	}
+
+	out := make([]byte, len(sum)*2)
+	step := (endGain - startGain) / float64(len(sum))
+	g := startGain
+	for i, v := range sum {
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(clampSample(float64(v)*g)))
+		g += step
+	}
+
+	m.mu.Lock()
+	if _, exists := m.limiterGains[listenerID]; exists {
+		m.limiterGains[listenerID] = endGain
+	}
+	m.mu.Unlock()
+
+	return out
+}
+
+// Stop closes the bridge
+func (m *MixingMediaBridge) Stop() error {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return nil
+	}
+	m.stopped = true
+	close(m.stopChan)
+	for id := range m.queues {
+		m.removeLocked(id, BridgeEventParticipantLeft, "bridge_stopped")
+	}
+	m.inputs = make(map[mixInputKey]*mixInput)
+	m.mu.Unlock()
+
+	m.wg.Wait()
+	m.converter.Reset()
+
+	slog.Info("Mixing bridge stopped",
+		"event", "media_bridge_stopped")
+	m.events.close()
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// frameWriter passes every write of a participant to a channel
+type frameWriter chan []int16
+
+func (w frameWriter) Write(p []byte) (int, error) {
+	w <- pcmToSamples(p)
+	return len(p), nil
+}
+
+// newTestMixer returns an unstarted mixing bridge with a listening participant
+// for each id, so tests can drive the mix clock with mixFrame
+func newTestMixer(t *testing.T, ids ...string) (*MixingMediaBridge, map[string]frameWriter) {
+	t.Helper()
+	mixer := NewMixingMediaBridge(8000, BridgeConfig{})
+	t.Cleanup(func() { mixer.Stop() })
+
+	writers := make(map[string]frameWriter)
+	for _, id := range ids {
+		writers[id] = make(frameWriter, 16)
+		if err := mixer.AddParticipant(NewParticipant(id, writers[id])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mixer, writers
+}
+
+// sendLevel broadcasts samples of a constant level from sender
+func sendLevel(t *testing.T, mixer *MixingMediaBridge, sender string, level int16, samples int) {
+	t.Helper()
+	pcmData := make([]byte, samples*2)
+	levels := make([]int16, samples)
+	for i := range levels {
+		levels[i] = level
+	}
+	samplesToPCM(levels, pcmData)
+	if err := mixer.Broadcast(&MediaChunk{Data: pcmData, SenderID: sender, Format: PCM16Format(8000)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiveFrame returns the next mix written to a listener
+func receiveFrame(t *testing.T, writer frameWriter) []int16 {
+	t.Helper()
+	select {
+	case frame := <-writer:
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("no mix received")
+		return nil
+	}
+}
+
+func TestMixingBridgeSendsEachListenerTheOthers(t *testing.T) {
+	mixer, writers := newTestMixer(t, "a", "b", "c")
+	levels := map[string]int16{"a": 1000, "b": 2000, "c": 4000}
+	for id, level := range levels {
+		sendLevel(t, mixer, id, level, rtpSamplesPerFrame)
+	}
+	mixer.mixFrame()
+
+	for id, writer := range writers {
+		want := 1000 + 2000 + 4000 - levels[id]
+		frame := receiveFrame(t, writer)
+		if len(frame) != rtpSamplesPerFrame {
+			t.Fatalf("%s: mix of %d samples, want %d", id, len(frame), rtpSamplesPerFrame)
+		}
+		for i, sample := range frame {
+			if sample != want {
+				t.Fatalf("%s: sample %d is %d, want %d (the other two, without its own audio)", id, i, sample, want)
+			}
+		}
+	}
+}
+
+func TestMixingBridgeLimitsLoudSums(t *testing.T) {
+	mixer, writers := newTestMixer(t, "a", "b", "c")
+
+	// Each listener's mix sums to almost twice full scale
+	for tick := 0; tick < 3; tick++ {
+		for _, id := range []string{"a", "b", "c"} {
+			sendLevel(t, mixer, id, 30000, rtpSamplesPerFrame)
+		}
+		mixer.mixFrame()
+
+		ceiling := mixCeiling * math.MaxInt16
+		for id, writer := range writers {
+			for i, sample := range receiveFrame(t, writer) {
+				if sample <= 0 {
+					t.Fatalf("tick %d, %s: sample %d wrapped to %d", tick, id, i, sample)
+				}
+				if float64(sample) > math.Round(ceiling) {
+					t.Fatalf("tick %d, %s: sample %d is %d, above the ceiling %.0f", tick, id, i, sample, ceiling)
+				}
+			}
+		}
+	}
+}
+
+func TestMixingBridgePadsPartialTail(t *testing.T) {
+	mixer, writers := newTestMixer(t, "a", "b")
+
+	// Half a frame: held back for mixPartialTicks in case the rest follows
+	sendLevel(t, mixer, "a", 1000, rtpSamplesPerFrame/2)
+	for tick := 1; tick < mixPartialTicks; tick++ {
+		mixer.mixFrame()
+	}
+	select {
+	case frame := <-writers["b"]:
+		t.Fatalf("partial frame mixed after %d ticks: %v", mixPartialTicks-1, frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mixer.mixFrame()
+	frame := receiveFrame(t, writers["b"])
+	for i, sample := range frame {
+		want := int16(0)
+		if i < rtpSamplesPerFrame/2 {
+			want = 1000
+		}
+		if sample != want {
+			t.Fatalf("sample %d of the padded tail is %d, want %d", i, sample, want)
+		}
+	}
+	if len(frame) != rtpSamplesPerFrame {
+		t.Fatalf("padded tail of %d samples, want %d", len(frame), rtpSamplesPerFrame)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// promptLeadFrames is how many frames a prompt is kept ahead of the media
+	// clock so that timer jitter between the two clocks never starves the sender
+	promptLeadFrames = 3
+	// maxPromptBytes bounds the size of a prompt file
+	maxPromptBytes = 50 * 1024 * 1024
+)
+
+// WAV format codes supported for prompts
+const (
+	wavFormatPCM        = 1
+	wavFormatALaw       = 6
+	wavFormatULaw       = 7
+	wavFormatExtensible = 0xFFFE
+)
+
+// PromptPlayer is a send-only participant that streams pre-recorded audio
+// (greetings, disclosures, hold messages) into the bridge. Its audio is
+// addressed to a single participant, normally the caller's SIP leg, so the
+// AI never hears it.
+type PromptPlayer struct {
+	id         string
+	bridge     MediaBridge
+	targetID   string
+	sampleRate int
+	playback   *promptPlayback
+	mu         sync.Mutex
+}
+
+// promptPlayback is one prompt being played
+type promptPlayback struct {
+	source string
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewPromptPlayer creates a prompt player that plays into targetID at sampleRate
+func NewPromptPlayer(id string, bridge MediaBridge, targetID string, sampleRate int) *PromptPlayer {
+	return &PromptPlayer{
+		id:         id,
+		bridge:     bridge,
+		targetID:   targetID,
+		sampleRate: sampleRate,
+	}
+}
+
+// ID returns the participant's unique identifier
+func (p *PromptPlayer) ID() string {
+	return p.id
+}
+
+// Writer returns nil: the prompt player only sends audio
+func (p *PromptPlayer) Writer() io.Writer {
+	return nil
+}
+
+// Play loads a WAV file (local path or http(s) URL) and starts streaming it,
+// replacing any prompt that is already playing. With loop set the prompt
+// repeats until Stop is called. With interrupt set, audio already queued on a
+// forwarding bridge is flushed so the prompt starts at once; this cuts off the
+// AI mid-sentence and flushes every participant, not only the target.
+// Otherwise the prompt plays after audio already queued for the target. The
+// returned channel is closed when playback finishes or is stopped.
+func (p *PromptPlayer) Play(source string, loop, interrupt bool) (<-chan struct{}, error) {
+	pcmData, err := loadAudio(source, p.sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	if len(pcmData) == 0 {
+		return nil, fmt.Errorf("prompt %s contains no audio", source)
+	}
+
+	playback := &promptPlayback{
+		source: source,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	p.mu.Lock()
+	previous := p.playback
+	p.playback = playback
+	p.mu.Unlock()
+
+	if previous != nil {
+		previous.halt()
+	}
+
+	// A forwarding bridge queues the prompt behind whatever the caller is
+	// already due to hear; a mixing bridge mixes it in regardless
+	if _, mixing := p.bridge.(*MixingMediaBridge); interrupt && !mixing {
+		p.bridge.FlushQueues()
+	}
+
+	go p.stream(playback, pcmData, loop)
+
+	return playback.done, nil
+}
+
+// Stop ends the current prompt, if any
+func (p *PromptPlayer) Stop() {
+	p.mu.Lock()
+	playback := p.playback
+	p.playback = nil
+	p.mu.Unlock()
+
+	if playback != nil {
+		playback.halt()
+	}
+}
+
+// IsPlaying reports whether a prompt is currently playing
+func (p *PromptPlayer) IsPlaying() bool {
+	p.mu.Lock()
+	playback := p.playback
+	p.mu.Unlock()
+
+	if playback == nil {
+		return false
+	}
+	select {
+	case <-playback.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// halt stops a playback and waits for its goroutine to exit
+func (pb *promptPlayback) halt() {
+	select {
+	case <-pb.stop:
+	default:
+		close(pb.stop)
+	}
+	<-pb.done
+}
+
+// stream sends the prompt one 20ms frame at a time, paced by its own clock
+// and kept a few frames ahead of the session's media clock
+func (p *PromptPlayer) stream(playback *promptPlayback, pcmData []byte, loop bool) {
+	defer close(playback.done)
+
+	frameBytes := p.sampleRate / 1000 * int(rtpFrameDuration/time.Millisecond) * 2
+
+	slog.Info("Playing prompt",
+		"event", "prompt_play_start",
+		"participant", p.id,
+		"source", playback.source,
+		"duration_ms", len(pcmData)*1000/(p.sampleRate*2),
+		"loop", loop)
+
+	ticker := time.NewTicker(rtpFrameDuration)
+	defer ticker.Stop()
+
+	offset := 0
+	sent := 0
+	for {
+		if offset >= len(pcmData) {
+			if !loop {
+				break
+			}
+			offset = 0
+		}
+
+		end := offset + frameBytes
+		if end > len(pcmData) {
+			end = len(pcmData)
+		}
+		frame := pcmData[offset:end]
+		offset = end
+
+		err := p.bridge.Broadcast(&MediaChunk{
+			Data:        frame,
+			SenderID:    p.id,
+			RecipientID: p.targetID,
+			Format:      PCM16Format(p.sampleRate),
+			Timestamp:   time.Duration(sent) * rtpFrameDuration,
+		})
+		if err != nil {
+			slog.Info("Prompt stopped, bridge closed",
+				"event", "prompt_play_closed",
+				"participant", p.id,
+				"source", playback.source)
+			return
+		}
+		sent++
+
+		if sent <= promptLeadFrames {
+			continue
+		}
+
+		select {
+		case <-ticker.C:
+		case <-playback.stop:
+			slog.Info("Prompt stopped",
+				"event", "prompt_play_stopped",
+				"participant", p.id,
+				"source", playback.source)
+			return
+		}
+	}
+
+	slog.Info("Prompt finished",
+		"event", "prompt_play_finished",
+		"participant", p.id,
+		"source", playback.source)
+}
+
+// loadAudio reads a WAV file from a local path or http(s) URL and returns it
+// as 16-bit mono PCM at sampleRate
+func loadAudio(source string, sampleRate int) ([]byte, error) {
+	data, err := readAudioSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	samples, rate, err := decodeWAV(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", source, err)
+	}
+
+	pcmData := make([]byte, len(samples)*2)
+	samplesToPCM(samples, pcmData)
+
+	if rate == sampleRate {
+		return pcmData, nil
+	}
+
+	resampler, err := NewStreamResampler(float64(rate), float64(sampleRate))
+	if err != nil {
+		return nil, err
+	}
+	defer resampler.Close()
+
+	// Trailing silence pushes the last samples out through the filter delay
+	pcmData = append(pcmData, make([]byte, rate/50*2)...)
+	return resampler.Process(pcmData)
+}
+
+// readAudioSource reads the raw bytes of a local file or http(s) URL
+func readAudioSource(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", source, err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch %s: status %d", source, resp.StatusCode)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, maxPromptBytes))
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, maxPromptBytes))
+}
+
+// decodeWAV decodes 8/16-bit PCM and G.711 WAV data to mono samples,
+// averaging channels, and returns the samples with their sample rate
+func decodeWAV(data []byte) ([]int16, int, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, 0, fmt.Errorf("not a WAV file")
+	}
+
+	var format, channels, bitsPerSample int
+	var sampleRate int
+	var audio []byte
+	haveFormat := false
+
+	// Walk the chunks; "fmt " must come before "data"
+	for pos := 12; pos+8 <= len(data); {
+		chunkID := string(data[pos : pos+4])
+		chunkSize := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		body := data[pos+8:]
+		if chunkSize > len(body) {
+			// Streams written without a final size report 0 or oversize lengths
+			chunkSize = len(body)
+		}
+		body = body[:chunkSize]
+
+		switch chunkID {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, 0, fmt.Errorf("fmt chunk too short")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:2]))
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			sampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bitsPerSample = int(binary.LittleEndian.Uint16(body[14:16]))
+			if format == wavFormatExtensible && len(body) >= 26 {
+				// The real format is the first two bytes of the subformat GUID
+				format = int(binary.LittleEndian.Uint16(body[24:26]))
+			}
+			haveFormat = true
+		case "data":
+			audio = body
+		}
+
+		if audio != nil {
+			break
+		}
+		pos += 8 + chunkSize + chunkSize%2
+	}
+
+	if !haveFormat {
+		return nil, 0, fmt.Errorf("missing fmt chunk")
+	}
+	if audio == nil {
+		return nil, 0, fmt.Errorf("missing data chunk")
+	}
+	if channels < 1 || sampleRate <= 0 {
+		return nil, 0, fmt.Errorf("invalid format: %d channels at %dHz", channels, sampleRate)
+	}
+
+	// Decode to interleaved 16-bit samples
+	var interleaved []int16
+	switch {
+	case format == wavFormatPCM && bitsPerSample == 16:
+		interleaved = pcmToSamples(audio[:len(audio)/2*2])
+	case format == wavFormatPCM && bitsPerSample == 8:
+		interleaved = make([]int16, len(audio))
+		for i, b := range audio {
+			interleaved[i] = int16(int(b)-128) << 8
+		}
+	case format == wavFormatULaw && bitsPerSample == 8:
+		interleaved = pcmToSamples(decodeG711(audio, "PCMU"))
+	case format == wavFormatALaw && bitsPerSample == 8:
+		interleaved = pcmToSamples(decodeG711(audio, "PCMA"))
+	default:
+		return nil, 0, fmt.Errorf("unsupported WAV format %d with %d bits per sample", format, bitsPerSample)
+	}
+
+	if channels == 1 {
+		return interleaved, sampleRate, nil
+	}
+
+	// Downmix to mono
+	frames := len(interleaved) / channels
+	mono := make([]int16, frames)
+	for i := 0; i < frames; i++ {
+		sum := 0
+		for c := 0; c < channels; c++ {
+			sum += int(interleaved[i*channels+c])
+		}
+		mono[i] = int16(sum / channels)
+	}
+	return mono, sampleRate, nil
+}
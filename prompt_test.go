@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// flushCountingBridge is a forwarding bridge that counts FlushQueues calls
+// and discards what is broadcast
+type flushCountingBridge struct {
+	MediaBridge
+	flushes atomic.Int32
+}
+
+func (b *flushCountingBridge) Broadcast(chunk *MediaChunk) error { return nil }
+
+func (b *flushCountingBridge) FlushQueues() error {
+	b.flushes.Add(1)
+	return nil
+}
+
+func TestPromptPlayerOnlyFlushesWhenInterrupting(t *testing.T) {
+	// A 100ms stereo recording, which loadAudio mixes down to mono
+	source := filepath.Join(t.TempDir(), "hold.wav")
+	audio := append(wavHeader(3200), make([]byte, 3200)...)
+	if err := os.WriteFile(source, audio, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	bridge := &flushCountingBridge{}
+	player := NewPromptPlayer("prompt", bridge, "sip", 8000)
+	defer player.Stop()
+
+	if _, err := player.Play(source, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if flushes := bridge.flushes.Load(); flushes != 0 {
+		t.Fatalf("prompt without interrupt flushed the bridge %d times", flushes)
+	}
+
+	if _, err := player.Play(source, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if flushes := bridge.flushes.Load(); flushes != 1 {
+		t.Fatalf("interrupting prompt flushed the bridge %d times, want 1", flushes)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// recordingSampleRate is the sample rate of recordings (the SIP leg rate)
+	recordingSampleRate = 8000
+	// wavHeaderSize is the size of the canonical 44-byte PCM WAV header
+	wavHeaderSize = 44
+	// maxCallerBacklog bounds how far caller audio may run ahead of the media
+	// clock (60ms) before the oldest samples are dropped to stay aligned
+	maxCallerBacklog = 3 * rtpSamplesPerFrame
+)
+
+// RecordingMetadata is written as a JSON sidecar next to each recording
+type RecordingMetadata struct {
+	CallID          string    `json:"call_id"`
+	From            string    `json:"from"`
+	To              string    `json:"to"`
+	StartTime       time.Time `json:"start_time"`
+	EndTime         time.Time `json:"end_time"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Codec           string    `json:"codec"`
+	SampleRate      int       `json:"sample_rate"`
+	Channels        []string  `json:"channels"`
+	AudioFile       string    `json:"audio_file"`
+}
+
+// CallRecorder writes a stereo WAV file with the caller on the left channel
+// and the AI on the right. Both channels advance on the session's 20ms media
+// clock: each tick writes the frame that was sent to the caller together with
+// the caller audio received since the previous tick, so the channels stay
+// time-aligned regardless of how bursty the AI output is.
+type CallRecorder struct {
+	session     *Session
+	storage     Storage
+	audioKey    string
+	metadataKey string
+	upload      Upload
+	writer      *bufio.Writer
+	callerFIFO  []int16
+	frame       []byte
+	dataBytes   uint32
+	startTime   time.Time
+	closed      bool
+	mu          sync.Mutex
+}
+
+// unsafeFileChars matches characters not allowed in recording file names
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// NewCallRecorder starts streaming a session's recording to storage under key
+// (without extension); the audio and metadata are stored as key.wav and key.json
+func NewCallRecorder(session *Session, storage Storage, key string) (*CallRecorder, error) {
+	audioKey := key + ".wav"
+
+	upload, err := storage.NewUpload(audioKey, "audio/wav")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	r := &CallRecorder{
+		session:     session,
+		storage:     storage,
+		audioKey:    audioKey,
+		metadataKey: key + ".json",
+		upload:      upload,
+		writer:      bufio.NewWriterSize(upload, 64*1024),
+		frame:       make([]byte, rtpSamplesPerFrame*4),
+		startTime:   time.Now(),
+	}
+
+	// Sizes are patched in when the recording is closed
+	if _, err := r.writer.Write(wavHeader(0)); err != nil {
+		upload.Close()
+		return nil, fmt.Errorf("failed to write WAV header: %w", err)
+	}
+
+	slog.Info("Call recording started",
+		"event", "recording_started",
+		"session", session.CallID,
+		"key", audioKey)
+
+	return r, nil
+}
+
+// WriteCaller buffers caller audio until the next media clock tick
+func (r *CallRecorder) WriteCaller(pcmData []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	r.callerFIFO = append(r.callerFIFO, pcmToSamples(pcmData)...)
+
+	// Keep the caller channel from drifting ahead when packets arrive in bursts
+	if excess := len(r.callerFIFO) - maxCallerBacklog; excess > 0 {
+		r.callerFIFO = r.callerFIFO[excess:]
+	}
+}
+
+// WriteFrame is called on every media clock tick with the 20ms frame sent to
+// the caller. It writes one stereo frame pairing it with buffered caller audio.
+func (r *CallRecorder) WriteFrame(aiFrame []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	for i := 0; i < rtpSamplesPerFrame; i++ {
+		var caller int16
+		if i < len(r.callerFIFO) {
+			caller = r.callerFIFO[i]
+		}
+		var ai uint16
+		if 2*i+1 < len(aiFrame) {
+			ai = binary.LittleEndian.Uint16(aiFrame[2*i:])
+		}
+		binary.LittleEndian.PutUint16(r.frame[4*i:], uint16(caller))
+		binary.LittleEndian.PutUint16(r.frame[4*i+2:], ai)
+	}
+
+	consumed := rtpSamplesPerFrame
+	if consumed > len(r.callerFIFO) {
+		consumed = len(r.callerFIFO)
+	}
+	r.callerFIFO = r.callerFIFO[consumed:]
+
+	if _, err := r.writer.Write(r.frame); err != nil {
+		slog.Error("Failed to write recording frame",
+			"event", "recording_write_error",
+			"session", r.session.CallID,
+			"error", err.Error())
+		return
+	}
+	r.dataBytes += uint32(len(r.frame))
+}
+
+// Close finalizes the WAV header and writes the metadata sidecar
+func (r *CallRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	if err := r.writer.Flush(); err != nil {
+		r.upload.Close()
+		return fmt.Errorf("failed to flush recording: %w", err)
+	}
+	if _, err := r.upload.WriteAt(wavHeader(r.dataBytes), 0); err != nil {
+		r.upload.Close()
+		return fmt.Errorf("failed to finalize WAV header: %w", err)
+	}
+	if err := r.upload.Close(); err != nil {
+		return fmt.Errorf("failed to store recording: %w", err)
+	}
+
+	endTime := time.Now()
+	metadata := RecordingMetadata{
+		CallID:          r.session.CallID,
+		From:            r.session.From,
+		To:              r.session.To,
+		StartTime:       r.startTime,
+		EndTime:         endTime,
+		DurationSeconds: float64(r.dataBytes) / 4 / recordingSampleRate,
+		Codec:           r.session.selectedCodec,
+		SampleRate:      recordingSampleRate,
+		Channels:        []string{"caller", "ai"},
+		AudioFile:       path.Base(r.audioKey),
+	}
+	metadataJSON, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal recording metadata: %w", err)
+	}
+	if err := r.storage.Put(r.metadataKey, "application/json", metadataJSON); err != nil {
+		return fmt.Errorf("failed to store recording metadata: %w", err)
+	}
+
+	slog.Info("Call recording finished",
+		"event", "recording_finished",
+		"session", r.session.CallID,
+		"key", r.audioKey,
+		"duration_seconds", metadata.DurationSeconds)
+
+	return nil
+}
+
+// wavHeader builds a 16-bit stereo PCM WAV header for dataBytes of audio
+func wavHeader(dataBytes uint32) []byte {
+	const channels = 2
+	const bitsPerSample = 16
+	byteRate := recordingSampleRate * channels * bitsPerSample / 8
+
+	header := make([]byte, wavHeaderSize)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], 36+dataBytes)
+	copy(header[8:12], "WAVE")
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16) // fmt chunk size
+	binary.LittleEndian.PutUint16(header[20:22], 1)  // PCM
+	binary.LittleEndian.PutUint16(header[22:24], channels)
+	binary.LittleEndian.PutUint32(header[24:28], recordingSampleRate)
+	binary.LittleEndian.PutUint32(header[28:32], uint32(byteRate))
+	binary.LittleEndian.PutUint16(header[32:34], channels*bitsPerSample/8)
+	binary.LittleEndian.PutUint16(header[34:36], bitsPerSample)
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], dataBytes)
+	return header
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// constantFrame returns one 20ms frame of PCM with every sample set to value
+func constantFrame(value int16) []byte {
+	samples := make([]int16, rtpSamplesPerFrame)
+	for i := range samples {
+		samples[i] = value
+	}
+	pcmData := make([]byte, rtpFrameBytes)
+	samplesToPCM(samples, pcmData)
+	return pcmData
+}
+
+func TestCallRecorderWritesAlignedStereo(t *testing.T) {
+	dir := t.TempDir()
+	session := &Session{CallID: "call-1", From: "alice", To: "bob", selectedCodec: "PCMU"}
+	recorder, err := NewCallRecorder(session, NewLocalStorage(dir), "calls/call-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each tick pairs the caller audio received since the last one with the
+	// AI frame sent; want holds the expected caller/AI level of each frame
+	var want [][2]int16
+	recorder.WriteCaller(constantFrame(1))
+	recorder.WriteFrame(constantFrame(100))
+	want = append(want, [2]int16{1, 100})
+
+	// No caller audio this tick: the left channel is silent, not shifted
+	recorder.WriteFrame(constantFrame(200))
+	want = append(want, [2]int16{0, 200})
+
+	// A burst of five frames overflows the 60ms backlog; the oldest two go
+	for value := int16(10); value < 15; value++ {
+		recorder.WriteCaller(constantFrame(value))
+	}
+	for value := int16(12); value < 15; value++ {
+		recorder.WriteFrame(constantFrame(value * 10))
+		want = append(want, [2]int16{value, value * 10})
+	}
+	recorder.WriteFrame(nil)
+	want = append(want, [2]int16{0, 0})
+
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes after Close are ignored
+	recorder.WriteCaller(constantFrame(7))
+	recorder.WriteFrame(constantFrame(7))
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+
+	wav, err := os.ReadFile(filepath.Join(dir, "calls", "call-1.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataBytes := len(want) * rtpSamplesPerFrame * 4
+	if len(wav) != wavHeaderSize+dataBytes {
+		t.Fatalf("recording of %d bytes, want %d", len(wav), wavHeaderSize+dataBytes)
+	}
+	if riff := binary.LittleEndian.Uint32(wav[4:8]); riff != uint32(36+dataBytes) {
+		t.Fatalf("RIFF size %d, want %d", riff, 36+dataBytes)
+	}
+	if data := binary.LittleEndian.Uint32(wav[40:44]); data != uint32(dataBytes) {
+		t.Fatalf("data size %d, want %d", data, dataBytes)
+	}
+
+	samples := pcmToSamples(wav[wavHeaderSize:])
+	for frame, levels := range want {
+		for i := 0; i < rtpSamplesPerFrame; i++ {
+			left, right := samples[2*(frame*rtpSamplesPerFrame+i)], samples[2*(frame*rtpSamplesPerFrame+i)+1]
+			if left != levels[0] || right != levels[1] {
+				t.Fatalf("frame %d sample %d is %d/%d, want caller %d, AI %d", frame, i, left, right, levels[0], levels[1])
+			}
+		}
+	}
+
+	metadataJSON, err := os.ReadFile(filepath.Join(dir, "calls", "call-1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata RecordingMetadata
+	if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.AudioFile != "call-1.wav" || metadata.DurationSeconds != 0.12 || metadata.Channels[0] != "caller" {
+		t.Fatalf("metadata %+v", metadata)
+	}
+}
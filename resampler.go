@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/zaf/resample"
+)
+
+// StreamResampler converts a continuous stream of 16-bit mono PCM between two
+// sample rates. It keeps a single soxr resampler alive for the lifetime of the
+// stream so that filter state is carried across packets, avoiding both the
+// per-packet setup cost and the edge artifacts at every packet boundary.
+type StreamResampler struct {
+	inRate    float64
+	outRate   float64
+	resampler *resample.Resampler
+	output    bytes.Buffer
+	pending   []byte // input bytes not yet consumed (odd byte or too few frames)
+	mu        sync.Mutex
+}
+
+// NewStreamResampler creates a long-lived resampler from inRate to outRate
+func NewStreamResampler(inRate, outRate float64) (*StreamResampler, error) {
+	r := &StreamResampler{
+		inRate:  inRate,
+		outRate: outRate,
+	}
+
+	resampler, err := resample.New(&r.output, inRate, outRate, 1, resample.I16, resample.HighQ)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %.0fHz->%.0fHz resampler: %w", inRate, outRate, err)
+	}
+	r.resampler = resampler
+
+	return r, nil
+}
+
+// Process pushes PCM data through the resampler and returns whatever output
+// is available so far. The returned slice is owned by the caller.
+func (r *StreamResampler) Process(pcmData []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.resampler == nil {
+		return nil, fmt.Errorf("resampler is closed")
+	}
+
+	input := pcmData
+	if len(r.pending) > 0 {
+		input = append(r.pending, pcmData...)
+		r.pending = nil
+	}
+
+	// soxr rejects writes that would not produce at least one output frame,
+	// so hold back incomplete frames and tiny tails until the next call
+	frames := len(input) / 2
+	if int(float64(frames)*(r.outRate/r.inRate)) == 0 {
+		r.pending = append([]byte(nil), input...)
+		return nil, nil
+	}
+	usable := frames * 2
+	if usable < len(input) {
+		r.pending = append([]byte(nil), input[usable:]...)
+	}
+
+	if _, err := r.resampler.Write(input[:usable]); err != nil {
+		return nil, err
+	}
+
+	return r.drain(), nil
+}
+
+// Reset discards buffered input and output and clears the filter state, e.g.
+// when queued audio is dropped on interruption and the next chunk is unrelated
+func (r *StreamResampler) Reset() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.resampler == nil {
+		return fmt.Errorf("resampler is closed")
+	}
+
+	err := r.resampler.Reset(&r.output)
+	r.output.Reset()
+	r.pending = nil
+	return err
+}
+
+// Close releases the underlying soxr resampler
+func (r *StreamResampler) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.resampler == nil {
+		return nil
+	}
+
+	err := r.resampler.Close()
+	r.resampler = nil
+	r.output.Reset()
+	r.pending = nil
+	return err
+}
+
+// drain copies the accumulated output out of the internal buffer
+func (r *StreamResampler) drain() []byte {
+	if r.output.Len() == 0 {
+		return nil
+	}
+	out := make([]byte, r.output.Len())
+	copy(out, r.output.Bytes())
+	r.output.Reset()
+	return out
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/zaf/resample"
+)
+
+// toneAt returns duration seconds of a 440Hz tone at sampleRate as PCM
+func toneAt(sampleRate int, seconds float64) []byte {
+	samples := make([]int16, int(float64(sampleRate)*seconds))
+	for i := range samples {
+		samples[i] = int16(10000 * math.Sin(2*math.Pi*440*float64(i)/float64(sampleRate)))
+	}
+	pcmData := make([]byte, len(samples)*2)
+	samplesToPCM(samples, pcmData)
+	return pcmData
+}
+
+// TestStreamResamplerChunkedMatchesOneShot checks that filter state carries
+// across packets: resampling 20ms packets must give the same audio as
+// resampling the whole stream at once, without clicks at packet boundaries.
+func TestStreamResamplerChunkedMatchesOneShot(t *testing.T) {
+	for _, rates := range [][2]int{{8000, 16000}, {24000, 8000}, {16000, 8000}} {
+		inRate, outRate := rates[0], rates[1]
+		input := toneAt(inRate, 1)
+
+		oneShot, err := NewStreamResampler(float64(inRate), float64(outRate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer oneShot.Close()
+		want, err := oneShot.Process(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chunked, err := NewStreamResampler(float64(inRate), float64(outRate))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer chunked.Close()
+		var got []byte
+		// 20ms packets, plus an odd-sized one to exercise held-back bytes
+		packet := inRate / 50 * 2
+		for offset := 0; offset < len(input); {
+			size := packet
+			if offset == packet {
+				size = packet + 1
+			}
+			end := min(offset+size, len(input))
+			out, err := chunked.Process(input[offset:end])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, out...)
+			offset = end
+		}
+
+		// The streams may differ by a few samples still inside the filter
+		wantSamples, gotSamples := pcmToSamples(want), pcmToSamples(got)
+		if diff := len(wantSamples) - len(gotSamples); diff < -outRate/100 || diff > outRate/100 {
+			t.Fatalf("%d->%d: chunked output has %d samples, one-shot %d", inRate, outRate, len(gotSamples), len(wantSamples))
+		}
+		n := min(len(wantSamples), len(gotSamples))
+		for i := 0; i < n; i++ {
+			if d := int(wantSamples[i]) - int(gotSamples[i]); d < -2 || d > 2 {
+				t.Fatalf("%d->%d: sample %d is %d chunked, %d one-shot", inRate, outRate, i, gotSamples[i], wantSamples[i])
+			}
+		}
+	}
+}
+
+// callPackets are the 20ms packets a call resamples: the caller's audio up to
+// the AI's input rate and the AI's audio down to the telephony rate
+var callPackets = []struct {
+	inRate, outRate int
+}{
+	{8000, 16000},
+	{24000, 8000},
+}
+
+// benchmarkCallResampling resamples one 20ms packet in each direction per
+// iteration and reports the share of a CPU core a call spends on it, so the
+// streaming and per-packet paths compare per concurrent call
+func benchmarkCallResampling(b *testing.B, newConverter func(inRate, outRate int) (convert func([]byte) error, release func())) {
+	converters := make([]func([]byte) error, len(callPackets))
+	packets := make([][]byte, len(callPackets))
+	for i, rates := range callPackets {
+		convert, release := newConverter(rates.inRate, rates.outRate)
+		defer release()
+		converters[i] = convert
+		packets[i] = toneAt(rates.inRate, 0.02)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i, convert := range converters {
+			if err := convert(packets[i]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+
+	perPacket := float64(b.Elapsed().Nanoseconds()) / float64(b.N)
+	b.ReportMetric(100*perPacket/float64(20*time.Millisecond), "%cpu/call")
+}
+
+// BenchmarkStreamResampler measures a call's resampling with one
+// StreamResampler per direction, kept for the whole call
+func BenchmarkStreamResampler(b *testing.B) {
+	benchmarkCallResampling(b, func(inRate, outRate int) (func([]byte) error, func()) {
+		resampler, err := NewStreamResampler(float64(inRate), float64(outRate))
+		if err != nil {
+			b.Fatal(err)
+		}
+		return func(packet []byte) error {
+			_, err := resampler.Process(packet)
+			return err
+		}, func() { resampler.Close() }
+	})
+}
+
+// BenchmarkPerPacketResampler measures the path StreamResampler replaced: a
+// resampler created, written and closed for every packet
+func BenchmarkPerPacketResampler(b *testing.B) {
+	benchmarkCallResampling(b, func(inRate, outRate int) (func([]byte) error, func()) {
+		return func(packet []byte) error {
+			var outputBuf bytes.Buffer
+			resampler, err := resample.New(&outputBuf, float64(inRate), float64(outRate), 1, resample.I16, resample.HighQ)
+			if err != nil {
+				return err
+			}
+			if _, err := resampler.Write(packet); err != nil {
+				return err
+			}
+			return resampler.Close()
+		}, func() {}
+	})
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/pion/rtp"
 	"github.com/zaf/g711"
@@ -55,25 +58,278 @@ func encodeG711(pcmData []byte, codec string) []byte {
 }
 
 // extractRTPPayload extracts the payload and header info from an RTP packet using pion/rtp
-func extractRTPPayload(rtpPacket []byte) (payloadType byte, payload []byte, sequenceNumber uint16, timestamp uint32, err error) {
+func extractRTPPayload(rtpPacket []byte) (payloadType byte, payload []byte, sequenceNumber uint16, timestamp uint32, ssrc uint32, err error) {
 	// Parse the RTP packet using pion/rtp
 	var packet rtp.Packet
 	if err := packet.Unmarshal(rtpPacket); err != nil {
-		return 0, nil, 0, 0, fmt.Errorf("failed to unmarshal RTP packet: %w", err)
+		return 0, nil, 0, 0, 0, fmt.Errorf("failed to unmarshal RTP packet: %w", err)
 	}
 
 	// Extract header information
 	payloadType = packet.PayloadType
 	sequenceNumber = packet.SequenceNumber
 	timestamp = packet.Timestamp
+	ssrc = packet.SSRC
 
 	// Get the payload
 	payload = packet.Payload
 
 	// If no payload, return nil without error (normal for some packets)
 	if len(payload) == 0 {
-		return payloadType, nil, sequenceNumber, timestamp, nil
+		return payloadType, nil, sequenceNumber, timestamp, ssrc, nil
 	}
 
-	return payloadType, payload, sequenceNumber, timestamp, nil
+	return payloadType, payload, sequenceNumber, timestamp, ssrc, nil
+}
+
+const (
+	// rtpLatchProbation is the number of consecutive in-sequence packets an
+	// unexpected source must send before we latch onto it
+	rtpLatchProbation = 5
+	// rtpRelatchIdle is how long the latched source must be silent before
+	// another port of its IP, or the SDP address, may take over (NAT rebinding)
+	rtpRelatchIdle = 500 * time.Millisecond
+	// rtpMaxDropout is the largest forward sequence jump treated as packet loss
+	rtpMaxDropout = 3000
+	// rtpMaxMisorder is the largest backward sequence jump treated as a late packet
+	rtpMaxMisorder = 100
+)
+
+// rtpSourceLatch decides which remote address RTP is accepted from and sent to.
+// Packets from the address advertised in the SDP (c= and m= lines) are accepted
+// immediately. Any other source has to prove itself with a run of consecutive
+// packets. Once a source is latched, only another port of its IP or of the SDP
+// address may take over (NAT rebinding), and only once the current source has
+// gone quiet. Sources on other IPs are never latched mid-call: quiet periods
+// are normal with DTX, VAD and hold, so a third party guessing our port could
+// otherwise take over the call's media, injecting audio and receiving the AI's.
+// A far end that moves its media to another IP announces it in a re-INVITE.
+type rtpSourceLatch struct {
+	strict          bool
+	expected        *net.UDPAddr // From the SDP offer, nil if unknown
+	latched         *net.UDPAddr
+	lastFromLatched time.Time
+	candidate       *net.UDPAddr
+	candidateSSRC   uint32
+	candidateSeq    uint16
+	candidateCount  int
+	mu              sync.Mutex
+}
+
+// newRTPSourceLatch creates a latch for the given SDP address. When strict is
+// false, the first source seen is latched and packets from anywhere are accepted.
+func newRTPSourceLatch(expected *net.UDPAddr, strict bool) *rtpSourceLatch {
+	return &rtpSourceLatch{
+		strict:   strict,
+		expected: expected,
+	}
+}
+
+// setExpected updates the SDP address, e.g. after a re-INVITE moved the media
+func (l *rtpSourceLatch) setExpected(expected *net.UDPAddr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expected = expected
+}
+
+// accept checks a packet's source. It returns whether the packet should be
+// processed and, if the latched address changed, the new address to send to.
+func (l *rtpSourceLatch) accept(addr *net.UDPAddr, ssrc uint32, seq uint16, now time.Time) (accepted bool, newLatch *net.UDPAddr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.latched != nil && udpAddrEqual(addr, l.latched) {
+		l.lastFromLatched = now
+		return true, nil
+	}
+
+	if !l.strict {
+		if l.latched == nil {
+			l.latch(addr, now)
+			return true, addr
+		}
+		return true, nil
+	}
+
+	// The SDP address is trusted as soon as the call starts
+	if l.latched == nil && l.expected != nil && udpAddrEqual(addr, l.expected) {
+		l.latch(addr, now)
+		return true, addr
+	}
+
+	// Track a run of consecutive packets from the unexpected source
+	if l.candidate != nil && udpAddrEqual(addr, l.candidate) && ssrc == l.candidateSSRC && seq == l.candidateSeq+1 {
+		l.candidateCount++
+	} else {
+		l.candidate = addr
+		l.candidateSSRC = ssrc
+		l.candidateCount = 1
+	}
+	l.candidateSeq = seq
+
+	if l.candidateCount < rtpLatchProbation {
+		return false, nil
+	}
+
+	// Nothing arrived from the SDP address (typically a far end behind NAT)
+	if l.latched == nil {
+		l.latch(addr, now)
+		return true, addr
+	}
+
+	// The latched source went quiet and its media moved to another port
+	// (NAT rebinding), or to the address of a re-INVITE
+	if l.trustedIP(addr) && now.Sub(l.lastFromLatched) > rtpRelatchIdle {
+		l.latch(addr, now)
+		return true, addr
+	}
+
+	return false, nil
+}
+
+// trustedIP reports whether addr is on the IP of the latched source or of the
+// SDP. Caller must hold the lock.
+func (l *rtpSourceLatch) trustedIP(addr *net.UDPAddr) bool {
+	return addr.IP.Equal(l.latched.IP) || (l.expected != nil && addr.IP.Equal(l.expected.IP))
+}
+
+// latch switches to a new source. Caller must hold the lock.
+func (l *rtpSourceLatch) latch(addr *net.UDPAddr, now time.Time) {
+	l.latched = addr
+	l.lastFromLatched = now
+	l.candidate = nil
+	l.candidateCount = 0
+}
+
+// udpAddrEqual compares two UDP addresses by IP and port
+func udpAddrEqual(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// rtpVerdict is the result of feeding a packet to rtpReceiveState
+type rtpVerdict int
+
+const (
+	rtpAccept    rtpVerdict = iota // In order, possibly after some loss
+	rtpDuplicate                   // Duplicate or arrived too late to play
+	rtpProbation                   // Unexpected sequence jump, waiting for confirmation
+	rtpRestarted                   // New SSRC or confirmed sequence reset, state restarted
+)
+
+// rtpReceiveState tracks the sequence and timing of an incoming RTP stream
+// following RFC 3550 appendix A.1 and A.8. A new SSRC or a confirmed sequence
+// discontinuity (e.g. after a carrier media switchover) restarts the state
+// instead of treating the new stream as massive loss or reordering.
+type rtpReceiveState struct {
+	initialized bool
+	ssrc        uint32
+	maxSeq      uint16
+	cycles      uint32
+	badSeq      uint32 // Expected next sequence after a jump, or > 0xFFFF if none
+	received    uint64
+	clockRate   float64
+	baseArrival time.Time
+	baseTime    uint32 // RTP timestamp at the start of the stream
+	lastTransit float64
+	jitter      float64 // Interarrival jitter in timestamp units
+}
+
+// newRTPReceiveState creates receive state for a stream with the given clock rate
+func newRTPReceiveState(clockRate int) *rtpReceiveState {
+	return &rtpReceiveState{
+		clockRate: float64(clockRate),
+		badSeq:    1 << 16,
+	}
+}
+
+// update feeds one packet header into the state and reports how to treat it
+func (r *rtpReceiveState) update(ssrc uint32, seq uint16, timestamp uint32, arrival time.Time) rtpVerdict {
+	if !r.initialized || ssrc != r.ssrc {
+		restarted := r.initialized
+		r.restart(ssrc, seq, timestamp, arrival)
+		if restarted {
+			return rtpRestarted
+		}
+		return rtpAccept
+	}
+
+	delta := seq - r.maxSeq
+	switch {
+	case delta == 0:
+		return rtpDuplicate
+
+	case delta < rtpMaxDropout:
+		// In order, with a permissible gap
+		if seq < r.maxSeq {
+			// Sequence number wrapped
+			r.cycles += 1 << 16
+		}
+		r.maxSeq = seq
+
+	case delta <= 1<<16-rtpMaxMisorder:
+		// Very large jump. Two sequential packets confirm that the sender restarted
+		// its sequence numbering without changing SSRC.
+		if uint32(seq) == r.badSeq {
+			r.restart(ssrc, seq, timestamp, arrival)
+			return rtpRestarted
+		}
+		r.badSeq = uint32(seq+1) & 0xFFFF
+		return rtpProbation
+
+	default:
+		// Late or duplicate packet from the recent past. Without a jitter buffer it
+		// cannot be played in order, so drop it.
+		return rtpDuplicate
+	}
+
+	r.received++
+	r.updateJitter(timestamp, arrival)
+	return rtpAccept
+}
+
+// restart resets all state for a new stream
+func (r *rtpReceiveState) restart(ssrc uint32, seq uint16, timestamp uint32, arrival time.Time) {
+	r.initialized = true
+	r.ssrc = ssrc
+	r.maxSeq = seq
+	r.cycles = 0
+	r.badSeq = 1 << 16
+	r.received = 1
+	r.baseArrival = arrival
+	r.baseTime = timestamp
+	r.lastTransit = -float64(timestamp)
+	r.jitter = 0
+}
+
+// updateJitter applies the RFC 3550 interarrival jitter estimator
+func (r *rtpReceiveState) updateJitter(timestamp uint32, arrival time.Time) {
+	arrivalUnits := arrival.Sub(r.baseArrival).Seconds() * r.clockRate
+	transit := arrivalUnits - float64(timestamp)
+	d := transit - r.lastTransit
+	r.lastTransit = transit
+	if d < 0 {
+		d = -d
+	}
+	// Ignore the huge step caused by 32-bit timestamp wraparound
+	if d > float64(1<<31) {
+		return
+	}
+	r.jitter += (d - r.jitter) / 16
+}
+
+// mediaTime converts an RTP timestamp to media time since the start of the
+// stream (streams longer than 2^32 samples wrap)
+func (r *rtpReceiveState) mediaTime(timestamp uint32) time.Duration {
+	if r.clockRate == 0 {
+		return 0
+	}
+	return time.Duration(float64(timestamp-r.baseTime) / r.clockRate * float64(time.Second))
+}
+
+// jitterMs returns the current interarrival jitter estimate in milliseconds
+func (r *rtpReceiveState) jitterMs() float64 {
+	if r.clockRate == 0 {
+		return 0
+	}
+	return r.jitter / r.clockRate * 1000
 }
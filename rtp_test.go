@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// sendRun feeds count in-sequence packets from addr into the latch, every
+// 20ms from start, and returns whether the last one was accepted
+func sendRun(l *rtpSourceLatch, addr *net.UDPAddr, count int, start time.Time) (bool, *net.UDPAddr) {
+	var accepted bool
+	var latched *net.UDPAddr
+	for i := 0; i < count; i++ {
+		ok, newLatch := l.accept(addr, 1234, uint16(100+i), start.Add(time.Duration(i)*rtpFrameDuration))
+		accepted = ok
+		if newLatch != nil {
+			latched = newLatch
+		}
+	}
+	return accepted, latched
+}
+
+func TestRTPSourceLatch(t *testing.T) {
+	sdpAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 10000}
+	rebound := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 20000}
+	foreign := &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 10000}
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		name     string
+		from     *net.UDPAddr
+		quiet    time.Duration // Since the last packet from the SDP address
+		packets  int
+		accepted bool
+	}{
+		{"rebinding after silence", rebound, time.Second, rtpLatchProbation, true},
+		{"rebinding on probation", rebound, time.Second, rtpLatchProbation - 1, false},
+		{"rebinding while the source talks", rebound, 100 * time.Millisecond, rtpLatchProbation, false},
+		{"other IP during a pause", foreign, time.Second, rtpLatchProbation, false},
+		{"other IP during a long hold", foreign, 10 * time.Minute, 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRTPSourceLatch(sdpAddr, true)
+			if ok, latched := l.accept(sdpAddr, 1, 1, start); !ok || latched == nil {
+				t.Fatal("SDP address not latched immediately")
+			}
+
+			accepted, latched := sendRun(l, tt.from, tt.packets, start.Add(tt.quiet))
+			if accepted != tt.accepted {
+				t.Fatalf("accepted = %v, want %v", accepted, tt.accepted)
+			}
+			if (latched != nil) != tt.accepted {
+				t.Fatalf("latched %v, want a takeover: %v", latched, tt.accepted)
+			}
+		})
+	}
+}
+
+func TestRTPSourceLatchBeforeMedia(t *testing.T) {
+	sdpAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 10000}
+	natted := &net.UDPAddr{IP: net.ParseIP("203.0.113.9"), Port: 40000}
+	start := time.Unix(1000, 0)
+
+	// A far end behind NAT never sends from its SDP address
+	l := newRTPSourceLatch(sdpAddr, true)
+	if accepted, latched := sendRun(l, natted, rtpLatchProbation, start); !accepted || latched == nil {
+		t.Fatal("NATed source not latched after probation")
+	}
+
+	// A re-INVITE moves the media to a new IP
+	moved := &net.UDPAddr{IP: net.ParseIP("192.0.2.99"), Port: 30000}
+	l.setExpected(moved)
+	if accepted, _ := sendRun(l, moved, rtpLatchProbation, start.Add(time.Second)); !accepted {
+		t.Fatal("re-INVITE address not latched")
+	}
+}
@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// s3PartSize is the size of multipart upload parts (the S3 minimum)
+	s3PartSize = 5 * 1024 * 1024
+	// s3Attempts is how many times each S3 request is tried before spooling
+	s3Attempts = 4
+	// s3RequestTimeout bounds a single S3 request
+	s3RequestTimeout = 2 * time.Minute
+	// spoolRetryInterval is how often failed uploads are retried from the spool
+	spoolRetryInterval = time.Minute
+)
+
+// S3Config configures an S3-compatible backend (AWS S3, MinIO, etc.)
+type S3Config struct {
+	Endpoint        string // e.g. http://localhost:9000 for MinIO; defaults to AWS for the region
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	PathStyle       bool // Use endpoint/bucket/key URLs instead of bucket.endpoint/key
+}
+
+// S3Storage stores objects in an S3-compatible bucket. Every upload is also
+// written to a local spool file; if an upload still fails after retries the
+// spool file is kept and retried in the background until it succeeds.
+type S3Storage struct {
+	config     S3Config
+	endpoint   *url.URL
+	httpClient *http.Client
+	spoolDir   string
+	active     map[string]bool // Spool files of uploads still in progress
+	activeMu   sync.Mutex
+	stopRetry  chan struct{}
+	wg         sync.WaitGroup
+}
+
+// spoolMetadata is stored next to a spool file whose upload failed
+type spoolMetadata struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+}
+
+// NewS3Storage creates an S3 backend and starts retrying any uploads left in the spool directory
+func NewS3Storage(config S3Config, spoolDir string) (*S3Storage, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is not set")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3 credentials are not set")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", config.Region)
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+
+	if err := os.MkdirAll(spoolDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &S3Storage{
+		config:     config,
+		endpoint:   endpointURL,
+		httpClient: &http.Client{},
+		spoolDir:   spoolDir,
+		active:     make(map[string]bool),
+		stopRetry:  make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.retrySpooled()
+
+	slog.Info("S3 storage initialized",
+		"event", "storage_s3_init",
+		"endpoint", endpointURL.String(),
+		"bucket", config.Bucket,
+		"path_style", config.PathStyle)
+
+	return s, nil
+}
+
+// NewUpload starts a streaming upload. Data is spooled locally and sent as
+// multipart parts while the call is in progress. The first part is uploaded
+// last so that its start (e.g. a WAV header) can still be rewritten.
+func (s *S3Storage) NewUpload(key string, contentType string) (Upload, error) {
+	spoolPath := s.spoolPath(key)
+	spool, err := os.Create(spoolPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	s.setActive(spoolPath, true)
+
+	u := &s3Upload{
+		storage:     s,
+		key:         key,
+		contentType: contentType,
+		spool:       spool,
+		nextPart:    2,
+		signal:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	go u.uploadParts()
+
+	return u, nil
+}
+
+// Put uploads a small object, spooling it for later retry if S3 is unavailable
+func (s *S3Storage) Put(key string, contentType string, data []byte) error {
+	err := withRetry(s3Attempts, "put "+key, func() error {
+		return s.putObject(key, contentType, bytes.NewReader(data), int64(len(data)), sha256Hex(data))
+	})
+	if err == nil {
+		return nil
+	}
+
+	spoolPath := s.spoolPath(key)
+	if writeErr := os.WriteFile(spoolPath, data, 0o644); writeErr != nil {
+		return fmt.Errorf("upload failed (%v) and could not be spooled: %w", err, writeErr)
+	}
+	if spoolErr := s.markSpooled(spoolPath, key, contentType); spoolErr != nil {
+		return spoolErr
+	}
+	return fmt.Errorf("upload failed, spooled for retry: %w", err)
+}
+
+// Close stops the background retry loop
+func (s *S3Storage) Close() error {
+	close(s.stopRetry)
+	s.wg.Wait()
+	return nil
+}
+
+// spoolPath returns the local spool file used for an object key
+func (s *S3Storage) spoolPath(key string) string {
+	return filepath.Join(s.spoolDir, unsafeFileChars.ReplaceAllString(key, "_")+".spool")
+}
+
+// setActive tracks spool files that belong to uploads still in progress
+func (s *S3Storage) setActive(spoolPath string, active bool) {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	if active {
+		s.active[spoolPath] = true
+	} else {
+		delete(s.active, spoolPath)
+	}
+}
+
+// markSpooled records where a failed upload should go so it can be retried
+func (s *S3Storage) markSpooled(spoolPath, key, contentType string) error {
+	metadata, err := json.Marshal(spoolMetadata{Key: key, ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(spoolPath+".meta", metadata, 0o644); err != nil {
+		return fmt.Errorf("failed to write spool metadata: %w", err)
+	}
+
+	slog.Warn("Upload spooled to disk for retry",
+		"event", "storage_spooled",
+		"key", key,
+		"spool_file", spoolPath)
+	return nil
+}
+
+// retrySpooled periodically uploads spool files left behind by failed uploads
+func (s *S3Storage) retrySpooled() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		s.uploadSpooled()
+
+		select {
+		case <-ticker.C:
+		case <-s.stopRetry:
+			return
+		}
+	}
+}
+
+// uploadSpooled makes one pass over the spool directory
+func (s *S3Storage) uploadSpooled() {
+	metaFiles, err := filepath.Glob(filepath.Join(s.spoolDir, "*.spool.meta"))
+	if err != nil {
+		return
+	}
+
+	for _, metaFile := range metaFiles {
+		spoolPath := strings.TrimSuffix(metaFile, ".meta")
+
+		s.activeMu.Lock()
+		active := s.active[spoolPath]
+		s.activeMu.Unlock()
+		if active {
+			continue
+		}
+
+		metadataJSON, err := os.ReadFile(metaFile)
+		if err != nil {
+			continue
+		}
+		var metadata spoolMetadata
+		if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+			slog.Error("Invalid spool metadata",
+				"event", "storage_spool_invalid",
+				"file", metaFile,
+				"error", err.Error())
+			continue
+		}
+
+		if err := s.putFile(metadata.Key, metadata.ContentType, spoolPath); err != nil {
+			slog.Warn("Spooled upload still failing",
+				"event", "storage_spool_retry_failed",
+				"key", metadata.Key,
+				"error", err.Error())
+			continue
+		}
+
+		os.Remove(spoolPath)
+		os.Remove(metaFile)
+		slog.Info("Spooled upload completed",
+			"event", "storage_spool_uploaded",
+			"key", metadata.Key)
+	}
+}
+
+// putFile uploads a whole local file as one object
+func (s *S3Storage) putFile(key, contentType, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	payloadHash, err := sha256Reader(io.NewSectionReader(file, 0, info.Size()))
+	if err != nil {
+		return err
+	}
+
+	return s.putObject(key, contentType, io.NewSectionReader(file, 0, info.Size()), info.Size(), payloadHash)
+}
+
+// putObject uploads an object in a single request
+func (s *S3Storage) putObject(key, contentType string, body io.Reader, size int64, payloadHash string) error {
+	resp, err := s.do(http.MethodPut, key, nil, body, size, payloadHash, contentType)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// createMultipartUpload starts a multipart upload and returns its ID
+func (s *S3Storage) createMultipartUpload(key, contentType string) (string, error) {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0, sha256Hex(nil), contentType)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to parse multipart upload response: %w", err)
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("multipart upload response has no UploadId")
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart uploads one part from a reader and returns its ETag
+func (s *S3Storage) uploadPart(key, uploadID string, partNumber int, body io.ReadSeeker, size int64) (string, error) {
+	payloadHash, err := sha256Reader(body)
+	if err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	resp, err := s.do(http.MethodPut, key, query, body, size, payloadHash, "")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("part %d upload returned no ETag", partNumber)
+	}
+	return etag, nil
+}
+
+// s3Part identifies an uploaded part for CompleteMultipartUpload
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// completeMultipartUpload assembles the uploaded parts into the final object
+func (s *S3Storage) completeMultipartUpload(key, uploadID string, parts []s3Part) error {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body), int64(len(body)), sha256Hex(body), "application/xml")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 can report an error inside a 200 response to CompleteMultipartUpload
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		return fmt.Errorf("complete multipart upload failed: %s", string(respBody))
+	}
+	return nil
+}
+
+// abortMultipartUpload discards a multipart upload and its parts
+func (s *S3Storage) abortMultipartUpload(key, uploadID string) error {
+	resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, 0, sha256Hex(nil), "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do sends a signed request and returns the response if it succeeded
+func (s *S3Storage) do(method, key string, query url.Values, body io.Reader, size int64, payloadHash, contentType string) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+
+	reqURL := *s.endpoint
+	objectPath := "/" + strings.TrimPrefix(key, "/")
+	if s.config.PathStyle {
+		reqURL.Path = "/" + s.config.Bucket + objectPath
+	} else {
+		reqURL.Host = s.config.Bucket + "." + s.endpoint.Host
+		reqURL.Path = objectPath
+	}
+	reqURL.RawPath = awsURIEscape(reqURL.Path, false)
+	reqURL.RawQuery = canonicalQueryString(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, reqURL.String(), body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("S3 request failed: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("S3 %s returned status %d: %s", method, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	// Release the request context once the caller has consumed the body
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to a request
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := dateStamp + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), dateStamp)
+	signingKey = hmacSHA256(signingKey, s.config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// s3Upload is a streaming multipart upload backed by a local spool file
+type s3Upload struct {
+	storage     *S3Storage
+	key         string
+	contentType string
+	spool       *os.File
+	size        int64  // Bytes written so far
+	uploadID    string // Empty until the first part beyond part 1 is uploaded
+	parts       []s3Part
+	nextPart    int // Next part number to upload; part 1 is reserved for Close
+	err         error
+	signal      chan struct{}
+	done        chan struct{}
+	mu          sync.Mutex
+}
+
+// Write appends to the spool file and lets the uploader send any full parts
+func (u *s3Upload) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	n, err := u.spool.WriteAt(p, u.size)
+	u.size += int64(n)
+	u.mu.Unlock()
+
+	select {
+	case u.signal <- struct{}{}:
+	default:
+	}
+	return n, err
+}
+
+// WriteAt rewrites data in the first part, which is only uploaded on Close
+func (u *s3Upload) WriteAt(p []byte, off int64) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if off+int64(len(p)) > s3PartSize && u.uploadID != "" {
+		return 0, fmt.Errorf("cannot rewrite data that has already been uploaded")
+	}
+	return u.spool.WriteAt(p, off)
+}
+
+// uploadParts runs in the background and uploads parts 2..N as they fill up
+func (u *s3Upload) uploadParts() {
+	defer close(u.done)
+
+	for range u.signal {
+		for {
+			u.mu.Lock()
+			ready := u.err == nil && u.size >= int64(u.nextPart)*s3PartSize
+			u.mu.Unlock()
+			if !ready {
+				break
+			}
+
+			if err := u.uploadPart(u.nextPart, s3PartSize); err != nil {
+				u.mu.Lock()
+				u.err = err
+				u.mu.Unlock()
+				break
+			}
+		}
+	}
+}
+
+// uploadPart uploads one part of the spool file, creating the multipart upload on first use
+func (u *s3Upload) uploadPart(partNumber int, size int64) error {
+	if u.uploadID == "" {
+		var uploadID string
+		err := withRetry(s3Attempts, "create multipart "+u.key, func() error {
+			var err error
+			uploadID, err = u.storage.createMultipartUpload(u.key, u.contentType)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		u.mu.Lock()
+		u.uploadID = uploadID
+		u.mu.Unlock()
+	}
+
+	offset := int64(partNumber-1) * s3PartSize
+	var etag string
+	err := withRetry(s3Attempts, fmt.Sprintf("upload part %d of %s", partNumber, u.key), func() error {
+		var err error
+		etag, err = u.storage.uploadPart(u.key, u.uploadID, partNumber, io.NewSectionReader(u.spool, offset, size), size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	u.parts = append(u.parts, s3Part{PartNumber: partNumber, ETag: etag})
+	if partNumber >= u.nextPart {
+		u.nextPart = partNumber + 1
+	}
+	return nil
+}
+
+// Close uploads the remaining data and completes the object. If S3 is
+// unreachable the spool file is kept and retried in the background.
+func (u *s3Upload) Close() error {
+	// Let the background uploader finish its current part and exit
+	close(u.signal)
+	<-u.done
+
+	spoolPath := u.spool.Name()
+	defer u.storage.setActive(spoolPath, false)
+
+	err := u.finish()
+	if closeErr := u.spool.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		if u.uploadID != "" {
+			if abortErr := u.storage.abortMultipartUpload(u.key, u.uploadID); abortErr != nil {
+				slog.Warn("Failed to abort multipart upload",
+					"event", "storage_abort_error",
+					"key", u.key,
+					"error", abortErr.Error())
+			}
+		}
+		if spoolErr := u.storage.markSpooled(spoolPath, u.key, u.contentType); spoolErr != nil {
+			return fmt.Errorf("upload failed (%v) and could not be spooled: %w", err, spoolErr)
+		}
+		return fmt.Errorf("upload failed, spooled for retry: %w", err)
+	}
+
+	os.Remove(spoolPath)
+	slog.Info("Upload completed",
+		"event", "storage_upload_complete",
+		"key", u.key,
+		"size_bytes", u.size,
+		"parts", len(u.parts))
+	return nil
+}
+
+// finish uploads whatever is not yet in S3
+func (u *s3Upload) finish() error {
+	if u.err != nil {
+		return u.err
+	}
+
+	// Small objects never started a multipart upload
+	if u.uploadID == "" {
+		return withRetry(s3Attempts, "put "+u.key, func() error {
+			return u.storage.putFile(u.key, u.contentType, u.spool.Name())
+		})
+	}
+
+	// Remaining full parts and the final short part
+	for offset := int64(u.nextPart-1) * s3PartSize; offset < u.size; offset += s3PartSize {
+		size := u.size - offset
+		if size > s3PartSize {
+			size = s3PartSize
+		}
+		if err := u.uploadPart(u.nextPart, size); err != nil {
+			return err
+		}
+	}
+
+	// Part 1 goes last so rewrites of the object's start are included
+	if err := u.uploadPart(1, s3PartSize); err != nil {
+		return err
+	}
+
+	return withRetry(s3Attempts, "complete "+u.key, func() error {
+		return u.storage.completeMultipartUpload(u.key, u.uploadID, u.parts)
+	})
+}
+
+// cancelOnClose cancels a request context when the response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and releases the context
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// awsURIEscape percent-encodes a string as required by SigV4: everything
+// except unreserved characters, and '/' unless encodeSlash is set
+func awsURIEscape(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQueryString encodes query parameters sorted by key for SigV4
+func canonicalQueryString(query url.Values) string {
+	if len(query) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, awsURIEscape(key, true)+"="+awsURIEscape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// sha256Hex returns the hex SHA-256 of data
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sha256Reader returns the hex SHA-256 of everything read from r
+func sha256Reader(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hmacSHA256 computes HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
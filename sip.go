@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emiago/sipgo"
@@ -26,9 +27,38 @@ const (
 	RTP_DEBUG = false
 )
 
-// MediaHandler is an interface for different media handlers (WebRTC, Gemini, etc.)
+const (
+	// rtpFrameDuration is the packetization interval of the outgoing media clock
+	rtpFrameDuration = 20 * time.Millisecond
+	// rtpSamplesPerFrame is the number of 8kHz samples in one 20ms frame
+	rtpSamplesPerFrame = 160
+	// rtpFrameBytes is the size of one 20ms frame of 16-bit PCM
+	rtpFrameBytes = rtpSamplesPerFrame * 2
+	// rtpPartialTicks is how many ticks a partial frame waits for the next
+	// Write before it is sent padded with silence (the tail of an utterance)
+	rtpPartialTicks = 2
+)
+
+const (
+	// promptMediaWait bounds how long the intro waits for the caller's first RTP
+	promptMediaWait = 2 * time.Second
+	// promptWaitDelay is how long the AI may take to connect before the wait prompt starts
+	promptWaitDelay = 500 * time.Millisecond
+)
+
+// MediaHandler is an interface for the handler that answers the caller (e.g. Gemini)
 type MediaHandler interface {
+	// Start connects the handler; it is called once the call has been answered
+	Start() error
+	// Open starts the conversation (e.g. a greeting) once the caller's media is flowing
+	Open() error
 	Close() error
+	// ParticipantID returns the handler's ID in the session's media bridge
+	ParticipantID() string
+	// Transcript returns the conversation so far
+	Transcript() *Transcript
+	// Stats returns the model, interruption count and token usage so far
+	Stats() AIStats
 }
 
 // Session represents an active SIP session
@@ -39,23 +69,58 @@ type Session struct {
 	CreatedAt      time.Time
 	LastActivity   time.Time
 	MediaBridge    MediaBridge
-	MediaHandler   MediaHandler // Can be either WebRTCHandler or GeminiHandler
+	MediaHandler   MediaHandler // The AI, e.g. GeminiHandler
 	SIPParticipant *SIPParticipant
 	RTPPort        int
 	rtpConn        *net.UDPConn
-	remoteRTPAddr  *net.UDPAddr
-	stopRTP        chan struct{}
-	supportsPCMU   bool
-	supportsPCMA   bool
-	selectedCodec  string // "PCMU" or "PCMA"
+	remoteRTPAddr  *net.UDPAddr // Latched source of incoming RTP, guarded by mediaStateMux
+	rtpLatch       *rtpSourceLatch
+	rtpRecvState   *rtpReceiveState
+	inputProcessor *AudioProcessingChain // Optional processing of caller audio, nil if disabled
+	outputLoudness *LoudnessNormalizer   // Optional gain staging of AI audio, nil if disabled
+	recorder       *CallRecorder         // Optional call recording, nil if disabled
+	promptPlayer   *PromptPlayer         // Plays pre-recorded prompts to the caller
+	ambience       *AmbienceMixer        // Optional background track under outgoing audio, nil if disabled
+	mediaFork      *MediaFork            // Optional stream of the call's audio to a WebSocket, nil if disabled
+	// Browser participants joined over WebRTC, guarded by webrtcMux
+	webrtcParticipants map[string]*WebRTCParticipant
+	webrtcMux          sync.Mutex
+	stopRTP            chan struct{}
+	supportsPCMU       bool
+	supportsPCMA       bool
+	selectedCodec      string // "PCMU" or "PCMA"
 	// RTP state for outgoing packets
-	rtpSequence     uint16
-	rtpTimestamp    uint32
-	rtpSSRC         uint32
-	rtpLastSendTime time.Time
-	rtpStateMux     sync.Mutex
-	rtpPacketQueue  chan []byte // Queue for outgoing RTP packets (PCM data)
-	stopRTPSender   chan struct{}
+	rtpSequence    uint16
+	rtpTimestamp   uint32
+	rtpSSRC        uint32
+	rtpInTalkspurt bool // True while the last sent frame carried audio rather than silence
+	rtpStateMux    sync.Mutex
+	rtpPacketQueue chan []byte   // Queue for outgoing RTP packets (PCM data)
+	rtpWriter      *SIPRTPWriter // Fills rtpPacketQueue with 20ms frames
+	stopRTPSender  chan struct{}
+	// Media state shared between the SIP handlers and the RTP goroutines
+	onHold          bool
+	lastRTPReceived time.Time
+	mediaStateMux   sync.Mutex
+	// Dialog state for sending in-dialog requests
+	inviteRequest  *sip.Request
+	inviteResponse *sip.Response
+	localCSeq      uint32
+	// Outgoing DTMF (RFC 4733), disabled if the far end did not offer telephone-event
+	dtmfPayloadType uint8
+	dtmf            dtmfSender
+	dtmfTimestamp   uint32 // RTP timestamp of the event being sent, guarded by rtpStateMux
+	// Call transfer: outcome of an accepted REFER, or the leg that replaced the AI
+	referStatus       chan int
+	transferLeg       *TransferLeg // Guarded by mediaStateMux
+	endCallWebhookURL string       // Receives the end-of-call record, empty for none
+	extraction        *Extraction  // Extracts outcomes from the AI's speech, nil if not configured
+	// Final AI usage and its estimated cost, set when the session ends
+	aiStats *AIStats
+	cost    *CostEstimate // Nil without a price for the model
+	// EndReason records why the session ended (e.g. "remote_bye", "rtp_timeout")
+	EndReason string
+	EndedAt   time.Time
 }
 
 // SIPParticipant represents a SIP participant in the media bridge
@@ -90,6 +155,12 @@ func (p *SIPParticipant) SetWriter(writer io.Writer) {
 	p.writer = writer
 }
 
+// AcceptedFormats returns the format the SIP leg's packetizer expects: 8kHz
+// linear PCM, which it encodes to the negotiated G.711 codec
+func (p *SIPParticipant) AcceptedFormats() []MediaFormat {
+	return []MediaFormat{DefaultMediaFormat}
+}
+
 // FlushQueue implements QueueFlusher interface - delegates to the Session
 func (p *SIPParticipant) FlushQueue() {
 	if p.session != nil {
@@ -100,40 +171,146 @@ func (p *SIPParticipant) FlushQueue() {
 // SIPRTPWriter implements io.Writer to send RTP packets back to SIP client
 type SIPRTPWriter struct {
 	session *Session
+	// Audio left over after the last full frame of a Write. It is completed by
+	// the next Write, so that chunks of arbitrary length play back to back, and
+	// only padded to a full frame when the talkspurt ends.
+	remainder      []byte
+	remainderTicks int // Ticks the remainder has waited for the next Write
+	mu             sync.Mutex
 }
 
 // Write enqueues PCM audio data to be sent as RTP packets
 // Expects p to contain raw PCM audio data (16-bit LPCM)
 func (w *SIPRTPWriter) Write(p []byte) (n int, err error) {
-	// Split the incoming audio into 20ms chunks for RTP packetization
-	// Audio is 16-bit PCM at 8000 Hz
-	chunks := splitIntoChunks(p, 8000, 20)
-
-	// Enqueue each chunk separately
-	for _, chunk := range chunks {
-		// Make a copy of the chunk since it might be reused
-		chunkCopy := make([]byte, len(chunk))
-		copy(chunkCopy, chunk)
-
-		// Enqueue the PCM chunk for the packet sender goroutine to process
-		select {
-		case w.session.rtpPacketQueue <- chunkCopy:
-			// Successfully enqueued
-		default:
-			// Queue is full, log and drop chunk
-			slog.Warn("RTP queue full, dropping chunk",
-				"event", "rtp_queue_full",
-				"session", w.session.CallID,
-				"chunk_size", len(chunk))
-		}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Continue where the previous Write left off. This also copies p, which
+	// the caller may reuse.
+	data := make([]byte, 0, len(w.remainder)+len(p))
+	data = append(data, w.remainder...)
+	data = append(data, p...)
+
+	// Split the audio into 20ms frames for RTP packetization and keep the
+	// partial tail for the next Write. Audio is 16-bit PCM at 8000 Hz.
+	full := len(data) - len(data)%rtpFrameBytes
+	w.remainder = data[full:]
+	w.remainderTicks = 0
+	for offset := 0; offset < full; offset += rtpFrameBytes {
+		w.enqueue(data[offset : offset+rtpFrameBytes])
 	}
 
 	// Return the total number of bytes processed
 	return len(p), nil
 }
 
+// enqueue hands one frame to the packet sender goroutine
+func (w *SIPRTPWriter) enqueue(frame []byte) {
+	select {
+	case w.session.rtpPacketQueue <- frame:
+		// Successfully enqueued
+	default:
+		// Queue is full, log and drop chunk
+		slog.Warn("RTP queue full, dropping chunk",
+			"event", "rtp_queue_full",
+			"session", w.session.CallID,
+			"chunk_size", len(frame))
+	}
+}
+
+// takeRemainder returns the partial frame left over by the last Write, if
+// any, and forgets it. The packet sender calls it on every tick the queue is
+// empty; the remainder is held for rtpPartialTicks ticks first, so a chunk
+// that arrives a little late still continues it instead of following a
+// padded frame.
+func (w *SIPRTPWriter) takeRemainder() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.remainder) == 0 {
+		return nil
+	}
+	w.remainderTicks++
+	if w.remainderTicks < rtpPartialTicks {
+		return nil
+	}
+	remainder := w.remainder
+	w.remainder = nil
+	w.remainderTicks = 0
+	return remainder
+}
+
+// clearRemainder drops the partial frame left over by the last Write
+func (w *SIPRTPWriter) clearRemainder() {
+	w.mu.Lock()
+	w.remainder = nil
+	w.remainderTicks = 0
+	w.mu.Unlock()
+}
+
+// IsOnHold reports whether the far end has put the call on hold
+func (s *Session) IsOnHold() bool {
+	s.mediaStateMux.Lock()
+	defer s.mediaStateMux.Unlock()
+	return s.onHold
+}
+
+// SetOnHold updates the hold state. Leaving hold restarts the RTP inactivity
+// timer so that the far end has a full timeout period to resume media.
+func (s *Session) SetOnHold(onHold bool) {
+	s.mediaStateMux.Lock()
+	defer s.mediaStateMux.Unlock()
+	if s.onHold && !onHold {
+		s.lastRTPReceived = time.Now()
+	}
+	s.onHold = onHold
+}
+
+// getRemoteRTPAddr returns the address outgoing RTP is sent to
+func (s *Session) getRemoteRTPAddr() *net.UDPAddr {
+	s.mediaStateMux.Lock()
+	defer s.mediaStateMux.Unlock()
+	return s.remoteRTPAddr
+}
+
+// setRemoteRTPAddr updates the address outgoing RTP is sent to
+func (s *Session) setRemoteRTPAddr(addr *net.UDPAddr) {
+	s.mediaStateMux.Lock()
+	s.remoteRTPAddr = addr
+	s.mediaStateMux.Unlock()
+}
+
+// markRTPReceived records the arrival time of an RTP packet
+func (s *Session) markRTPReceived(now time.Time) {
+	s.mediaStateMux.Lock()
+	s.lastRTPReceived = now
+	s.mediaStateMux.Unlock()
+}
+
+// rtpTimedOut reports whether no RTP has been received for longer than timeout
+// while the call is not on hold. A zero timeout disables the check.
+func (s *Session) rtpTimedOut(timeout time.Duration, now time.Time) bool {
+	if timeout <= 0 {
+		return false
+	}
+	s.mediaStateMux.Lock()
+	defer s.mediaStateMux.Unlock()
+	return !s.onHold && now.Sub(s.lastRTPReceived) > timeout
+}
+
 // FlushQueue drains all pending RTP packets from the queue (called on interruption)
 func (s *Session) FlushQueue() {
+	// Whatever is sent next starts a new talkspurt, even if no silence frame
+	// went out in between
+	s.rtpStateMux.Lock()
+	s.rtpInTalkspurt = false
+	s.rtpStateMux.Unlock()
+
+	// The partial frame belongs to the interrupted audio too
+	if s.rtpWriter != nil {
+		s.rtpWriter.clearRemainder()
+	}
+
 	flushedCount := 0
 	// Drain the queue without blocking
 	for {
@@ -153,12 +330,20 @@ func (s *Session) FlushQueue() {
 	}
 }
 
-// rtpPacketSender runs in a separate goroutine to send RTP packets with proper pacing
+// rtpPacketSender runs in a separate goroutine and acts as the session's media clock.
+// Every 20ms it emits exactly one RTP packet: the next queued PCM frame if there is
+// one, or silence otherwise. This keeps the outgoing stream continuous so that the
+// far end's jitter buffer never sees gaps, drift or bursts.
 func (s *Session) rtpPacketSender() {
 	slog.Info("Starting RTP packet sender",
 		"event", "rtp_sender_start",
 		"session", s.CallID)
 
+	ticker := time.NewTicker(rtpFrameDuration)
+	defer ticker.Stop()
+
+	silence := make([]byte, rtpFrameBytes)
+
 	for {
 		select {
 		case <-s.stopRTPSender:
@@ -167,122 +352,165 @@ func (s *Session) rtpPacketSender() {
 				"session", s.CallID)
 			return
 
-		case pcmData := <-s.rtpPacketQueue:
-			if s.remoteRTPAddr == nil {
-				// Remote address not yet learned, skip
+		case <-ticker.C:
+			// DTMF digits take the place of audio while they are sent
+			if s.sendDTMFFrame(silence) {
 				continue
 			}
 
-			// Calculate packet duration from PCM data length
-			// PCM is 16-bit (2 bytes per sample) at 8000 Hz
-			samplesInChunk := len(pcmData) / 2
-			packetDurationMs := float64(samplesInChunk) / 8.0 // 8000 Hz = 8 samples per ms
-
-			// Encode PCM to G.711 using the selected codec
-			g711Payload := encodeG711(pcmData, s.selectedCodec)
-			if len(g711Payload) == 0 {
-				slog.Error("Failed to encode PCM to G.711",
-					"event", "encoding_failed",
-					"session", s.CallID,
-					"codec", s.selectedCodec)
-				continue
+			// Take one frame of audio if available. Once the queue has been dry
+			// for rtpPartialTicks, the talkspurt ends with the partial frame of
+			// its last Write, if any, and is followed by silence.
+			var pcmData []byte
+			select {
+			case pcmData = <-s.rtpPacketQueue:
+			default:
+				if s.rtpWriter != nil {
+					pcmData = s.rtpWriter.takeRemainder()
+				}
 			}
 
-			// Determine payload type based on codec
-			var payloadType uint8
-			if s.selectedCodec == "PCMU" {
-				payloadType = 0
-			} else if s.selectedCodec == "PCMA" {
-				payloadType = 8
-			} else {
-				slog.Error("Unknown codec",
-					"event", "unknown_codec",
-					"session", s.CallID,
-					"codec", s.selectedCodec)
-				continue
-			}
+			s.sendRTPFrame(pcmData, silence)
+		}
+	}
+}
 
-			// Lock RTP state for thread-safe updates
-			s.rtpStateMux.Lock()
+// sendRTPFrame packetizes and sends one 20ms frame. A nil pcmData sends silence.
+// The RTP timestamp always advances by one frame so it stays continuous across
+// idle periods and FlushQueue interruptions.
+func (s *Session) sendRTPFrame(pcmData []byte, silence []byte) {
+	isSpeech := pcmData != nil
+	if !isSpeech {
+		pcmData = silence
+	} else if len(pcmData) < rtpFrameBytes {
+		// Pad the last partial frame of an utterance up to a full frame
+		padded := make([]byte, rtpFrameBytes)
+		copy(padded, pcmData)
+		pcmData = padded
+	}
 
-			// Check timing - if last packet was sent too recently, wait to maintain proper pacing
-			if !s.rtpLastSendTime.IsZero() {
-				elapsed := time.Since(s.rtpLastSendTime)
-				expectedDuration := time.Duration(packetDurationMs * float64(time.Millisecond))
+	// Advance the media clock even when the packet cannot be sent yet
+	s.rtpStateMux.Lock()
+	sequenceNumber := s.rtpSequence
+	timestamp := s.rtpTimestamp
+	ssrc := s.rtpSSRC
+	s.rtpSequence++
+	s.rtpTimestamp += rtpSamplesPerFrame
+
+	// Set the marker bit on the first packet of each talkspurt (RFC 3551 section 4.1)
+	marker := isSpeech && !s.rtpInTalkspurt
+	s.rtpInTalkspurt = isSpeech
+	s.rtpStateMux.Unlock()
+
+	// Bring AI speech to a consistent level; silence is left untouched
+	if isSpeech && s.outputLoudness != nil {
+		samples := pcmToSamples(pcmData)
+		s.outputLoudness.Process(samples)
+		samplesToPCM(samples, pcmData)
+	}
 
-				if elapsed < expectedDuration {
-					waitTime := expectedDuration - elapsed
-					s.rtpStateMux.Unlock() // Unlock while sleeping
-					time.Sleep(waitTime)
-					s.rtpStateMux.Lock() // Re-lock after sleep
-				}
-			}
+	// Mix the ambience under everything that goes out, including silence
+	if s.ambience != nil {
+		samples := pcmToSamples(pcmData)
+		s.ambience.Mix(samples)
+		if !isSpeech {
+			// Don't write into the shared silence buffer
+			pcmData = make([]byte, rtpFrameBytes)
+		}
+		samplesToPCM(samples, pcmData)
+	}
 
-			sequenceNumber := s.rtpSequence
-			timestamp := s.rtpTimestamp
-			ssrc := s.rtpSSRC
-
-			// Increment sequence number for next packet
-			s.rtpSequence++
-
-			// Increment timestamp based on sample count (8000 Hz)
-			s.rtpTimestamp += uint32(samplesInChunk)
-
-			s.rtpStateMux.Unlock()
-
-			// Create RTP packet
-			rtpPacket := &rtp.Packet{
-				Header: rtp.Header{
-					Version:        2,
-					Padding:        false,
-					Extension:      false,
-					Marker:         false,
-					PayloadType:    payloadType,
-					SequenceNumber: sequenceNumber,
-					Timestamp:      timestamp,
-					SSRC:           ssrc,
-				},
-				Payload: g711Payload,
-			}
+	// Record exactly what goes out on this tick, paired with the caller's audio
+	if s.recorder != nil {
+		s.recorder.WriteFrame(pcmData)
+	}
 
-			// Marshal RTP packet to bytes
-			rtpBytes, err := rtpPacket.Marshal()
-			if err != nil {
-				slog.Error("Failed to marshal RTP packet",
-					"event", "marshal_failed",
-					"session", s.CallID,
-					"error", err.Error())
-				continue
-			}
+	// Fork the AI's speech as it goes out, so audio flushed on barge-in is not forked
+	if isSpeech && s.mediaFork != nil {
+		s.mediaFork.WriteOutbound(pcmData, timestamp)
+	}
 
-			// Send RTP packet
-			now := time.Now()
-			_, err = s.rtpConn.WriteToUDP(rtpBytes, s.remoteRTPAddr)
-			if err != nil {
-				slog.Error("RTP send error",
-					"event", "rtp_send_error",
-					"session", s.CallID,
-					"to", s.remoteRTPAddr.String(),
-					"error", err.Error())
-				continue
-			}
+	remoteAddr := s.getRemoteRTPAddr()
+	if remoteAddr == nil {
+		// Remote address not yet learned, skip
+		return
+	}
 
-			// Update last send time after successful send
-			s.rtpStateMux.Lock()
-			s.rtpLastSendTime = now
-			s.rtpStateMux.Unlock()
+	if s.IsOnHold() {
+		// Far end is not receiving media while on hold
+		return
+	}
 
 
-			if RTP_DEBUG {
-				slog.Info("RTP packet sent",
-					"event", "rtp_send",
-					"session", s.CallID,
-					"to", s.remoteRTPAddr.String(),
-					"seq", sequenceNumber,
-					"timestamp", timestamp,
-					"payload_bytes", len(g711Payload))
-			}
-		}
+	// Encode PCM to G.711 using the selected codec
+	g711Payload := encodeG711(pcmData, s.selectedCodec)
+	if len(g711Payload) == 0 {
+		slog.Error("Failed to encode PCM to G.711",
+			"event", "encoding_failed",
+			"session", s.CallID,
+			"codec", s.selectedCodec)
+		return
+	}
+
+	// Determine payload type based on codec
+	var payloadType uint8
+	if s.selectedCodec == "PCMU" {
+		payloadType = 0
+	} else if s.selectedCodec == "PCMA" {
+		payloadType = 8
+	} else {
+		slog.Error("Unknown codec",
+			"event", "unknown_codec",
+			"session", s.CallID,
+			"codec", s.selectedCodec)
+		return
+	}
+
+	// Create RTP packet
+	rtpPacket := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Padding:        false,
+			Extension:      false,
+			Marker:         marker,
+			PayloadType:    payloadType,
+			SequenceNumber: sequenceNumber,
+			Timestamp:      timestamp,
+			SSRC:           ssrc,
+		},
+		Payload: g711Payload,
+	}
+
+	// Marshal RTP packet to bytes
+	rtpBytes, err := rtpPacket.Marshal()
+	if err != nil {
+		slog.Error("Failed to marshal RTP packet",
+			"event", "marshal_failed",
+			"session", s.CallID,
+			"error", err.Error())
+		return
+	}
+
+	// Send RTP packet
+	_, err = s.rtpConn.WriteToUDP(rtpBytes, remoteAddr)
+	if err != nil {
+		slog.Error("RTP send error",
+			"event", "rtp_send_error",
+			"session", s.CallID,
+			"to", remoteAddr.String(),
+			"error", err.Error())
+		return
+	}
+
+	if RTP_DEBUG {
+		slog.Info("RTP packet sent",
+			"event", "rtp_send",
+			"session", s.CallID,
+			"to", remoteAddr.String(),
+			"seq", sequenceNumber,
+			"timestamp", timestamp,
+			"marker", marker,
+			"payload_bytes", len(g711Payload))
 	}
 }
 
@@ -291,11 +519,16 @@ type SIPServer struct {
 	config         *Config
 	userAgent      *sipgo.UserAgent
 	server         *sipgo.Server
+	client         *sipgo.Client
+	dialogClient   *sipgo.DialogClient // Outbound calls placed for transfers
 	httpClient     *http.Client
 	sessions       map[string]*Session
 	sessionsMux    sync.RWMutex
 	stopCleanup    chan struct{}
 	handlerFactory *MediaHandlerFactory
+	storage        Storage        // Where call recordings are stored
+	webrtc         *WebRTCGateway // Negotiates browser participants
+	usageDIDs      *didLabels     // Bounds the did label of usage metrics
 }
 
 // InvitePayload represents the data sent to the callback URL
@@ -307,9 +540,29 @@ type InvitePayload struct {
 
 // SessionConfig represents the configuration returned from the callback URL
 type SessionConfig struct {
-	SystemInstructions string `json:"system_instructions"`
-	Voice              string `json:"voice,omitempty"`
-	Language           string `json:"language,omitempty"`
+	SystemInstructions   string                 `json:"system_instructions"`
+	Model                string                 `json:"model,omitempty"`   // Live model for this call, overrides --gemini-model
+	Opening              *OpeningConfig         `json:"opening,omitempty"` // How the conversation starts once the call is answered
+	Voice                string                 `json:"voice,omitempty"`
+	Language             string                 `json:"language,omitempty"`
+	AudioProcessing      *AudioProcessingConfig `json:"audio_processing,omitempty"`
+	OutputLoudness       *OutputLoudnessConfig  `json:"output_loudness,omitempty"`
+	Record               *bool                  `json:"record,omitempty"`                 // Overrides the global --record setting
+	IntroAudio           string                 `json:"intro_audio,omitempty"`            // WAV path or URL played before the AI joins
+	WaitAudio            string                 `json:"wait_audio,omitempty"`             // Looped while the AI connects, overrides --wait-audio
+	Ambience             *AmbienceConfig        `json:"ambience,omitempty"`               // Background track mixed under outgoing audio
+	BridgeMode           string                 `json:"bridge_mode,omitempty"`            // "forward" or "mix", overrides --bridge-mode
+	MediaFork            *MediaForkConfig       `json:"media_fork,omitempty"`             // Stream the call's audio to a WebSocket consumer
+	Tools                []ToolDeclaration      `json:"tools,omitempty"`                  // Functions the AI may call
+	ToolWebhookURL       string                 `json:"tool_webhook_url,omitempty"`       // Receives tool calls, overrides --tool-webhook-url
+	CallControl          *CallControlConfig     `json:"call_control,omitempty"`           // Lets the AI hang up, transfer, send DTMF and hold
+	EndCallWebhookURL    string                 `json:"end_call_webhook_url,omitempty"`   // Receives the end-of-call record, overrides --end-call-webhook-url
+	Extractors           []ExtractorConfig      `json:"extractors,omitempty"`             // Values to extract from what the AI says
+	ExtractionWebhookURL string                 `json:"extraction_webhook_url,omitempty"` // Receives extracted values, overrides --extraction-webhook-url
+	// Shorthand for an "intent" extractor of "[INTENT] <category>" lines
+	EndOnIntent          bool  `json:"end_on_intent,omitempty"`
+	IntentTimeoutSeconds int   `json:"intent_timeout_seconds,omitempty"`
+	IntentEndCategories  []int `json:"intent_end_categories,omitempty"`
 }
 
 // parseSDP parses the SDP offer to detect supported codecs using pion/sdp
@@ -357,6 +610,83 @@ func parseSDP(sdpOffer string) (supportsPCMU bool, supportsPCMA bool) {
 	return supportsPCMU, supportsPCMA
 }
 
+// parseSDPMediaAddress returns the address the far end will send audio from,
+// taken from the c= and m= lines of the first audio stream. It returns nil if
+// the SDP has no usable address (missing, unparsable or the 0.0.0.0 hold address).
+func parseSDPMediaAddress(sdpBody string) *net.UDPAddr {
+	var sd sdp.SessionDescription
+	if err := sd.Unmarshal([]byte(sdpBody)); err != nil {
+		return nil
+	}
+
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Media != "audio" {
+			continue
+		}
+
+		conn := md.ConnectionInformation
+		if conn == nil {
+			conn = sd.ConnectionInformation
+		}
+		if conn == nil || conn.Address == nil {
+			return nil
+		}
+
+		ip := net.ParseIP(conn.Address.Address)
+		if ip == nil || ip.IsUnspecified() || md.MediaName.Port.Value == 0 {
+			return nil
+		}
+
+		return &net.UDPAddr{IP: ip, Port: md.MediaName.Port.Value}
+	}
+
+	return nil
+}
+
+// parseSDPDirection returns the media direction of the first audio stream in an
+// SDP body ("sendrecv", "sendonly", "recvonly" or "inactive"). A connection
+// address of 0.0.0.0 is the legacy RFC 2543 way of signalling hold and is
+// reported as "sendonly".
+func parseSDPDirection(sdpBody string) string {
+	var sd sdp.SessionDescription
+	if err := sd.Unmarshal([]byte(sdpBody)); err != nil {
+		return "sendrecv"
+	}
+
+	direction := "sendrecv"
+	for _, attr := range sd.Attributes {
+		switch attr.Key {
+		case "sendrecv", "sendonly", "recvonly", "inactive":
+			direction = attr.Key
+		}
+	}
+
+	for _, md := range sd.MediaDescriptions {
+		if md.MediaName.Media != "audio" {
+			continue
+		}
+
+		// Media-level attributes override the session-level direction
+		for _, attr := range md.Attributes {
+			switch attr.Key {
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+				direction = attr.Key
+			}
+		}
+
+		conn := md.ConnectionInformation
+		if conn == nil {
+			conn = sd.ConnectionInformation
+		}
+		if conn != nil && conn.Address != nil && conn.Address.Address == "0.0.0.0" && direction == "sendrecv" {
+			direction = "sendonly"
+		}
+		break
+	}
+
+	return direction
+}
+
 
 // NewSIPServer creates a new SIP server instance
 func NewSIPServer(config *Config, factory *MediaHandlerFactory) (*SIPServer, error) {
@@ -370,14 +700,37 @@ func NewSIPServer(config *Config, factory *MediaHandlerFactory) (*SIPServer, err
 		return nil, fmt.Errorf("failed to create server: %w", err)
 	}
 
+	// Client is used for requests we originate within a dialog (e.g. BYE)
+	client, err := sipgo.NewClient(ua)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+
+	storage, err := NewStorage(config.Storage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording storage: %w", err)
+	}
+
+	webrtcGateway, err := NewWebRTCGateway(config.WebRTC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WebRTC gateway: %w", err)
+	}
+
 	s := &SIPServer{
-		config:         config,
-		userAgent:      ua,
-		server:         srv,
+		config:    config,
+		userAgent: ua,
+		server:    srv,
+		client:    client,
+		dialogClient: sipgo.NewDialogClient(client, sip.ContactHeader{
+			Address: sip.Uri{Host: getPublicIP(), Port: config.Port},
+		}),
 		httpClient:     &http.Client{},
 		sessions:       make(map[string]*Session),
 		stopCleanup:    make(chan struct{}),
 		handlerFactory: factory,
+		storage:        storage,
+		webrtc:         webrtcGateway,
+		usageDIDs:      newDIDLabels(config.UsageDIDs),
 	}
 
 	// Set up SIP message logging if debug is enabled
@@ -402,6 +755,7 @@ func (s *SIPServer) Start() error {
 	// Register other handlers
 	s.server.OnBye(s.handleBye)
 	s.server.OnAck(s.handleAck)
+	s.server.OnNotify(s.handleNotify)
 
 	// Start session cleanup goroutine
 	go s.cleanupInactiveSessions()
@@ -421,9 +775,15 @@ func (s *SIPServer) Stop() {
 	if s.server != nil {
 		s.server.Close()
 	}
+	if s.client != nil {
+		s.client.Close()
+	}
 	if s.userAgent != nil {
 		s.userAgent.Close()
 	}
+	if s.storage != nil {
+		s.storage.Close()
+	}
 }
 
 // logSentMessage logs a sent SIP message if debug is enabled
@@ -448,6 +808,15 @@ func (s *SIPServer) logSentMessage(msg interface{}) {
 
 // handleInvite processes incoming INVITE requests
 func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
+	// An INVITE for a known Call-ID is a re-INVITE within the existing dialog
+	s.sessionsMux.RLock()
+	existing, isReInvite := s.sessions[req.CallID().Value()]
+	s.sessionsMux.RUnlock()
+	if isReInvite {
+		s.handleReInvite(existing, req, tx)
+		return
+	}
+
 	slog.Info("Received INVITE",
 		"from", req.From().Address.String(),
 		"to", req.To().Address.String())
@@ -471,15 +840,21 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 	// Get the Call-ID
 	callID := req.CallID().Value()
 
-	// Parse SDP offer to detect supported codecs
+	// Parse SDP offer to detect supported codecs and where media will come from
 	var supportsPCMU, supportsPCMA bool
+	var offeredRTPAddr *net.UDPAddr
+	var dtmfPayloadType uint8
 	if req.Body() != nil && len(req.Body()) > 0 {
 		sdpOffer := string(req.Body())
 		supportsPCMU, supportsPCMA = parseSDP(sdpOffer)
+		offeredRTPAddr = parseSDPMediaAddress(sdpOffer)
+		dtmfPayloadType = parseSDPTelephoneEvent(sdpOffer)
 		slog.Info("SDP offer codec support",
 			"event", "sdp_parsed",
 			"pcmu", supportsPCMU,
-			"pcma", supportsPCMA)
+			"pcma", supportsPCMA,
+			"telephone_event", dtmfPayloadType,
+			"media_address", fmt.Sprintf("%v", offeredRTPAddr))
 	} else {
 		slog.Info("No SDP offer in INVITE",
 			"event", "no_sdp_offer",
@@ -530,8 +905,21 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 			"call_id", callID)
 	}
 
-	// Create media bridge
-	mediaBridge := NewMediaBridge()
+	// Session config overrides the server-wide outbound loudness settings
+	outputLoudness := s.config.OutputLoudness
+	if sessionConfig.OutputLoudness != nil {
+		outputLoudness = sessionConfig.OutputLoudness
+	}
+
+	// The ambience track loads in the background and joins the mix once ready
+	ambience := NewAmbienceMixer(sessionConfig.Ambience, 8000, callID)
+
+	// Create media bridge; the session config may ask for a mixing bridge
+	bridgeConfig := s.config.Bridge
+	if sessionConfig.BridgeMode != "" {
+		bridgeConfig.Mode = sessionConfig.BridgeMode
+	}
+	mediaBridge := NewSessionBridge(bridgeConfig, 8000)
 	if err := mediaBridge.Start(); err != nil {
 		slog.Error("Failed to start media bridge",
 			"event", "media_bridge_start_error",
@@ -545,9 +933,23 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 		}
 		return
 	}
+	// Export the bridge's events as metrics until it stops
+	bridgeEvents, _ := mediaBridge.Subscribe(0)
+	go watchBridgeEvents(bridgeEvents)
+
+	// Tool calls go to the webhook, which the session config may override;
+	// call-control tools are registered once the session exists
+	var tools *ToolDispatcher
+	if len(sessionConfig.Tools) > 0 || sessionConfig.CallControl != nil {
+		toolConfig := s.config.Tools
+		if sessionConfig.ToolWebhookURL != "" {
+			toolConfig.WebhookURL = sessionConfig.ToolWebhookURL
+		}
+		tools = NewToolDispatcher(callID, sessionConfig.Tools, toolConfig, s.httpClient)
+	}
 
 	// Create appropriate media handler using factory
-	mediaHandler, err := s.handlerFactory.CreateHandler(mediaBridge, callID, sessionConfig)
+	mediaHandler, err := s.handlerFactory.CreateHandler(mediaBridge, callID, sessionConfig, tools)
 	if err != nil {
 		slog.Error("Failed to create media handler",
 			"event", "media_handler_create_error",
@@ -582,8 +984,18 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 		rtpSequence:    uint16(rand.Intn(65536)),      // Random initial sequence number
 		rtpTimestamp:   uint32(rand.Intn(1000000000)), // Random initial timestamp
 		rtpSSRC:        rand.Uint32(),                 // Random SSRC
-		rtpPacketQueue: make(chan []byte, 10000),        // Buffered channel for outgoing packets
+		rtpPacketQueue: make(chan []byte, 10000),      // Buffered channel for outgoing packets
 		stopRTPSender:  make(chan struct{}),
+		// The RTP inactivity timer starts when the call is answered
+		lastRTPReceived:   now,
+		rtpLatch:          newRTPSourceLatch(offeredRTPAddr, s.config.StrictRTP),
+		rtpRecvState:      newRTPReceiveState(8000),
+		dtmfPayloadType:   dtmfPayloadType,
+		referStatus:       make(chan int, 1),
+		endCallWebhookURL: s.config.EndCallWebhookURL,
+		inputProcessor:    NewAudioProcessingChain(sessionConfig.AudioProcessing, 8000, callID),
+		outputLoudness:    NewLoudnessNormalizer(outputLoudness, 8000),
+		ambience:          ambience,
 	}
 
 	// Now create SIP participant that references the session
@@ -609,6 +1021,7 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 
 	// Set up the SIP participant writer to send packets back to SIP client
 	sipWriter := &SIPRTPWriter{session: session}
+	session.rtpWriter = sipWriter
 	sipParticipant.SetWriter(sipWriter)
 
 	// Add SIP participant to media bridge now that writer is set
@@ -627,6 +1040,10 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 		return
 	}
 
+	// Prompts are addressed to the caller only, never to the AI
+	session.promptPlayer = NewPromptPlayer("prompt-"+callID, mediaBridge, sipParticipant.ID(), 8000)
+	mediaBridge.AddParticipant(session.promptPlayer)
+
 	s.sessionsMux.Lock()
 	s.sessions[callID] = session
 	s.sessionsMux.Unlock()
@@ -636,6 +1053,56 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 		"call_id", callID,
 		"total_sessions", len(s.sessions))
 
+	// Start recording before the media clock starts ticking
+	record := s.config.RecordCalls
+	if sessionConfig.Record != nil {
+		record = *sessionConfig.Record
+	}
+	if record {
+		recorder, err := NewCallRecorder(session, s.storage, recordingKey(s.config.Storage.KeyTemplate, session))
+		if err != nil {
+			slog.Error("Failed to start call recording",
+				"event", "recording_start_error",
+				"session", callID,
+				"error", err.Error())
+		} else {
+			session.recorder = recorder
+		}
+	}
+
+	// Fork the call's audio to an external consumer if the callback asked for it
+	if sessionConfig.MediaFork != nil {
+		fork, err := NewMediaFork(*sessionConfig.MediaFork, session)
+		if err == nil {
+			err = mediaBridge.AddParticipant(fork)
+		}
+		if err != nil {
+			slog.Error("Failed to start media fork",
+				"event", "media_fork_error",
+				"session", callID,
+				"error", err.Error())
+		} else {
+			session.mediaFork = fork
+			fork.Connect()
+		}
+	}
+
+	if sessionConfig.EndCallWebhookURL != "" {
+		session.endCallWebhookURL = sessionConfig.EndCallWebhookURL
+	}
+
+	// Let the AI control the call if the callback asked for it
+	if sessionConfig.CallControl != nil {
+		holdAudio := s.config.WaitAudio
+		if sessionConfig.WaitAudio != "" {
+			holdAudio = sessionConfig.WaitAudio
+		}
+		s.registerCallControl(session, tools, *sessionConfig.CallControl, holdAudio)
+	}
+
+	// Watch the AI's speech for the outcomes the callback asked for
+	s.startExtraction(session, sessionConfig)
+
 	// Start RTP packet sender goroutine
 	go session.rtpPacketSender()
 
@@ -643,6 +1110,172 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 	go s.listenRTP(session)
 
 	// Generate SDP answer using pion/sdp
+	sdpBytes, err := buildSDPAnswer(session, "sendrecv")
+	if err != nil {
+		slog.Error("Failed to marshal SDP answer",
+			"event", "sdp_marshal_error",
+			"session", callID,
+			"error", err.Error())
+		resp := sip.NewResponseFromRequest(req, sip.StatusInternalServerError, "Internal Server Error", nil)
+		s.logSentMessage(resp)
+		if err := tx.Respond(resp); err != nil {
+			slog.Error("Failed to send error response",
+				"event", "sip_response_error",
+				"error", err.Error())
+		}
+		return
+	}
+	sdpAnswer := string(sdpBytes)
+
+	slog.Info("Generated SDP answer",
+		"event", "sdp_answer_generated",
+		"session", callID,
+		"codec", session.selectedCodec,
+		"sdp", sdpAnswer)
+
+	// Create 200 OK response with SDP body
+	resp := sip.NewResponseFromRequest(req, sip.StatusOK, "OK", []byte(sdpAnswer))
+
+	// Add Content-Type header for SDP
+	contentType := sip.ContentTypeHeader("application/sdp")
+	resp.AppendHeader(&contentType)
+
+	// Add Contact header using the To header as template
+	if contact := req.Contact(); contact != nil {
+		resp.AppendHeader(contact)
+	}
+
+	// Keep the dialog-forming INVITE and its answer so we can send in-dialog requests (BYE)
+	session.inviteRequest = req
+	session.inviteResponse = resp
+
+	// Send response
+	s.logSentMessage(resp)
+	if err := tx.Respond(resp); err != nil {
+		slog.Error("Failed to send 200 OK",
+			"event", "sip_response_error",
+			"error", err.Error())
+	}
+
+	// Play the intro and connect the AI now that the call is answered
+	go s.startSessionMedia(session, sessionConfig)
+}
+
+// startSessionMedia runs once the call is answered. It plays the intro prompt
+// (if any) to completion, then connects the AI, looping the wait prompt (if
+// any) until the connection is up. The AI only starts hearing the caller once
+// it is connected, so it never talks over the intro.
+func (s *SIPServer) startSessionMedia(session *Session, sessionConfig *SessionConfig) {
+	waitAudio := s.config.WaitAudio
+	if sessionConfig.WaitAudio != "" {
+		waitAudio = sessionConfig.WaitAudio
+	}
+
+	if sessionConfig.IntroAudio != "" {
+		// Avoid losing the start of the intro before the far end's media is latched
+		session.waitForRemoteMedia(promptMediaWait)
+
+		done, err := session.promptPlayer.Play(sessionConfig.IntroAudio, false, false)
+		if err != nil {
+			slog.Error("Failed to play intro prompt",
+				"event", "prompt_intro_error",
+				"session", session.CallID,
+				"source", sessionConfig.IntroAudio,
+				"error", err.Error())
+		} else {
+			select {
+			case <-done:
+			case <-session.stopRTP:
+				return
+			}
+		}
+	}
+
+	connected := make(chan error, 1)
+	go func() {
+		connected <- session.MediaHandler.Start()
+	}()
+
+	var err error
+	select {
+	case err = <-connected:
+	case <-time.After(promptWaitDelay):
+		// Connecting is taking noticeable time, keep the caller company
+		if waitAudio != "" {
+			if _, playErr := session.promptPlayer.Play(waitAudio, true, false); playErr != nil {
+				slog.Error("Failed to play wait prompt",
+					"event", "prompt_wait_error",
+					"session", session.CallID,
+					"source", waitAudio,
+					"error", playErr.Error())
+			}
+		}
+		err = <-connected
+		session.promptPlayer.Stop()
+	}
+
+	if err == nil {
+		// Open the conversation once the caller can hear it
+		session.waitForRemoteMedia(promptMediaWait)
+		select {
+		case <-session.stopRTP:
+			return
+		default:
+		}
+		if err := session.MediaHandler.Open(); err != nil {
+			slog.Error("Failed to open the conversation",
+				"event", "opening_error",
+				"session", session.CallID,
+				"error", err.Error())
+		}
+		if session.extraction != nil {
+			session.extraction.startTimeouts()
+		}
+		return
+	}
+
+	select {
+	case <-session.stopRTP:
+		// The call ended while connecting
+		return
+	default:
+	}
+
+	slog.Error("Failed to start media handler, hanging up",
+		"event", "media_handler_start_error",
+		"session", session.CallID,
+		"error", err.Error())
+	s.hangupSession(session, "media_handler_error", `SIP;cause=503;text="AI unavailable"`)
+}
+
+// waitForRemoteMedia waits until the far end's RTP address is known, the
+// session ends or timeout elapses
+func (s *Session) waitForRemoteMedia(timeout time.Duration) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(rtpFrameDuration)
+	defer ticker.Stop()
+
+	for s.getRemoteRTPAddr() == nil {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		case <-s.stopRTP:
+			return
+		}
+	}
+}
+
+// getSession returns the active session for a Call-ID, or nil
+func (s *SIPServer) getSession(callID string) *Session {
+	s.sessionsMux.RLock()
+	defer s.sessionsMux.RUnlock()
+	return s.sessions[callID]
+}
+
+// buildSDPAnswer generates the SDP answer for a session with the given media direction
+// attribute. The codec is selected on the first call and kept for re-INVITEs.
+func buildSDPAnswer(session *Session, direction string) ([]byte, error) {
 	sessionID := time.Now().Unix()
 	sessionVersion := sessionID
 	rtpPort := session.RTPPort
@@ -687,7 +1320,7 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 			Formats: []string{}, // Will be populated below
 		},
 		Attributes: []sdp.Attribute{
-			{Key: "sendrecv"},
+			{Key: direction},
 		},
 	}
 
@@ -695,7 +1328,9 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 	if session.supportsPCMU {
 		formats = append(formats, "0")
 		mediaDesc = mediaDesc.WithCodec(0, "PCMU", 8000, 1, "")
-		session.selectedCodec = "PCMU"
+		if session.selectedCodec == "" {
+			session.selectedCodec = "PCMU"
+		}
 	}
 	if session.supportsPCMA {
 		formats = append(formats, "8")
@@ -712,15 +1347,61 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 		session.selectedCodec = "PCMU"
 	}
 
+	// Offer DTMF back if the far end supports it
+	if session.dtmfPayloadType != 0 {
+		formats = append(formats, fmt.Sprintf("%d", session.dtmfPayloadType))
+		mediaDesc = mediaDesc.WithCodec(session.dtmfPayloadType, "telephone-event", 8000, 0, "0-16")
+	}
+
 	mediaDesc.MediaName.Formats = formats
 	sd.MediaDescriptions = []*sdp.MediaDescription{mediaDesc}
 
 	// Marshal to SDP string
-	sdpBytes, err := sd.Marshal()
+	return sd.Marshal()
+}
+
+// handleReInvite processes an in-dialog INVITE for an existing session, typically
+// used by the far end to put the call on hold or take it off hold
+func (s *SIPServer) handleReInvite(session *Session, req *sip.Request, tx sip.ServerTransaction) {
+	slog.Info("Received re-INVITE",
+		"event", "reinvite_received",
+		"session", session.CallID)
+
+	// Without an SDP offer the media state is unchanged
+	onHold := session.IsOnHold()
+	remoteDirection := "sendrecv"
+	if req.Body() != nil && len(req.Body()) > 0 {
+		remoteDirection = parseSDPDirection(string(req.Body()))
+		onHold = remoteDirection == "sendonly" || remoteDirection == "inactive"
+		session.SetOnHold(onHold)
+
+		// The far end may have moved its media, e.g. after a carrier switchover
+		if addr := parseSDPMediaAddress(string(req.Body())); addr != nil {
+			session.rtpLatch.setExpected(addr)
+		}
+	}
+
+	// Mirror the offered direction in the answer
+	direction := "sendrecv"
+	switch remoteDirection {
+	case "sendonly":
+		direction = "recvonly"
+	case "recvonly":
+		direction = "sendonly"
+	case "inactive":
+		direction = "inactive"
+	}
+
+	slog.Info("Session hold state updated",
+		"event", "session_hold_state",
+		"session", session.CallID,
+		"on_hold", onHold)
+
+	sdpBytes, err := buildSDPAnswer(session, direction)
 	if err != nil {
 		slog.Error("Failed to marshal SDP answer",
 			"event", "sdp_marshal_error",
-			"session", callID,
+			"session", session.CallID,
 			"error", err.Error())
 		resp := sip.NewResponseFromRequest(req, sip.StatusInternalServerError, "Internal Server Error", nil)
 		s.logSentMessage(resp)
@@ -731,27 +1412,11 @@ func (s *SIPServer) handleInvite(req *sip.Request, tx sip.ServerTransaction) {
 		}
 		return
 	}
-	sdpAnswer := string(sdpBytes)
-
-	slog.Info("Generated SDP answer",
-		"event", "sdp_answer_generated",
-		"session", callID,
-		"codec", session.selectedCodec,
-		"sdp", sdpAnswer)
 
-	// Create 200 OK response with SDP body
-	resp := sip.NewResponseFromRequest(req, sip.StatusOK, "OK", []byte(sdpAnswer))
-
-	// Add Content-Type header for SDP
+	resp := sip.NewResponseFromRequest(req, sip.StatusOK, "OK", sdpBytes)
 	contentType := sip.ContentTypeHeader("application/sdp")
 	resp.AppendHeader(&contentType)
 
-	// Add Contact header using the To header as template
-	if contact := req.Contact(); contact != nil {
-		resp.AppendHeader(contact)
-	}
-
-	// Send response
 	s.logSentMessage(resp)
 	if err := tx.Respond(resp); err != nil {
 		slog.Error("Failed to send 200 OK",
@@ -768,16 +1433,15 @@ func (s *SIPServer) handleBye(req *sip.Request, tx sip.ServerTransaction) {
 
 	// Remove session and cleanup resources
 	callID := req.CallID().Value()
-	s.sessionsMux.Lock()
-	if session, exists := s.sessions[callID]; exists {
-		s.cleanupSession(session)
-		delete(s.sessions, callID)
-		slog.Info("Removed session",
-			"event", "session_removed",
-			"call_id", callID,
-			"total_sessions", len(s.sessions))
+	s.sessionsMux.RLock()
+	session, exists := s.sessions[callID]
+	s.sessionsMux.RUnlock()
+	if exists {
+		s.endSession(session, "remote_bye")
+	} else if err := s.dialogClient.ReadBye(req, tx); err == nil {
+		// The target of a transfer hung up; ReadBye has answered it
+		return
 	}
-	s.sessionsMux.Unlock()
 
 	resp := sip.NewResponseFromRequest(req, sip.StatusOK, "OK", nil)
 	s.logSentMessage(resp)
@@ -814,19 +1478,22 @@ func (s *SIPServer) cleanupInactiveSessions() {
 			now := time.Now()
 			timeout := 5 * time.Minute
 
-			s.sessionsMux.Lock()
-			for callID, session := range s.sessions {
+			var expired []*Session
+			s.sessionsMux.RLock()
+			for _, session := range s.sessions {
 				if now.Sub(session.LastActivity) > timeout {
-					s.cleanupSession(session)
-					delete(s.sessions, callID)
-					slog.Info("Cleaned up inactive session",
-						"event", "session_cleanup",
-						"call_id", callID,
-						"inactive_duration", now.Sub(session.LastActivity).String(),
-						"total_sessions", len(s.sessions))
+					expired = append(expired, session)
 				}
 			}
-			s.sessionsMux.Unlock()
+			s.sessionsMux.RUnlock()
+
+			for _, session := range expired {
+				slog.Info("Cleaning up inactive session",
+					"event", "session_cleanup",
+					"call_id", session.CallID,
+					"inactive_duration", now.Sub(session.LastActivity).String())
+				s.endSession(session, "inactivity_timeout")
+			}
 
 		case <-s.stopCleanup:
 			slog.Info("Session cleanup goroutine stopped",
@@ -914,6 +1581,7 @@ func (s *SIPServer) startRTPListener(session *Session) error {
 // listenRTP reads RTP packets from UDP and broadcasts to other participants
 func (s *SIPServer) listenRTP(session *Session) {
 	buffer := make([]byte, 1500) // Standard MTU size for RTP packets
+	rejectedPackets := 0
 
 	slog.Info("Starting RTP packet reading",
 		"event", "rtp_listener_start",
@@ -933,6 +1601,17 @@ func (s *SIPServer) listenRTP(session *Session) {
 			session.rtpConn.SetReadDeadline(time.Now().Add(1 * time.Second))
 
 			n, remoteAddr, err := session.rtpConn.ReadFromUDP(buffer)
+
+			// Hang up if the far end has stopped sending media
+			if session.rtpTimedOut(s.config.RTPTimeout, time.Now()) {
+				slog.Warn("No RTP received within timeout, hanging up",
+					"event", "rtp_timeout",
+					"session", session.CallID,
+					"timeout", s.config.RTPTimeout.String())
+				s.hangupSession(session, "rtp_timeout", `SIP;cause=408;text="RTP timeout"`)
+				return
+			}
+
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					// Timeout is expected, continue to check stopRTP
@@ -948,20 +1627,8 @@ func (s *SIPServer) listenRTP(session *Session) {
 			if n > 0 {
 				now := time.Now()
 
-				// Store remote RTP address from first packet (for sending back)
-				if session.remoteRTPAddr == nil {
-					session.remoteRTPAddr = remoteAddr
-					slog.Info("Learned remote RTP address",
-						"event", "rtp_remote_addr",
-						"session", session.CallID,
-						"address", remoteAddr.String())
-				}
-
-				// Update last activity timestamp
-				session.LastActivity = now
-
 				// Extract RTP payload and determine codec
-				payloadType, rtpPayload, sequenceNumber, timestamp, err := extractRTPPayload(buffer[:n])
+				payloadType, rtpPayload, sequenceNumber, timestamp, ssrc, err := extractRTPPayload(buffer[:n])
 				if err != nil {
 					slog.Error("Error extracting RTP payload",
 						"event", "rtp_extract_error",
@@ -969,11 +1636,75 @@ func (s *SIPServer) listenRTP(session *Session) {
 						"error", err.Error())
 					continue
 				}
+
+				// Only accept media from the negotiated source (or one that has
+				// legitimately taken over from it)
+				accepted, newLatch := session.rtpLatch.accept(remoteAddr, ssrc, sequenceNumber, now)
+				if !accepted {
+					rejectedPackets++
+					if rejectedPackets == 1 || rejectedPackets%500 == 0 {
+						slog.Warn("Rejected RTP packet from unexpected source",
+							"event", "rtp_source_rejected",
+							"session", session.CallID,
+							"from", remoteAddr.String(),
+							"ssrc", ssrc,
+							"rejected_total", rejectedPackets)
+					}
+					continue
+				}
+				if newLatch != nil {
+					previous := session.getRemoteRTPAddr()
+					session.setRemoteRTPAddr(newLatch)
+					if previous == nil {
+						slog.Info("Learned remote RTP address",
+							"event", "rtp_remote_addr",
+							"session", session.CallID,
+							"address", newLatch.String())
+					} else {
+						// Either a NAT rebinding or a move to a re-INVITE's address
+						kind := "port"
+						if !previous.IP.Equal(newLatch.IP) {
+							kind = "address"
+						}
+						slog.Warn("Re-latched remote RTP address",
+							"event", "rtp_remote_relatch",
+							"session", session.CallID,
+							"previous", previous.String(),
+							"address", newLatch.String(),
+							"kind", kind)
+						metrics.Counter("sip_proxy_rtp_relatch_total",
+							"Incoming RTP sources that took over from the latched source, by whether the port or the address changed",
+							"kind", kind).Inc()
+					}
+				}
+
+				// Update last activity timestamp
+				session.LastActivity = now
+				session.markRTPReceived(now)
+
+				// Track sequence numbers so duplicates and late packets are dropped and
+				// a new SSRC or sequence restart resets the stream state
+				switch session.rtpRecvState.update(ssrc, sequenceNumber, timestamp, now) {
+				case rtpDuplicate, rtpProbation:
+					continue
+				case rtpRestarted:
+					slog.Info("RTP stream restarted",
+						"event", "rtp_stream_restart",
+						"session", session.CallID,
+						"ssrc", ssrc,
+						"seq", sequenceNumber)
+				}
+
 				if rtpPayload == nil || len(rtpPayload) == 0 {
 					// No payload, skip silently
 					continue
 				}
 
+				// Telephone-events from the far end are not audio
+				if session.dtmfPayloadType != 0 && payloadType == session.dtmfPayloadType {
+					continue
+				}
+
 				// Determine codec from payload type
 				var codec string
 				if payloadType == 0 {
@@ -993,8 +1724,10 @@ func (s *SIPServer) listenRTP(session *Session) {
 						"event", "rtp_recv",
 						"session", session.CallID,
 						"from", remoteAddr.String(),
+						"ssrc", ssrc,
 						"seq", sequenceNumber,
 						"timestamp", timestamp,
+						"jitter_ms", session.rtpRecvState.jitterMs(),
 						"payload_bytes", len(rtpPayload))
 				}
 
@@ -1007,10 +1740,22 @@ func (s *SIPServer) listenRTP(session *Session) {
 					continue
 				}
 
+				// Record the caller as received, before any processing
+				if session.recorder != nil {
+					session.recorder.WriteCaller(pcmData)
+				}
+
+				// Clean up the caller's audio before the AI hears it
+				if session.inputProcessor != nil {
+					session.inputProcessor.ProcessPCM(pcmData)
+				}
+
 				// Broadcast PCM data to all other participants (excluding this SIP sender)
 				chunk := &MediaChunk{
-					Data:     pcmData,
-					SenderID: session.SIPParticipant.ID(),
+					Data:      pcmData,
+					SenderID:  session.SIPParticipant.ID(),
+					Format:    DefaultMediaFormat,
+					Timestamp: session.rtpRecvState.mediaTime(timestamp),
 				}
 
 				if err := session.MediaBridge.Broadcast(chunk); err != nil {
@@ -1024,6 +1769,145 @@ func (s *SIPServer) listenRTP(session *Session) {
 	}
 }
 
+// endSession removes a session from the session table, releases its resources and
+// reports why it ended. Only the first call for a given session has any effect.
+func (s *SIPServer) endSession(session *Session, reason string) {
+	s.sessionsMux.Lock()
+	current, exists := s.sessions[session.CallID]
+	if !exists || current != session {
+		s.sessionsMux.Unlock()
+		return
+	}
+	delete(s.sessions, session.CallID)
+	totalSessions := len(s.sessions)
+	s.sessionsMux.Unlock()
+
+	session.EndReason = reason
+	session.EndedAt = time.Now()
+
+	s.cleanupSession(session)
+	s.accountUsage(session)
+
+	slog.Info("Removed session",
+		"event", "session_removed",
+		"call_id", session.CallID,
+		"end_reason", reason,
+		"duration", session.EndedAt.Sub(session.CreatedAt).String(),
+		"total_sessions", totalSessions)
+
+	go s.notifyCallEnded(session)
+}
+
+// hangupSession terminates a call from our side: it sends a BYE carrying the
+// given Reason header value (RFC 3326) and then ends the session
+func (s *SIPServer) hangupSession(session *Session, reason string, reasonHeader string) {
+	if err := s.sendBye(session, reasonHeader); err != nil {
+		slog.Error("Failed to send BYE",
+			"event", "bye_send_error",
+			"session", session.CallID,
+			"error", err.Error())
+	}
+	s.endSession(session, reason)
+}
+
+// sendBye sends an in-dialog BYE to the far end and waits for the final response
+func (s *SIPServer) sendBye(session *Session, reasonHeader string) error {
+	bye, err := s.newInDialogRequest(session, sip.BYE)
+	if err != nil {
+		return err
+	}
+	if reasonHeader != "" {
+		bye.AppendHeader(sip.NewHeader("Reason", reasonHeader))
+	}
+
+	resp, err := s.sendInDialogRequest(session, bye)
+	if err != nil {
+		return err
+	}
+	slog.Info("BYE answered",
+		"event", "bye_response",
+		"session", session.CallID,
+		"status_code", resp.StatusCode)
+	return nil
+}
+
+// newInDialogRequest builds a request within the session's dialog, e.g. BYE or REFER
+func (s *SIPServer) newInDialogRequest(session *Session, method sip.RequestMethod) (*sip.Request, error) {
+	req := session.inviteRequest
+	res := session.inviteResponse
+	if req == nil || res == nil {
+		return nil, fmt.Errorf("no confirmed dialog for session %s", session.CallID)
+	}
+
+	contact := req.Contact()
+	if contact == nil {
+		return nil, fmt.Errorf("INVITE has no Contact header")
+	}
+
+	// Reverse From and To from our 200 OK, which carries our To tag
+	request := sip.NewRequest(method, contact.Address)
+	from := res.From()
+	to := res.To()
+	request.AppendHeader(&sip.FromHeader{
+		DisplayName: to.DisplayName,
+		Address:     to.Address,
+		Params:      to.Params,
+	})
+	request.AppendHeader(&sip.ToHeader{
+		DisplayName: from.DisplayName,
+		Address:     from.Address,
+		Params:      from.Params,
+	})
+	request.AppendHeader(res.CallID())
+
+	// BYE may race with a REFER sent by a tool call
+	seqNo := atomic.AddUint32(&session.localCSeq, 1)
+	request.AppendHeader(&sip.CSeqHeader{SeqNo: seqNo, MethodName: method})
+
+	// Route through any proxies that recorded themselves on the INVITE
+	for _, recordRoute := range req.GetHeaders("Record-Route") {
+		request.AppendHeader(sip.NewHeader("Route", recordRoute.Value()))
+	}
+	if route := request.Route(); route != nil {
+		request.SetDestination(route.Address.HostPort())
+	} else {
+		request.SetDestination(req.Source())
+	}
+
+	return request, nil
+}
+
+// sendInDialogRequest sends a request built by newInDialogRequest and waits
+// for its final response
+func (s *SIPServer) sendInDialogRequest(session *Session, req *sip.Request) (*sip.Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s.logSentMessage(req)
+	tx, err := s.client.TransactionRequest(ctx, req, sipgo.ClientRequestBuild)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %s: %w", req.Method, err)
+	}
+	defer tx.Terminate()
+
+	for {
+		select {
+		case resp := <-tx.Responses():
+			if resp.IsProvisional() {
+				continue
+			}
+			return resp, nil
+		case <-tx.Done():
+			if err := tx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%s transaction ended without a response", req.Method)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 // cleanupSession closes all resources associated with a session
 func (s *SIPServer) cleanupSession(session *Session) {
 	// Stop RTP packet sender
@@ -1045,10 +1929,30 @@ func (s *SIPServer) cleanupSession(session *Session) {
 			"session", session.CallID)
 	}
 
+	session.closeWebRTCParticipants()
+	if leg := session.getTransferLeg(); leg != nil {
+		leg.Close(s)
+	}
+	if session.mediaFork != nil {
+		session.mediaFork.Close()
+	}
 	if session.MediaBridge != nil {
 		session.MediaBridge.Stop()
 	}
 	if session.MediaHandler != nil {
 		session.MediaHandler.Close()
 	}
+
+	// Finalize the recording once no more media will be written. Uploading
+	// the tail of the recording can take a while, so don't block teardown.
+	if session.recorder != nil {
+		go func(recorder *CallRecorder) {
+			if err := recorder.Close(); err != nil {
+				slog.Error("Failed to finalize call recording",
+					"event", "recording_close_error",
+					"session", session.CallID,
+					"error", err.Error())
+			}
+		}(session.recorder)
+	}
 }
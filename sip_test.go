@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSIPRTPWriterCarriesPartialFrames(t *testing.T) {
+	session := &Session{CallID: "test", rtpPacketQueue: make(chan []byte, 16)}
+	writer := &SIPRTPWriter{session: session}
+	session.rtpWriter = writer
+
+	// 2.5 frames of a ramp, written in chunks that do not line up with frames
+	audio := make([]byte, rtpFrameBytes*5/2)
+	for i := range audio {
+		audio[i] = byte(i%251 + 1)
+	}
+	for _, size := range []int{100, 300, 7, 393} {
+		if _, err := writer.Write(audio[:size]); err != nil {
+			t.Fatal(err)
+		}
+		audio = audio[size:]
+	}
+
+	var sent []byte
+	for len(session.rtpPacketQueue) > 0 {
+		frame := <-session.rtpPacketQueue
+		if len(frame) != rtpFrameBytes {
+			t.Fatalf("queued frame of %d bytes, want %d", len(frame), rtpFrameBytes)
+		}
+		sent = append(sent, frame...)
+	}
+	if len(sent) != 2*rtpFrameBytes {
+		t.Fatalf("queued %d bytes, want %d", len(sent), 2*rtpFrameBytes)
+	}
+
+	if writer.takeRemainder() != nil {
+		t.Fatal("remainder taken on the first tick without audio")
+	}
+	remainder := writer.takeRemainder()
+	if len(remainder) != rtpFrameBytes/2 {
+		t.Fatalf("remainder of %d bytes, want %d", len(remainder), rtpFrameBytes/2)
+	}
+	sent = append(sent, remainder...)
+	for i, b := range sent {
+		if want := byte(i%251 + 1); b != want {
+			t.Fatalf("byte %d is %d, want %d: audio was padded or reordered", i, b, want)
+		}
+	}
+	if writer.takeRemainder() != nil {
+		t.Fatal("remainder returned twice")
+	}
+}
+
+func TestSIPRTPWriterHoldsPartialFrameForLateAudio(t *testing.T) {
+	session := &Session{CallID: "test", rtpPacketQueue: make(chan []byte, 16)}
+	writer := &SIPRTPWriter{session: session}
+	session.rtpWriter = writer
+
+	// The queue runs dry for a tick after half a frame, then the rest arrives
+	writer.Write(bytes.Repeat([]byte{1}, rtpFrameBytes/2))
+	for tick := 1; tick < rtpPartialTicks; tick++ {
+		if remainder := writer.takeRemainder(); remainder != nil {
+			t.Fatalf("remainder of %d bytes padded on tick %d", len(remainder), tick)
+		}
+	}
+	writer.Write(bytes.Repeat([]byte{2}, rtpFrameBytes/2))
+
+	want := append(bytes.Repeat([]byte{1}, rtpFrameBytes/2), bytes.Repeat([]byte{2}, rtpFrameBytes/2)...)
+	if len(session.rtpPacketQueue) != 1 || !bytes.Equal(<-session.rtpPacketQueue, want) {
+		t.Fatal("late audio did not complete the held partial frame")
+	}
+
+	// A Write restarts the wait, so a new tail is held again
+	writer.Write(bytes.Repeat([]byte{3}, 10))
+	for tick := 1; tick < rtpPartialTicks; tick++ {
+		if writer.takeRemainder() != nil {
+			t.Fatalf("tail padded on tick %d", tick)
+		}
+	}
+	if remainder := writer.takeRemainder(); !bytes.Equal(remainder, bytes.Repeat([]byte{3}, 10)) {
+		t.Fatalf("tail %v after %d ticks, want the last Write's 10 bytes", remainder, rtpPartialTicks)
+	}
+}
+
+func TestFlushQueueDropsPartialFrame(t *testing.T) {
+	session := &Session{CallID: "test", rtpPacketQueue: make(chan []byte, 16)}
+	writer := &SIPRTPWriter{session: session}
+	session.rtpWriter = writer
+
+	writer.Write(make([]byte, rtpFrameBytes+10))
+	session.FlushQueue()
+
+	if len(session.rtpPacketQueue) != 0 {
+		t.Fatal("queue not flushed")
+	}
+	if remainder := writer.takeRemainder(); remainder != nil {
+		t.Fatalf("remainder of %d bytes survived the flush", len(remainder))
+	}
+
+	// The next utterance starts on a frame boundary
+	writer.Write(bytes.Repeat([]byte{1}, rtpFrameBytes))
+	if frame := <-session.rtpPacketQueue; !bytes.Equal(frame, bytes.Repeat([]byte{1}, rtpFrameBytes)) {
+		t.Fatal("next utterance does not start on a frame boundary")
+	}
+}
+
+func TestRTPTimedOut(t *testing.T) {
+	const timeout = 30 * time.Second
+	start := time.Now()
+	session := &Session{CallID: "test"}
+	session.markRTPReceived(start)
+
+	if session.rtpTimedOut(timeout, start.Add(timeout)) {
+		t.Fatal("timed out at exactly the timeout")
+	}
+	if !session.rtpTimedOut(timeout, start.Add(timeout+time.Second)) {
+		t.Fatal("not timed out after the timeout")
+	}
+	if session.rtpTimedOut(0, start.Add(time.Hour)) {
+		t.Fatal("timed out with the check disabled")
+	}
+
+	// No media is expected while on hold
+	session.SetOnHold(true)
+	if session.rtpTimedOut(timeout, start.Add(time.Hour)) {
+		t.Fatal("timed out while on hold")
+	}
+
+	// Leaving hold gives the far end a full timeout to resume media
+	session.SetOnHold(false)
+	resumed := time.Now()
+	if session.rtpTimedOut(timeout, resumed.Add(timeout-time.Second)) {
+		t.Fatal("timed out before a full timeout after unhold")
+	}
+	if !session.rtpTimedOut(timeout, resumed.Add(timeout+time.Second)) {
+		t.Fatal("not timed out a full timeout after unhold")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage persists recordings and other call artifacts
+type Storage interface {
+	// NewUpload starts a streaming upload that is written while the call is in progress
+	NewUpload(key string, contentType string) (Upload, error)
+
+	// Put stores a small object in one request
+	Put(key string, contentType string, data []byte) error
+
+	// Close stops any background work (e.g. retrying spooled uploads)
+	Close() error
+}
+
+// Upload is an object being written incrementally. WriteAt may rewrite bytes
+// that were already written (e.g. to patch a WAV header), and Close completes
+// the object.
+type Upload interface {
+	io.Writer
+	io.WriterAt
+	Close() error
+}
+
+// StorageConfig selects and configures the storage backend
+type StorageConfig struct {
+	Backend     string // "local" or "s3"
+	LocalDir    string
+	KeyTemplate string // e.g. "{date}/{did}/{call_id}"
+	SpoolDir    string // Local copy of in-flight uploads, kept when an upload fails
+	S3          S3Config
+}
+
+// NewStorage creates the configured storage backend
+func NewStorage(config StorageConfig) (Storage, error) {
+	switch config.Backend {
+	case "", "local":
+		return NewLocalStorage(config.LocalDir), nil
+	case "s3":
+		return NewS3Storage(config.S3, config.SpoolDir)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
+	}
+}
+
+// recordingKey expands a key template for a session. Supported placeholders:
+// {date} (YYYY/MM/DD), {year}, {month}, {day}, {did} (the dialed number from
+// the To URI), {from} (the caller's user part) and {call_id}.
+func recordingKey(template string, session *Session) string {
+	if template == "" {
+		template = "{call_id}"
+	}
+
+	start := session.CreatedAt.UTC()
+	replacer := strings.NewReplacer(
+		"{date}", start.Format("2006/01/02"),
+		"{year}", start.Format("2006"),
+		"{month}", start.Format("01"),
+		"{day}", start.Format("02"),
+		"{did}", safeKeyComponent(sipUser(session.To)),
+		"{from}", safeKeyComponent(sipUser(session.From)),
+		"{call_id}", safeKeyComponent(session.CallID),
+	)
+	return replacer.Replace(template)
+}
+
+// sipUser extracts the user part of a SIP URI, e.g. "+15551234567" from
+// "sip:+15551234567@example.com"
+func sipUser(uri string) string {
+	user := strings.TrimPrefix(strings.TrimPrefix(uri, "sips:"), "sip:")
+	if i := strings.IndexAny(user, "@;>"); i >= 0 {
+		user = user[:i]
+	}
+	if user == "" {
+		return "unknown"
+	}
+	return user
+}
+
+// safeKeyComponent makes a value safe to use as one segment of a storage key
+func safeKeyComponent(value string) string {
+	return unsafeFileChars.ReplaceAllString(strings.TrimPrefix(value, "+"), "_")
+}
+
+// withRetry runs fn up to attempts times with exponential backoff
+func withRetry(attempts int, operation string, fn func() error) error {
+	var err error
+	backoff := 500 * time.Millisecond
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt < attempts {
+			slog.Warn("Storage operation failed, retrying",
+				"event", "storage_retry",
+				"operation", operation,
+				"attempt", attempt,
+				"error", err.Error())
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// LocalStorage writes objects below a directory on the local filesystem
+type LocalStorage struct {
+	dir string
+}
+
+// NewLocalStorage creates a filesystem backend rooted at dir
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{dir: dir}
+}
+
+// NewUpload creates the object as a ".part" file that is renamed into place on Close
+func (l *LocalStorage) NewUpload(key string, contentType string) (Upload, error) {
+	path := filepath.Join(l.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file, err := os.Create(path + ".part")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	return &localUpload{file: file, path: path}, nil
+}
+
+// Put writes a complete object
+func (l *LocalStorage) Put(key string, contentType string, data []byte) error {
+	path := filepath.Join(l.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// Close is a no-op for the local backend
+func (l *LocalStorage) Close() error {
+	return nil
+}
+
+// localUpload is an object being written to the local filesystem
+type localUpload struct {
+	file *os.File
+	path string
+}
+
+// Write appends to the object
+func (u *localUpload) Write(p []byte) (int, error) {
+	return u.file.Write(p)
+}
+
+// WriteAt rewrites part of the object
+func (u *localUpload) WriteAt(p []byte, off int64) (int, error) {
+	return u.file.WriteAt(p, off)
+}
+
+// Close moves the finished object into place
+func (u *localUpload) Close() error {
+	if err := u.file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(u.file.Name(), u.path)
+}
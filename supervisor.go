@@ -0,0 +1,66 @@
+package main
+
+import "fmt"
+
+// Supervisor roles for humans joined to a call
+const (
+	RoleListen  = "listen"  // Hears both sides, heard by nobody
+	RoleWhisper = "whisper" // Hears both sides, heard only by the whisper target
+	RoleBarge   = "barge"   // Full three-way call: heard by everyone
+)
+
+// Whisper targets
+const (
+	WhisperTargetAI     = "ai"
+	WhisperTargetCaller = "caller"
+)
+
+// SupervisorRole is how a human participant's audio is routed
+type SupervisorRole struct {
+	Role   string `json:"role,omitempty"`   // RoleListen (default), RoleWhisper or RoleBarge
+	Target string `json:"target,omitempty"` // Whisper target: WhisperTargetAI or WhisperTargetCaller
+}
+
+// normalize fills in the default role and validates the combination
+func (r SupervisorRole) normalize() (SupervisorRole, error) {
+	switch r.Role {
+	case "":
+		r.Role = RoleListen
+		fallthrough
+	case RoleListen, RoleBarge:
+		if r.Target != "" {
+			return r, fmt.Errorf("target only applies to the %q role", RoleWhisper)
+		}
+	case RoleWhisper:
+		if r.Target != WhisperTargetAI && r.Target != WhisperTargetCaller {
+			return r, fmt.Errorf("whisper target must be %q or %q", WhisperTargetAI, WhisperTargetCaller)
+		}
+	default:
+		return r, fmt.Errorf("unknown role %q (want %q, %q or %q)", r.Role, RoleListen, RoleWhisper, RoleBarge)
+	}
+	return r, nil
+}
+
+// audience returns the participants of session that hear someone in this
+// role: nobody, one side of the call, or everyone (nil)
+func (r SupervisorRole) audience(session *Session) []string {
+	switch r.Role {
+	case RoleBarge:
+		return nil
+	case RoleWhisper:
+		if r.Target == WhisperTargetCaller {
+			return []string{session.SIPParticipant.ID()}
+		}
+		return []string{session.MediaHandler.ParticipantID()}
+	default:
+		return []string{}
+	}
+}
+
+// String renders the role as e.g. "whisper:caller"
+func (r SupervisorRole) String() string {
+	if r.Target == "" {
+		return r.Role
+	}
+	return r.Role + ":" + r.Target
+}
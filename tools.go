@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+const (
+	// defaultToolTimeout bounds a tool webhook request
+	defaultToolTimeout = 10 * time.Second
+	// maxToolResponseBytes bounds the tool webhook response body
+	maxToolResponseBytes = 1 << 20
+)
+
+// Tool call results, for metrics and logs
+const (
+	toolResultOK        = "ok"
+	toolResultError     = "error"
+	toolResultTimeout   = "timeout"
+	toolResultCancelled = "cancelled"
+)
+
+// ToolDeclaration declares a function the AI may call during the call
+type ToolDeclaration struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"` // JSON schema of the arguments
+}
+
+// ToolConfig holds the server-wide tool webhook settings
+type ToolConfig struct {
+	WebhookURL string        // Receives tool calls, unless the session config overrides it
+	Timeout    time.Duration // Per tool call
+}
+
+// builtinTool is a tool executed inside the proxy instead of through the webhook
+type builtinTool struct {
+	run     func(ctx context.Context, args map[string]any) (map[string]any, error)
+	timeout time.Duration // Replaces the webhook timeout
+}
+
+// toolCallIDKey is the context key of the ID of the tool call being executed
+type toolCallIDKey struct{}
+
+// toolCallID returns the ID of the tool call a built-in tool is executing
+func toolCallID(ctx context.Context) string {
+	id, _ := ctx.Value(toolCallIDKey{}).(string)
+	return id
+}
+
+// ToolCallPayload is POSTed to the tool webhook when the AI calls a tool
+type ToolCallPayload struct {
+	CallID string         `json:"call_id"`
+	ID     string         `json:"id"`
+	Name   string         `json:"name"`
+	Args   map[string]any `json:"args"`
+}
+
+// ToolDispatcher executes the AI's tool calls for one call, either in the
+// proxy (built-in tools) or by posting them to the tool webhook. Calls run
+// concurrently; each can be cancelled by the AI (when the caller interrupts
+// the turn that made it) or by Close.
+type ToolDispatcher struct {
+	callID       string
+	url          string
+	timeout      time.Duration
+	declarations []*genai.FunctionDeclaration
+	builtins     map[string]builtinTool // By tool name
+	httpClient   *http.Client
+	pending      map[string]context.CancelFunc // By call ID
+	followUps    map[string]func()             // Cancel work built-in tools left running after returning, by call ID
+	closed       bool
+	wg           sync.WaitGroup
+	mu           sync.Mutex
+}
+
+// NewToolDispatcher creates a dispatcher for the declared webhook tools.
+// Invalid declarations are logged and skipped, as are all of them if there is
+// no webhook to execute them.
+func NewToolDispatcher(callID string, tools []ToolDeclaration, config ToolConfig, httpClient *http.Client) *ToolDispatcher {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultToolTimeout
+	}
+
+	d := &ToolDispatcher{
+		callID:     callID,
+		url:        config.WebhookURL,
+		timeout:    config.Timeout,
+		builtins:   make(map[string]builtinTool),
+		httpClient: httpClient,
+		pending:    make(map[string]context.CancelFunc),
+		followUps:  make(map[string]func()),
+	}
+
+	if len(tools) > 0 && config.WebhookURL == "" {
+		slog.Warn("Session declares tools but no tool webhook is configured, tools disabled",
+			"event", "tools_disabled",
+			"session", callID)
+		return d
+	}
+
+	seen := make(map[string]bool)
+	for _, tool := range tools {
+		declaration, err := tool.functionDeclaration()
+		if err == nil && seen[tool.Name] {
+			err = fmt.Errorf("duplicate tool name")
+		}
+		if err != nil {
+			slog.Error("Skipping invalid tool declaration",
+				"event", "tool_declaration_invalid",
+				"session", callID,
+				"tool", tool.Name,
+				"error", err.Error())
+			continue
+		}
+		seen[tool.Name] = true
+		d.declarations = append(d.declarations, declaration)
+	}
+
+	return d
+}
+
+// functionDeclaration converts the declaration for the Live API
+func (t ToolDeclaration) functionDeclaration() (*genai.FunctionDeclaration, error) {
+	if t.Name == "" {
+		return nil, fmt.Errorf("tool name is required")
+	}
+
+	declaration := &genai.FunctionDeclaration{
+		Name:        t.Name,
+		Description: t.Description,
+	}
+	if len(t.Parameters) > 0 {
+		var schema any
+		if err := json.Unmarshal(t.Parameters, &schema); err != nil {
+			return nil, fmt.Errorf("invalid parameters schema: %w", err)
+		}
+		declaration.ParametersJsonSchema = schema
+	}
+	return declaration, nil
+}
+
+// registerBuiltin adds a tool executed by the proxy, replacing any webhook
+// tool of the same name. Call before the AI connects.
+func (d *ToolDispatcher) registerBuiltin(declaration *genai.FunctionDeclaration, run builtinTool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, existing := range d.declarations {
+		if existing.Name == declaration.Name {
+			slog.Warn("Built-in tool replaces webhook tool of the same name",
+				"event", "tool_declaration_replaced",
+				"session", d.callID,
+				"tool", declaration.Name)
+			d.declarations = append(d.declarations[:i], d.declarations[i+1:]...)
+			break
+		}
+	}
+	d.declarations = append(d.declarations, declaration)
+	d.builtins[declaration.Name] = run
+}
+
+// Tools returns the declarations for the Live API setup, or nil if there are none
+func (d *ToolDispatcher) Tools() []*genai.Tool {
+	if len(d.declarations) == 0 {
+		return nil
+	}
+	return []*genai.Tool{{FunctionDeclarations: d.declarations}}
+}
+
+// Dispatch executes a tool call in the background and passes the result to
+// respond, unless the call is cancelled first
+func (d *ToolDispatcher) Dispatch(call *genai.FunctionCall, respond func(*genai.FunctionResponse)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	builtin, isBuiltin := d.builtins[call.Name]
+	timeout := d.timeout
+	if isBuiltin {
+		timeout = builtin.timeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), toolCallIDKey{}, call.ID), timeout)
+	d.pending[call.ID] = cancel
+	d.wg.Add(1)
+
+	go func() {
+		defer d.wg.Done()
+		defer d.finish(call.ID)
+
+		slog.Info("Executing tool call",
+			"event", "tool_call",
+			"session", d.callID,
+			"tool", call.Name,
+			"id", call.ID)
+
+		started := time.Now()
+		var response map[string]any
+		var err error
+		if isBuiltin {
+			response, err = builtin.run(ctx, call.Args)
+		} else {
+			response, err = d.post(ctx, call)
+		}
+
+		result := toolResultOK
+		switch {
+		case ctx.Err() == context.Canceled:
+			result = toolResultCancelled
+		case ctx.Err() == context.DeadlineExceeded:
+			result = toolResultTimeout
+			err = fmt.Errorf("tool timed out after %s", timeout)
+		case err != nil:
+			result = toolResultError
+		}
+		metrics.Counter("sip_proxy_tool_calls_total",
+			"Tool calls made by the AI, by result", "tool", call.Name, "result", result).Inc()
+
+		if result == toolResultCancelled {
+			slog.Info("Tool call cancelled",
+				"event", "tool_call_cancelled",
+				"session", d.callID,
+				"tool", call.Name,
+				"id", call.ID)
+			return
+		}
+
+		if err != nil {
+			slog.Error("Tool call failed",
+				"event", "tool_call_error",
+				"session", d.callID,
+				"tool", call.Name,
+				"id", call.ID,
+				"result", result,
+				"error", err.Error())
+			// Tell the model, so that it can let the caller know
+			response = map[string]any{"error": err.Error()}
+		} else {
+			slog.Info("Tool call completed",
+				"event", "tool_call_complete",
+				"session", d.callID,
+				"tool", call.Name,
+				"id", call.ID,
+				"duration_ms", time.Since(started).Milliseconds())
+		}
+
+		respond(&genai.FunctionResponse{
+			ID:       call.ID,
+			Name:     call.Name,
+			Response: response,
+		})
+	}()
+}
+
+// post sends a tool call to the webhook and returns its JSON result. A JSON
+// object is passed to the model as-is ("output" and "error" keys have their
+// usual meaning); any other JSON value becomes {"output": value}.
+func (d *ToolDispatcher) post(ctx context.Context, call *genai.FunctionCall) (map[string]any, error) {
+	payload := ToolCallPayload{
+		CallID: d.callID,
+		ID:     call.ID,
+		Name:   call.Name,
+		Args:   call.Args,
+	}
+	if d.url == "" {
+		return nil, fmt.Errorf("unknown tool %q", call.Name)
+	}
+
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("tool webhook returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxToolResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tool response: %w", err)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return map[string]any{}, nil
+	}
+
+	var result any
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("invalid tool response: %w", err)
+	}
+	if object, ok := result.(map[string]any); ok {
+		return object, nil
+	}
+	return map[string]any{"output": result}, nil
+}
+
+// finish forgets a call that has completed
+func (d *ToolDispatcher) finish(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if cancel, ok := d.pending[id]; ok {
+		cancel()
+		delete(d.pending, id)
+	}
+}
+
+// OnCancel registers cancel to be called if the AI cancels call id after
+// its tool has returned, for built-in tools whose effect happens later (e.g.
+// hanging up once the AI stops speaking). The returned release unregisters it
+// once the effect has happened.
+func (d *ToolDispatcher) OnCancel(id string, cancel func()) (release func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.followUps[id] = cancel
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.followUps, id)
+	}
+}
+
+// Cancel cancels the given calls; their results are never sent
+func (d *ToolDispatcher) Cancel(ids []string) {
+	d.mu.Lock()
+	var followUps []func()
+	for _, id := range ids {
+		if cancel, ok := d.pending[id]; ok {
+			cancel()
+		}
+		if cancel, ok := d.followUps[id]; ok {
+			followUps = append(followUps, cancel)
+			delete(d.followUps, id)
+		}
+	}
+	d.mu.Unlock()
+
+	// Outside the lock: they belong to the tools, which may call back in
+	for _, cancel := range followUps {
+		cancel()
+	}
+}
+
+// Close cancels all calls in progress and waits for them to finish
+func (d *ToolDispatcher) Close() {
+	d.mu.Lock()
+	d.closed = true
+	for _, cancel := range d.pending {
+		cancel()
+	}
+	d.mu.Unlock()
+
+	d.wg.Wait()
+}
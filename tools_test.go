@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// dispatchAndWait makes a tool call and returns its response, or nil if none
+// is sent within wait
+func dispatchAndWait(d *ToolDispatcher, call *genai.FunctionCall, wait time.Duration) *genai.FunctionResponse {
+	responses := make(chan *genai.FunctionResponse, 1)
+	d.Dispatch(call, func(response *genai.FunctionResponse) {
+		responses <- response
+	})
+	select {
+	case response := <-responses:
+		return response
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+func TestToolWebhookResults(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		delay   time.Duration
+		want    string // JSON of the response passed to the model
+		wantErr string // Substring of the error passed to the model instead
+	}{
+		{name: "object as-is", body: `{"output": {"balance": 42}}`, want: `{"output":{"balance":42}}`},
+		{name: "error object as-is", body: `{"error": "account locked"}`, want: `{"error":"account locked"}`},
+		{name: "array wrapped", body: `[1, 2]`, want: `{"output":[1,2]}`},
+		{name: "string wrapped", body: `"done"`, want: `{"output":"done"}`},
+		{name: "number wrapped", body: `7`, want: `{"output":7}`},
+		{name: "null wrapped", body: `null`, want: `{"output":null}`},
+		{name: "empty body", body: "", want: `{}`},
+		{name: "invalid JSON", body: `{"output":`, wantErr: "invalid tool response"},
+		{name: "error status", status: http.StatusBadGateway, body: `{}`, wantErr: "status 502"},
+		{name: "body over the limit", body: `"` + strings.Repeat("x", maxToolResponseBytes) + `"`, wantErr: "invalid tool response"},
+		{name: "timeout", body: `{}`, delay: time.Second, wantErr: "timed out"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var payload ToolCallPayload
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&payload)
+				select {
+				case <-time.After(test.delay):
+				case <-r.Context().Done():
+					return
+				}
+				if test.status != 0 {
+					w.WriteHeader(test.status)
+				}
+				fmt.Fprint(w, test.body)
+			}))
+			defer server.Close()
+
+			d := NewToolDispatcher("call-1", []ToolDeclaration{{Name: "lookup"}},
+				ToolConfig{WebhookURL: server.URL, Timeout: 200 * time.Millisecond}, server.Client())
+			defer d.Close()
+
+			call := &genai.FunctionCall{ID: "fc-1", Name: "lookup", Args: map[string]any{"account": "123"}}
+			response := dispatchAndWait(d, call, 2*time.Second)
+			if response == nil {
+				t.Fatal("no response")
+			}
+			if response.ID != "fc-1" || response.Name != "lookup" {
+				t.Fatalf("response for %s/%s, want fc-1/lookup", response.ID, response.Name)
+			}
+			if test.delay == 0 && (payload.CallID != "call-1" || payload.ID != "fc-1" || payload.Name != "lookup" || payload.Args["account"] != "123") {
+				t.Fatalf("webhook received %+v", payload)
+			}
+
+			if test.wantErr != "" {
+				message, _ := response.Response["error"].(string)
+				if !strings.Contains(message, test.wantErr) {
+					t.Fatalf("response %v, want an error containing %q", response.Response, test.wantErr)
+				}
+				return
+			}
+			got, _ := json.Marshal(response.Response)
+			if string(got) != test.want {
+				t.Fatalf("response %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestToolCallCancelled(t *testing.T) {
+	aborted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server notices the client going away only once the body is read
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer server.Close()
+
+	d := NewToolDispatcher("call-1", []ToolDeclaration{{Name: "lookup"}},
+		ToolConfig{WebhookURL: server.URL, Timeout: defaultToolTimeout}, server.Client())
+	defer d.Close()
+
+	responses := make(chan *genai.FunctionResponse, 1)
+	d.Dispatch(&genai.FunctionCall{ID: "fc-1", Name: "lookup"}, func(response *genai.FunctionResponse) {
+		responses <- response
+	})
+	time.Sleep(50 * time.Millisecond)
+	d.Cancel([]string{"fc-1"})
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("webhook request not aborted on cancel")
+	}
+	select {
+	case response := <-responses:
+		t.Fatalf("cancelled call responded with %v", response.Response)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestToolDispatcherWithoutWebhook(t *testing.T) {
+	d := NewToolDispatcher("call-1", []ToolDeclaration{{Name: "lookup"}}, ToolConfig{}, http.DefaultClient)
+	if d.Tools() != nil {
+		t.Fatal("webhook tools declared without a webhook")
+	}
+
+	response := dispatchAndWait(d, &genai.FunctionCall{ID: "fc-1", Name: "lookup"}, time.Second)
+	if response == nil || !strings.Contains(fmt.Sprint(response.Response["error"]), "unknown tool") {
+		t.Fatalf("call to an undeclared tool answered %v", response)
+	}
+}
+
+func TestToolDeclarationsValidated(t *testing.T) {
+	d := NewToolDispatcher("call-1", []ToolDeclaration{
+		{Name: "lookup", Parameters: json.RawMessage(`{"type": "object"}`)},
+		{Name: "lookup"},
+		{Name: ""},
+		{Name: "broken", Parameters: json.RawMessage(`{`)},
+	}, ToolConfig{WebhookURL: "http://127.0.0.1:1"}, http.DefaultClient)
+
+	tools := d.Tools()
+	if len(tools) != 1 || len(tools[0].FunctionDeclarations) != 1 || tools[0].FunctionDeclarations[0].Name != "lookup" {
+		t.Fatalf("declared %+v, want only the first lookup", tools)
+	}
+}
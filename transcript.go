@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transcript speakers
+const (
+	SpeakerCaller = "caller"
+	SpeakerAI     = "ai"
+)
+
+// TranscriptTurn is what one speaker said in one turn of the conversation
+type TranscriptTurn struct {
+	Speaker     string    `json:"speaker"`
+	Text        string    `json:"text"`
+	StartedAt   time.Time `json:"started_at"`            // When the first fragment was transcribed
+	EndedAt     time.Time `json:"ended_at"`              // When the last fragment was transcribed
+	Interrupted bool      `json:"interrupted,omitempty"` // The caller cut the AI off
+}
+
+// Transcript merges the partial transcription fragments of a call into
+// speaker-attributed turns. A speaker's turn stays open, collecting fragments,
+// until the model completes its turn or is interrupted, so that fragments of
+// both speakers may interleave without splitting turns.
+type Transcript struct {
+	turns  []TranscriptTurn
+	open   map[string]int // Index of each speaker's open turn
+	onTurn func(TranscriptTurn)
+	mu     sync.Mutex
+}
+
+// NewTranscript creates an empty transcript
+func NewTranscript() *Transcript {
+	return &Transcript{open: make(map[string]int)}
+}
+
+// OnTurn sets a function called with every turn once it is closed. It runs
+// on the goroutine that closes the turn and must not block.
+func (t *Transcript) OnTurn(onTurn func(TranscriptTurn)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onTurn = onTurn
+}
+
+// Add appends a transcription fragment of speaker, received at at
+func (t *Transcript) Add(speaker, fragment string, at time.Time) {
+	if fragment == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if i, ok := t.open[speaker]; ok {
+		t.turns[i].Text += fragment
+		t.turns[i].EndedAt = at
+		return
+	}
+
+	t.open[speaker] = len(t.turns)
+	t.turns = append(t.turns, TranscriptTurn{
+		Speaker:   speaker,
+		Text:      fragment,
+		StartedAt: at,
+		EndedAt:   at,
+	})
+}
+
+// EndTurn closes the open turns of both speakers, e.g. when the model
+// completes its turn. The next fragments start new turns.
+func (t *Transcript) EndTurn() {
+	t.mu.Lock()
+	var indexes []int
+	for speaker, i := range t.open {
+		indexes = append(indexes, i)
+		delete(t.open, speaker)
+	}
+	sort.Ints(indexes)
+	closed := make([]TranscriptTurn, 0, len(indexes))
+	for _, i := range indexes {
+		closed = append(closed, t.turns[i])
+	}
+	onTurn := t.onTurn
+	t.mu.Unlock()
+
+	t.notify(onTurn, closed...)
+}
+
+// Interrupt marks the AI's open turn as interrupted and closes it
+func (t *Transcript) Interrupt() {
+	t.mu.Lock()
+	var closed []TranscriptTurn
+	if i, ok := t.open[SpeakerAI]; ok {
+		t.turns[i].Interrupted = true
+		closed = append(closed, t.turns[i])
+		delete(t.open, SpeakerAI)
+	}
+	onTurn := t.onTurn
+	t.mu.Unlock()
+
+	t.notify(onTurn, closed...)
+}
+
+// notify passes closed turns with text to onTurn
+func (t *Transcript) notify(onTurn func(TranscriptTurn), turns ...TranscriptTurn) {
+	if onTurn == nil {
+		return
+	}
+	for _, turn := range turns {
+		if turn.Text = normalizeTranscript(turn.Text); turn.Text != "" {
+			onTurn(turn)
+		}
+	}
+}
+
+// Turns returns a copy of the turns so far, in the order they started
+func (t *Transcript) Turns() []TranscriptTurn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	turns := make([]TranscriptTurn, 0, len(t.turns))
+	for _, turn := range t.turns {
+		if turn.Text = normalizeTranscript(turn.Text); turn.Text != "" {
+			turns = append(turns, turn)
+		}
+	}
+	return turns
+}
+
+// normalizeTranscript collapses the whitespace between merged fragments
+func normalizeTranscript(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
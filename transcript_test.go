@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTranscriptMergesInterleavedFragments(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+
+	transcript := NewTranscript()
+	var closed []TranscriptTurn
+	transcript.OnTurn(func(turn TranscriptTurn) {
+		closed = append(closed, turn)
+	})
+
+	transcript.Add(SpeakerCaller, "I'd like ", at(0))
+	transcript.Add(SpeakerAI, "Sure, ", at(1))
+	transcript.Add(SpeakerCaller, " to book  a table", at(2))
+	transcript.Add(SpeakerAI, "for how many?", at(3))
+	transcript.Add(SpeakerAI, "", at(4))
+	if len(closed) != 0 {
+		t.Fatalf("turns closed before the model's turn completed: %+v", closed)
+	}
+	transcript.EndTurn()
+
+	transcript.Add(SpeakerAI, "Let me check", at(5))
+	transcript.Interrupt()
+	transcript.Add(SpeakerCaller, "Four", at(6))
+	transcript.Add(SpeakerAI, "  ", at(7))
+	transcript.EndTurn()
+
+	want := []TranscriptTurn{
+		{Speaker: SpeakerCaller, Text: "I'd like to book a table", StartedAt: at(0), EndedAt: at(2)},
+		{Speaker: SpeakerAI, Text: "Sure, for how many?", StartedAt: at(1), EndedAt: at(3)},
+		{Speaker: SpeakerAI, Text: "Let me check", StartedAt: at(5), EndedAt: at(5), Interrupted: true},
+		{Speaker: SpeakerCaller, Text: "Four", StartedAt: at(6), EndedAt: at(6)},
+	}
+	if got := transcript.Turns(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("turns %+v, want %+v", got, want)
+	}
+	// Turns are reported as they close; the whitespace-only AI turn is not
+	if !reflect.DeepEqual(closed, want) {
+		t.Fatalf("closed turns %+v, want %+v", closed, want)
+	}
+}
+
+func TestTranscriptInterruptWithoutAITurn(t *testing.T) {
+	transcript := NewTranscript()
+	var closed []TranscriptTurn
+	transcript.OnTurn(func(turn TranscriptTurn) {
+		closed = append(closed, turn)
+	})
+
+	transcript.Add(SpeakerCaller, "Hello", time.Now())
+	transcript.Interrupt()
+	if len(closed) != 0 {
+		t.Fatalf("interrupt closed %+v", closed)
+	}
+
+	// The caller's turn is still open and collects the next fragment
+	transcript.Add(SpeakerCaller, " there", time.Now())
+	transcript.EndTurn()
+	if len(closed) != 1 || closed[0].Text != "Hello there" {
+		t.Fatalf("closed turns %+v, want one caller turn", closed)
+	}
+}
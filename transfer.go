@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emiago/sipgo"
+	"github.com/emiago/sipgo/sip"
+	"github.com/pion/rtp"
+	sdp "github.com/pion/sdp/v3"
+)
+
+const (
+	// transferRingTimeout bounds how long the outbound leg of a transfer may ring
+	transferRingTimeout = 30 * time.Second
+	// referNotifyTimeout bounds how long we wait for the outcome of a REFER
+	referNotifyTimeout = 32 * time.Second
+)
+
+// transferTargetURI turns a transfer target into a SIP URI. SIP URIs are used
+// as-is; phone numbers (optionally as tel: URIs) are addressed to the host the
+// call came from, i.e. the carrier.
+func transferTargetURI(session *Session, target string) (sip.Uri, error) {
+	var uri sip.Uri
+	target = strings.TrimSpace(target)
+	if strings.HasPrefix(target, "sip:") || strings.HasPrefix(target, "sips:") {
+		if err := sip.ParseUri(target, &uri); err != nil {
+			return uri, fmt.Errorf("invalid transfer target %q: %w", target, err)
+		}
+		return uri, nil
+	}
+
+	number := strings.TrimPrefix(target, "tel:")
+	if number == "" || strings.Trim(number, "+0123456789") != "" {
+		return uri, fmt.Errorf("invalid transfer target %q (want a SIP URI or a phone number)", target)
+	}
+	return sip.Uri{User: number, Host: session.inviteRequest.From().Address.Host}, nil
+}
+
+// sendRefer asks the far end to call target (RFC 3515) and returns its final
+// response. The outcome of the new call is reported later in NOTIFYs.
+func (s *SIPServer) sendRefer(session *Session, target sip.Uri) (*sip.Response, error) {
+	refer, err := s.newInDialogRequest(session, sip.REFER)
+	if err != nil {
+		return nil, err
+	}
+	refer.AppendHeader(sip.NewHeader("Refer-To", "<"+target.String()+">"))
+	refer.AppendHeader(sip.NewHeader("Referred-By", "<"+session.inviteResponse.To().Address.String()+">"))
+	return s.sendInDialogRequest(session, refer)
+}
+
+// referUnsupported reports whether a REFER response means the far end does
+// not do transfers at all, as opposed to refusing this one
+func referUnsupported(res *sip.Response) bool {
+	switch res.StatusCode {
+	case sip.StatusMethodNotAllowed, sip.StatusNotImplemented, sip.StatusBadExtension:
+		return true
+	}
+	return false
+}
+
+// handleNotify processes NOTIFYs of the implicit subscription created by a
+// REFER. Their sipfrag body carries the status of the transferred call.
+func (s *SIPServer) handleNotify(req *sip.Request, tx sip.ServerTransaction) {
+	session := s.getSession(req.CallID().Value())
+
+	status := 0
+	body := strings.TrimSpace(string(req.Body()))
+	if _, err := fmt.Sscanf(body, "SIP/2.0 %d", &status); err != nil {
+		status = 0
+	}
+
+	res := sip.NewResponseFromRequest(req, sip.StatusOK, "OK", nil)
+	if session == nil {
+		res = sip.NewResponseFromRequest(req, sip.StatusCallTransactionDoesNotExists, "Call/Transaction Does Not Exist", nil)
+	}
+	s.logSentMessage(res)
+	if err := tx.Respond(res); err != nil {
+		slog.Error("Failed to send NOTIFY response",
+			"event", "sip_response_error",
+			"error", err.Error())
+	}
+	if session == nil {
+		return
+	}
+
+	slog.Info("Transfer progress",
+		"event", "call_transfer_progress",
+		"session", session.CallID,
+		"status_code", status)
+
+	if status >= 200 {
+		select {
+		case session.referStatus <- status:
+		default:
+		}
+	}
+}
+
+// awaitReferOutcome waits for the final status of the call placed by the far
+// end after an accepted REFER. On success our leg is no longer needed and is
+// hung up; on failure the call stays with the AI.
+func (s *SIPServer) awaitReferOutcome(session *Session, target sip.Uri) {
+	select {
+	case status := <-session.referStatus:
+		if status >= 300 {
+			slog.Warn("Transfer failed, keeping the call",
+				"event", "call_transfer_failed",
+				"session", session.CallID,
+				"target", target.String(),
+				"status_code", status)
+			return
+		}
+	case <-time.After(referNotifyTimeout):
+		// The far end accepted the REFER but never reported back; a blind
+		// transfer does not need to wait for it
+	case <-session.stopRTP:
+		return
+	}
+
+	slog.Info("Call transferred",
+		"event", "call_transferred",
+		"session", session.CallID,
+		"target", target.String())
+	if s.getSession(session.CallID) == session {
+		s.hangupSession(session, "transferred", "")
+	}
+}
+
+// TransferLeg is an outbound call placed by the proxy to transfer a caller
+// whose carrier does not support REFER. It joins the session's bridge in
+// place of the AI and relays G.711 audio between the caller and the target.
+type TransferLeg struct {
+	id           string
+	session      *Session
+	dialog       *sipgo.DialogClientSession
+	conn         *net.UDPConn
+	remote       *net.UDPAddr
+	codec        string
+	format       MediaFormat
+	recvState    *rtpReceiveState
+	rtpSequence  uint16
+	rtpTimestamp uint32
+	rtpSSRC      uint32
+	stop         chan struct{}
+	stopOnce     sync.Once
+	mu           sync.Mutex // Guards the RTP send state
+}
+
+// dialTransferLeg calls target and waits for it to answer
+func (s *SIPServer) dialTransferLeg(ctx context.Context, session *Session, target sip.Uri) (*TransferLeg, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create UDP listener: %w", err)
+	}
+
+	offer, err := buildSDPOffer(conn.LocalAddr().(*net.UDPAddr).Port)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Present the number that was called, so the target sees who is transferring
+	invite := sip.NewRequest(sip.INVITE, target)
+	invite.SetBody(offer)
+	contentType := sip.ContentTypeHeader("application/sdp")
+	invite.AppendHeader(&contentType)
+	fromParams := sip.NewParams()
+	fromParams.Add("tag", sip.GenerateTagN(16))
+	invite.AppendHeader(&sip.FromHeader{
+		Address: sip.Uri{User: session.inviteRequest.To().Address.User, Host: getPublicIP()},
+		Params:  fromParams,
+	})
+	if target.Host == session.inviteRequest.From().Address.Host {
+		// Phone numbers go back through the carrier
+		invite.SetDestination(session.inviteRequest.Source())
+	}
+
+	// The dialog outlives ctx, which only bounds ringing
+	s.logSentMessage(invite)
+	dialog, err := s.dialogClient.WriteInvite(context.Background(), invite)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send INVITE: %w", err)
+	}
+
+	ringCtx, cancel := context.WithTimeout(ctx, transferRingTimeout)
+	defer cancel()
+	if err := dialog.WaitAnswer(ringCtx, sipgo.AnswerOptions{}); err != nil {
+		dialog.Close()
+		conn.Close()
+		return nil, fmt.Errorf("transfer target did not answer: %w", err)
+	}
+	if err := dialog.Ack(context.Background()); err != nil {
+		dialog.Close()
+		conn.Close()
+		return nil, fmt.Errorf("failed to send ACK: %w", err)
+	}
+
+	answer := string(dialog.InviteResponse.Body())
+	remote := parseSDPMediaAddress(answer)
+	supportsPCMU, supportsPCMA := parseSDP(answer)
+	codec := "PCMU"
+	if !supportsPCMU && supportsPCMA {
+		codec = "PCMA"
+	}
+	if remote == nil {
+		s.byeTransferLeg(dialog)
+		conn.Close()
+		return nil, fmt.Errorf("transfer target answered without a media address")
+	}
+
+	format := MediaFormat{Encoding: EncodingPCMU, SampleRate: 8000, Channels: 1}
+	if codec == "PCMA" {
+		format.Encoding = EncodingPCMA
+	}
+
+	return &TransferLeg{
+		id:           "transfer-" + session.CallID,
+		session:      session,
+		dialog:       dialog,
+		conn:         conn,
+		remote:       remote,
+		codec:        codec,
+		format:       format,
+		recvState:    newRTPReceiveState(8000),
+		rtpSequence:  uint16(rand.Intn(65536)),
+		rtpTimestamp: rand.Uint32(),
+		rtpSSRC:      rand.Uint32(),
+		stop:         make(chan struct{}),
+	}, nil
+}
+
+// buildSDPOffer builds an SDP offer for G.711 audio on rtpPort
+func buildSDPOffer(rtpPort int) ([]byte, error) {
+	localIP := getPublicIP()
+	sessionID := uint64(time.Now().Unix())
+
+	media := &sdp.MediaDescription{
+		MediaName: sdp.MediaName{
+			Media:  "audio",
+			Port:   sdp.RangedPort{Value: rtpPort},
+			Protos: []string{"RTP", "AVP"},
+		},
+		Attributes: []sdp.Attribute{{Key: "sendrecv"}},
+	}
+	media = media.WithCodec(0, "PCMU", 8000, 1, "").WithCodec(8, "PCMA", 8000, 1, "")
+
+	sd := &sdp.SessionDescription{
+		Origin: sdp.Origin{
+			Username:       "-",
+			SessionID:      sessionID,
+			SessionVersion: sessionID,
+			NetworkType:    "IN",
+			AddressType:    "IP4",
+			UnicastAddress: localIP,
+		},
+		SessionName: "SIP Proxy Session",
+		ConnectionInformation: &sdp.ConnectionInformation{
+			NetworkType: "IN",
+			AddressType: "IP4",
+			Address:     &sdp.Address{Address: localIP},
+		},
+		TimeDescriptions:  []sdp.TimeDescription{{}},
+		MediaDescriptions: []*sdp.MediaDescription{media},
+	}
+	return sd.Marshal()
+}
+
+// ID returns the participant's unique identifier
+func (l *TransferLeg) ID() string {
+	return l.id
+}
+
+// Writer returns io.Discard: audio is written through WriteChunk
+func (l *TransferLeg) Writer() io.Writer {
+	return io.Discard
+}
+
+// AcceptedFormats returns the codec negotiated with the target
+func (l *TransferLeg) AcceptedFormats() []MediaFormat {
+	return []MediaFormat{l.format}
+}
+
+// WriteChunk sends audio to the target in 20ms RTP packets
+func (l *TransferLeg) WriteChunk(chunk *MediaChunk) error {
+	select {
+	case <-l.stop:
+		return io.ErrClosedPipe
+	default:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for offset := 0; offset < len(chunk.Data); offset += rtpSamplesPerFrame {
+		end := offset + rtpSamplesPerFrame
+		if end > len(chunk.Data) {
+			end = len(chunk.Data)
+		}
+		payloadType := uint8(0)
+		if l.codec == "PCMA" {
+			payloadType = 8
+		}
+		packet := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    payloadType,
+				SequenceNumber: l.rtpSequence,
+				Timestamp:      l.rtpTimestamp,
+				SSRC:           l.rtpSSRC,
+			},
+			Payload: chunk.Data[offset:end],
+		}
+		l.rtpSequence++
+		l.rtpTimestamp += uint32(end - offset)
+
+		rtpBytes, err := packet.Marshal()
+		if err != nil {
+			return err
+		}
+		if _, err := l.conn.WriteToUDP(rtpBytes, l.remote); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run relays the target's audio into the bridge until the leg is closed
+func (l *TransferLeg) run() {
+	buffer := make([]byte, 1500)
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := l.conn.ReadFromUDP(buffer)
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+		if !from.IP.Equal(l.remote.IP) {
+			continue
+		}
+
+		payloadType, payload, sequenceNumber, timestamp, ssrc, err := extractRTPPayload(buffer[:n])
+		if err != nil || len(payload) == 0 || payloadType != l.AcceptedFormats()[0].payloadType() {
+			continue
+		}
+		switch l.recvState.update(ssrc, sequenceNumber, timestamp, time.Now()) {
+		case rtpDuplicate, rtpProbation:
+			continue
+		}
+
+		chunk := &MediaChunk{
+			Data:      append([]byte(nil), payload...),
+			SenderID:  l.id,
+			Format:    l.format,
+			Timestamp: l.recvState.mediaTime(timestamp),
+		}
+		if err := l.session.MediaBridge.Broadcast(chunk); err != nil {
+			return
+		}
+	}
+}
+
+// Close hangs up the target and releases the leg
+func (l *TransferLeg) Close(s *SIPServer) {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+		s.byeTransferLeg(l.dialog)
+		l.conn.Close()
+	})
+}
+
+// byeTransferLeg hangs up an outbound leg unless it has already ended
+func (s *SIPServer) byeTransferLeg(dialog *sipgo.DialogClientSession) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := dialog.Bye(ctx); err != nil {
+		slog.Warn("Failed to hang up transfer leg",
+			"event", "transfer_leg_bye_error",
+			"error", err.Error())
+	}
+}
+
+// payloadType returns the static RTP payload type of a G.711 format
+func (f MediaFormat) payloadType() uint8 {
+	if f.Encoding == EncodingPCMA {
+		return 8
+	}
+	return 0
+}
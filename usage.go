@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+
+	"google.golang.org/genai"
+)
+
+// TokenUsage totals the tokens a call consumed, as reported by the model
+type TokenUsage struct {
+	PromptTokens        int64 `json:"prompt_tokens"`
+	PromptAudioTokens   int64 `json:"prompt_audio_tokens"` // Part of PromptTokens
+	ResponseTokens      int64 `json:"response_tokens"`
+	ResponseAudioTokens int64 `json:"response_audio_tokens"` // Part of ResponseTokens
+	TotalTokens         int64 `json:"total_tokens"`
+}
+
+// add adds the tokens of one usage report of the Live API
+func (u *TokenUsage) add(usage *genai.UsageMetadata) {
+	u.PromptTokens += int64(usage.PromptTokenCount)
+	u.PromptAudioTokens += audioTokens(usage.PromptTokensDetails)
+	u.ResponseTokens += int64(usage.ResponseTokenCount)
+	u.ResponseAudioTokens += audioTokens(usage.ResponseTokensDetails)
+	u.TotalTokens += int64(usage.TotalTokenCount)
+}
+
+// audioTokens returns the audio tokens of a per-modality token breakdown
+func audioTokens(details []*genai.ModalityTokenCount) int64 {
+	var tokens int64
+	for _, detail := range details {
+		if detail != nil && detail.Modality == genai.MediaModalityAudio {
+			tokens += int64(detail.TokenCount)
+		}
+	}
+	return tokens
+}
+
+// Usage metrics are labelled with at most maxUsageDIDs dialed numbers unless
+// --usage-dids lists them; the rest are counted under didOther
+const (
+	maxUsageDIDs = 100
+	didOther     = "other"
+)
+
+// didLabels bounds the did label of usage metrics, since every distinct
+// dialed number would otherwise add series that live as long as the process
+type didLabels struct {
+	allowed map[string]bool // From --usage-dids, nil to admit the first maxUsageDIDs numbers seen
+	seen    map[string]bool
+	mu      sync.Mutex
+}
+
+// newDIDLabels creates the labeller of usage metrics; dids lists the numbers
+// to label, or is empty to label the first maxUsageDIDs numbers called
+func newDIDLabels(dids []string) *didLabels {
+	d := &didLabels{seen: make(map[string]bool)}
+	if len(dids) > 0 {
+		d.allowed = make(map[string]bool, len(dids))
+		for _, did := range dids {
+			d.allowed[did] = true
+		}
+	}
+	return d
+}
+
+// label returns the did label for a dialed number: the number itself if it
+// is listed or one of the first maxUsageDIDs seen, or else didOther
+func (d *didLabels) label(did string) string {
+	if d == nil || did == "" {
+		return didOther
+	}
+	if d.allowed != nil {
+		if d.allowed[did] {
+			return did
+		}
+		return didOther
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.seen[did] {
+		return did
+	}
+	if len(d.seen) >= maxUsageDIDs {
+		return didOther
+	}
+	d.seen[did] = true
+	return did
+}
+
+// ModelPrice is what a Live model costs. Token prices are per million tokens;
+// text prices apply to the tokens that are not audio.
+type ModelPrice struct {
+	TextInput   float64 `json:"text_input"`
+	AudioInput  float64 `json:"audio_input"`
+	TextOutput  float64 `json:"text_output"`
+	AudioOutput float64 `json:"audio_output"`
+	PerMinute   float64 `json:"per_minute"` // Per minute the AI is connected to a call
+}
+
+// PriceTable prices Live models by name. The "*" entry, if any, prices models
+// that are not listed.
+type PriceTable struct {
+	Currency string                `json:"currency"`
+	Models   map[string]ModelPrice `json:"models"`
+}
+
+// CostEstimate is the estimated cost of the AI's side of a call
+type CostEstimate struct {
+	Currency   string  `json:"currency"`
+	Input      float64 `json:"input"`      // Prompt tokens
+	Output     float64 `json:"output"`     // Response tokens
+	Connection float64 `json:"connection"` // Connected time
+	Total      float64 `json:"total"`
+}
+
+// LoadPriceTable reads a price table from a JSON file
+func LoadPriceTable(path string) (*PriceTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var table PriceTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("invalid price table %s: %w", path, err)
+	}
+	if len(table.Models) == 0 {
+		return nil, fmt.Errorf("price table %s lists no models", path)
+	}
+	return &table, nil
+}
+
+// Estimate returns the cost of a call's AI usage, or nil if its model is not priced
+func (t *PriceTable) Estimate(stats AIStats) *CostEstimate {
+	if t == nil {
+		return nil
+	}
+	price, ok := t.Models[stats.Model]
+	if !ok {
+		if price, ok = t.Models["*"]; !ok {
+			return nil
+		}
+	}
+
+	usage := stats.Usage
+	perToken := func(tokens int64, perMillion float64) float64 {
+		return float64(tokens) * perMillion / 1e6
+	}
+
+	cost := &CostEstimate{
+		Currency: t.Currency,
+		Input: perToken(usage.PromptTokens-usage.PromptAudioTokens, price.TextInput) +
+			perToken(usage.PromptAudioTokens, price.AudioInput),
+		Output: perToken(usage.ResponseTokens-usage.ResponseAudioTokens, price.TextOutput) +
+			perToken(usage.ResponseAudioTokens, price.AudioOutput),
+		Connection: stats.ConnectedSeconds / 60 * price.PerMinute,
+	}
+	cost.Input = roundCost(cost.Input)
+	cost.Output = roundCost(cost.Output)
+	cost.Connection = roundCost(cost.Connection)
+	cost.Total = roundCost(cost.Input + cost.Output + cost.Connection)
+	return cost
+}
+
+// roundCost rounds to a millionth of the currency unit, dropping float noise
+func roundCost(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
+
+// accountUsage records the final AI usage and cost of an ended session and
+// exports them as metrics labelled by the dialed number and model. The log
+// line always has the dialed number; metrics may count it as didOther.
+func (s *SIPServer) accountUsage(session *Session) {
+	if session.MediaHandler == nil {
+		return
+	}
+
+	stats := session.MediaHandler.Stats()
+	session.aiStats = &stats
+	session.cost = s.config.Prices.Estimate(stats)
+
+	did := sipUser(session.To)
+	label := s.usageDIDs.label(did)
+	tokens := func(direction, modality string, n int64) {
+		if n < 0 {
+			n = 0 // A model reporting more audio than total tokens
+		}
+		metrics.Counter("sip_proxy_ai_tokens_total",
+			"Tokens consumed by the AI, by dialed number, model, direction and modality",
+			"did", label, "model", stats.Model, "direction", direction, "modality", modality).Add(float64(n))
+	}
+	tokens("prompt", "audio", stats.Usage.PromptAudioTokens)
+	tokens("prompt", "text", stats.Usage.PromptTokens-stats.Usage.PromptAudioTokens)
+	tokens("response", "audio", stats.Usage.ResponseAudioTokens)
+	tokens("response", "text", stats.Usage.ResponseTokens-stats.Usage.ResponseAudioTokens)
+
+	metrics.Counter("sip_proxy_ai_connected_seconds_total",
+		"Time the AI was connected to calls, by dialed number and model",
+		"did", label, "model", stats.Model).Add(stats.ConnectedSeconds)
+
+	attrs := []any{
+		"event", "call_usage",
+		"call_id", session.CallID,
+		"did", did,
+		"model", stats.Model,
+		"prompt_tokens", stats.Usage.PromptTokens,
+		"response_tokens", stats.Usage.ResponseTokens,
+		"connected_seconds", stats.ConnectedSeconds,
+	}
+	if session.cost != nil {
+		metrics.Counter("sip_proxy_ai_cost_total",
+			"Estimated cost of the AI, by dialed number, model and currency",
+			"did", label, "model", stats.Model, "currency", session.cost.Currency).Add(session.cost.Total)
+		attrs = append(attrs, "cost", session.cost.Total, "currency", session.cost.Currency)
+	}
+	slog.Info("Call usage accounted", attrs...)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/genai"
+)
+
+func TestPriceTableEstimate(t *testing.T) {
+	table := &PriceTable{
+		Currency: "USD",
+		Models: map[string]ModelPrice{
+			"live": {TextInput: 0.5, AudioInput: 3, TextOutput: 2, AudioOutput: 12},
+			"*":    {TextInput: 1, AudioInput: 1, TextOutput: 1, AudioOutput: 1, PerMinute: 0.01},
+		},
+	}
+	usage := TokenUsage{PromptTokens: 5120, PromptAudioTokens: 4800, ResponseTokens: 2048, ResponseAudioTokens: 1900}
+
+	tests := []struct {
+		name  string
+		table *PriceTable
+		stats AIStats
+		want  *CostEstimate
+	}{
+		{
+			name:  "text and audio tokens priced separately",
+			table: table,
+			stats: AIStats{Model: "live", Usage: usage, ConnectedSeconds: 187.4},
+			// 320*0.5 + 4800*3 = 14560 and 148*2 + 1900*12 = 23096 per million
+			want: &CostEstimate{Currency: "USD", Input: 0.01456, Output: 0.023096, Connection: 0, Total: 0.037656},
+		},
+		{
+			name:  "unlisted model uses the wildcard",
+			table: table,
+			stats: AIStats{Model: "other", Usage: TokenUsage{PromptTokens: 1e6, ResponseTokens: 1e6}, ConnectedSeconds: 90},
+			want:  &CostEstimate{Currency: "USD", Input: 1, Output: 1, Connection: 0.015, Total: 2.015},
+		},
+		{
+			name:  "no usage",
+			table: table,
+			stats: AIStats{Model: "live"},
+			want:  &CostEstimate{Currency: "USD"},
+		},
+		{
+			name:  "unpriced model",
+			table: &PriceTable{Models: map[string]ModelPrice{"live": {}}},
+			stats: AIStats{Model: "other", Usage: usage},
+		},
+		{
+			name:  "no price table",
+			stats: AIStats{Model: "live", Usage: usage},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.table.Estimate(test.stats)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Fatalf("Estimate = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenUsageAdd(t *testing.T) {
+	var usage TokenUsage
+	for i := 0; i < 2; i++ {
+		usage.add(&genai.UsageMetadata{
+			PromptTokenCount:   100,
+			ResponseTokenCount: 50,
+			TotalTokenCount:    150,
+			PromptTokensDetails: []*genai.ModalityTokenCount{
+				{Modality: genai.MediaModalityAudio, TokenCount: 80},
+				{Modality: genai.MediaModalityText, TokenCount: 20},
+				nil,
+			},
+			ResponseTokensDetails: []*genai.ModalityTokenCount{{Modality: genai.MediaModalityAudio, TokenCount: 45}},
+		})
+	}
+
+	want := TokenUsage{PromptTokens: 200, PromptAudioTokens: 160, ResponseTokens: 100, ResponseAudioTokens: 90, TotalTokens: 300}
+	if usage != want {
+		t.Fatalf("usage %+v, want %+v", usage, want)
+	}
+}
+
+func TestDIDLabels(t *testing.T) {
+	listed := newDIDLabels([]string{"+15551234567"})
+	for did, want := range map[string]string{"+15551234567": "+15551234567", "+15550000000": didOther, "": didOther} {
+		if got := listed.label(did); got != want {
+			t.Errorf("listed label(%q) = %q, want %q", did, got, want)
+		}
+	}
+
+	capped := newDIDLabels(nil)
+	for i := 0; i < maxUsageDIDs; i++ {
+		did := fmt.Sprintf("+1555%07d", i)
+		if got := capped.label(did); got != did {
+			t.Fatalf("label(%q) = %q within the cap", did, got)
+		}
+	}
+	if got := capped.label("+15559999999"); got != didOther {
+		t.Fatalf("label beyond the cap = %q, want %q", got, didOther)
+	}
+	if got := capped.label("+15550000000"); got != "+15550000000" {
+		t.Fatalf("number seen before the cap relabelled as %q", got)
+	}
+
+	var unset *didLabels
+	if got := unset.label("+15551234567"); got != didOther {
+		t.Fatalf("nil labeller returned %q", got)
+	}
+}
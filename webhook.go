@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// CallEndedPayload represents the data sent to the end-of-call webhook
+type CallEndedPayload struct {
+	CallID           string                    `json:"call_id"`
+	From             string                    `json:"from"`
+	To               string                    `json:"to"`
+	EndReason        string                    `json:"end_reason"`
+	StartedAt        time.Time                 `json:"started_at"`
+	EndedAt          time.Time                 `json:"ended_at"`
+	DurationSeconds  float64                   `json:"duration_seconds"`
+	Codec            string                    `json:"codec,omitempty"` // Negotiated with the caller: PCMU or PCMA
+	Interruptions    int                       `json:"interruptions"`   // Times the caller cut the AI off
+	Model            string                    `json:"model,omitempty"`
+	Usage            *TokenUsage               `json:"usage,omitempty"`
+	ConnectedSeconds float64                   `json:"connected_seconds"` // How long the AI was connected
+	Cost             *CostEstimate             `json:"cost,omitempty"`    // Requires a price for the model in --price-table
+	Transcript       []TranscriptTurn          `json:"transcript"`
+	Extracted        map[string]ExtractedValue `json:"extracted,omitempty"` // Latest value of each extractor
+}
+
+// notifyCallEnded posts the end-of-call record to the configured webhook URL
+func (s *SIPServer) notifyCallEnded(session *Session) {
+	if session.endCallWebhookURL == "" {
+		return
+	}
+
+	payload := CallEndedPayload{
+		CallID:          session.CallID,
+		From:            session.From,
+		To:              session.To,
+		EndReason:       session.EndReason,
+		StartedAt:       session.CreatedAt,
+		EndedAt:         session.EndedAt,
+		DurationSeconds: session.EndedAt.Sub(session.CreatedAt).Seconds(),
+		Codec:           session.selectedCodec,
+		Transcript:      []TranscriptTurn{},
+	}
+	if session.MediaHandler != nil {
+		payload.Interruptions = session.MediaHandler.Stats().Interruptions
+		payload.Transcript = session.MediaHandler.Transcript().Turns()
+	}
+	if session.aiStats != nil {
+		// Accounted when the session ended, see accountUsage
+		payload.Model = session.aiStats.Model
+		payload.Usage = &session.aiStats.Usage
+		payload.ConnectedSeconds = session.aiStats.ConnectedSeconds
+		payload.Cost = session.cost
+	}
+	if session.extraction != nil {
+		payload.Extracted = session.extraction.Values()
+	}
+
+	if err := s.postWebhook(session.endCallWebhookURL, payload); err != nil {
+		slog.Error("End-of-call webhook failed",
+			"event", "end_call_webhook_failed",
+			"call_id", session.CallID,
+			"error", err.Error())
+		return
+	}
+
+	slog.Info("End-of-call webhook sent",
+		"event", "end_call_webhook_sent",
+		"call_id", session.CallID,
+		"end_reason", session.EndReason,
+		"transcript_turns", len(payload.Transcript))
+}
+
+// postWebhook sends a JSON payload to a webhook URL and checks for a 2xx response
+func (s *SIPServer) postWebhook(url string, payload interface{}) error {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	resp, err := s.httpClient.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
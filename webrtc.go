@@ -0,0 +1,521 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	// webrtcSampleRate is the rate Opus audio is encoded and decoded at
+	webrtcSampleRate = 48000
+	// webrtcMaxBacklog bounds how much audio may wait to be sent to a browser
+	webrtcMaxBacklog = 10 * time.Second
+	// opusMaxPacketBytes is the largest Opus packet (RFC 6716)
+	opusMaxPacketBytes = 1275
+	// opusMaxFrameSamples is the longest Opus frame (120ms at 48kHz)
+	opusMaxFrameSamples = 5760
+	// webrtcGatherTimeout bounds ICE candidate gathering before answering
+	webrtcGatherTimeout = 5 * time.Second
+)
+
+// WebRTCConfig configures browser participants
+type WebRTCConfig struct {
+	ICEServers []string // STUN/TURN URLs used when gathering candidates
+	PublicIP   string   // Advertised in host candidates when behind 1:1 NAT, empty to use interface addresses
+}
+
+// WebRTCGateway creates WebRTC participants for browser softphones and
+// supervisors. Signaling is a single HTTP offer/answer exchange: the browser
+// posts its offer and receives an answer with all candidates gathered.
+type WebRTCGateway struct {
+	api    *webrtc.API
+	config WebRTCConfig
+}
+
+// NewWebRTCGateway creates a gateway that negotiates Opus audio only
+func NewWebRTCGateway(config WebRTCConfig) (*WebRTCGateway, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   webrtcSampleRate,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register Opus: %w", err)
+	}
+
+	settingEngine := webrtc.SettingEngine{}
+	if config.PublicIP != "" {
+		settingEngine.SetNAT1To1IPs([]string{config.PublicIP}, webrtc.ICECandidateTypeHost)
+	}
+
+	return &WebRTCGateway{
+		api: webrtc.NewAPI(
+			webrtc.WithMediaEngine(mediaEngine),
+			webrtc.WithSettingEngine(settingEngine),
+		),
+		config: config,
+	}, nil
+}
+
+// errBridgeNotMixing refuses WebRTC joins to calls with a forward bridge
+var errBridgeNotMixing = errors.New("joining the call requires its bridge_mode to be mix")
+
+// Join answers a browser's SDP offer and adds it to the session's media bridge
+// in the given role. It returns the participant and the SDP answer.
+//
+// The call must use a mixing bridge. A forward bridge passes every sender's
+// chunks through as they come, so a third participant's audio would be
+// interleaved with the other side's in the caller's RTP stream and the AI's
+// input, doubling their rate, and a listener would hear the caller queued
+// behind the AI's bursts.
+func (g *WebRTCGateway) Join(session *Session, offer string, role SupervisorRole) (*WebRTCParticipant, string, error) {
+	role, err := role.normalize()
+	if err != nil {
+		return nil, "", err
+	}
+	if _, mixing := session.MediaBridge.(*MixingMediaBridge); !mixing {
+		return nil, "", errBridgeNotMixing
+	}
+
+	configuration := webrtc.Configuration{}
+	if len(g.config.ICEServers) > 0 {
+		configuration.ICEServers = []webrtc.ICEServer{{URLs: g.config.ICEServers}}
+	}
+
+	pc, err := g.api.NewPeerConnection(configuration)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create peer connection: %w", err)
+	}
+
+	participant, err := newWebRTCParticipant(fmt.Sprintf("webrtc-%08x", rand.Uint32()), session, pc)
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+
+	// Route the participant's audio before it can send any
+	participant.role = role
+	session.MediaBridge.SetAudience(participant.id, role.audience(session))
+
+	answer, err := participant.negotiate(offer)
+	if err != nil {
+		participant.Close()
+		return nil, "", err
+	}
+
+	if err := session.MediaBridge.AddParticipant(participant); err != nil {
+		participant.Close()
+		return nil, "", fmt.Errorf("failed to join media bridge: %w", err)
+	}
+	session.addWebRTCParticipant(participant)
+	participant.start()
+
+	slog.Info("WebRTC participant joined",
+		"event", "webrtc_join",
+		"session", session.CallID,
+		"participant", participant.id,
+		"role", role.String())
+
+	return participant, answer, nil
+}
+
+// WebRTCParticipant is a browser in a session's media bridge. What it hears
+// is encoded to Opus and paced out on a 20ms clock; what it sends is decoded
+// and broadcast to the other participants.
+type WebRTCParticipant struct {
+	id         string
+	session    *Session
+	pc         *webrtc.PeerConnection
+	track      *webrtc.TrackLocalStaticSample
+	encoder    *opus.Encoder
+	pending    []byte // PCM waiting to be sent, guarded by mu
+	maxPending int
+	role       SupervisorRole // Guarded by mu
+	closed     bool
+	stop       chan struct{}
+	closeOnce  sync.Once
+	wg         sync.WaitGroup
+	mu         sync.Mutex
+}
+
+// newWebRTCParticipant creates a participant on a new peer connection
+func newWebRTCParticipant(id string, session *Session, pc *webrtc.PeerConnection) (*WebRTCParticipant, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeOpus,
+		ClockRate: webrtcSampleRate,
+		Channels:  2,
+	}, "audio", "sip-proxy-"+session.CallID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audio track: %w", err)
+	}
+
+	encoder, err := opus.NewEncoder(webrtcSampleRate, 1, opus.AppVoIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Opus encoder: %w", err)
+	}
+
+	p := &WebRTCParticipant{
+		id:         id,
+		session:    session,
+		pc:         pc,
+		track:      track,
+		encoder:    encoder,
+		maxPending: webrtcSampleRate * 2 * int(webrtcMaxBacklog/time.Second),
+		stop:       make(chan struct{}),
+	}
+
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add audio track: %w", err)
+	}
+
+	// Drain RTCP for the sender; the reports themselves are not used
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeAudio {
+			return
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.receive(track)
+		}()
+	})
+
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		slog.Info("WebRTC connection state changed",
+			"event", "webrtc_state",
+			"session", session.CallID,
+			"participant", id,
+			"state", state.String())
+
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			go p.Close()
+		}
+	})
+
+	return p, nil
+}
+
+// negotiate applies the browser's offer and returns the answer once candidate
+// gathering has finished (there is no trickle ICE)
+func (p *WebRTCParticipant) negotiate(offer string) (string, error) {
+	err := p.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	})
+	if err != nil {
+		return "", fmt.Errorf("invalid offer: %w", err)
+	}
+
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create answer: %w", err)
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(p.pc)
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(webrtcGatherTimeout):
+		slog.Warn("ICE gathering timed out, answering with candidates so far",
+			"event", "webrtc_gather_timeout",
+			"session", p.session.CallID,
+			"participant", p.id)
+	}
+
+	return p.pc.LocalDescription().SDP, nil
+}
+
+// start begins sending audio to the browser
+func (p *WebRTCParticipant) start() {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.send()
+	}()
+}
+
+// ID returns the participant's unique identifier
+func (p *WebRTCParticipant) ID() string {
+	return p.id
+}
+
+// Writer returns the writer for audio the browser should hear
+func (p *WebRTCParticipant) Writer() io.Writer {
+	return p
+}
+
+// AcceptedFormats returns Opus's native rate, so the bridge resamples once
+func (p *WebRTCParticipant) AcceptedFormats() []MediaFormat {
+	return []MediaFormat{PCM16Format(webrtcSampleRate)}
+}
+
+// Write queues 48kHz PCM for the browser. The oldest audio is dropped if the
+// browser falls too far behind.
+func (p *WebRTCParticipant) Write(pcmData []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	p.pending = append(p.pending, pcmData...)
+	if excess := len(p.pending) - p.maxPending; excess > 0 {
+		excess += excess % 2
+		p.pending = p.pending[excess:]
+	}
+	return len(pcmData), nil
+}
+
+// FlushQueue implements QueueFlusher: audio not yet sent is dropped when the
+// AI is interrupted, as for the caller
+func (p *WebRTCParticipant) FlushQueue() {
+	p.mu.Lock()
+	p.pending = nil
+	p.mu.Unlock()
+}
+
+// send encodes one 20ms frame per tick, silence when nothing is queued, so
+// that the browser's jitter buffer sees a continuous stream
+func (p *WebRTCParticipant) send() {
+	frameSamples := webrtcSampleRate * int(rtpFrameDuration/time.Millisecond) / 1000
+	frameBytes := frameSamples * 2
+	samples := make([]int16, frameSamples)
+	packet := make([]byte, opusMaxPacketBytes)
+
+	ticker := time.NewTicker(rtpFrameDuration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		n := len(p.pending)
+		if n > frameBytes {
+			n = frameBytes
+		}
+		for i := range samples {
+			samples[i] = 0
+		}
+		copy(samples, pcmToSamples(p.pending[:n]))
+		p.pending = p.pending[n:]
+		if len(p.pending) == 0 {
+			p.pending = nil
+		}
+		p.mu.Unlock()
+
+		size, err := p.encoder.Encode(samples, packet)
+		if err != nil {
+			slog.Error("Failed to encode Opus frame",
+				"event", "webrtc_encode_error",
+				"participant", p.id,
+				"error", err.Error())
+			continue
+		}
+
+		err = p.track.WriteSample(media.Sample{Data: packet[:size], Duration: rtpFrameDuration})
+		if err != nil && err != io.ErrClosedPipe {
+			slog.Error("Failed to send Opus frame",
+				"event", "webrtc_send_error",
+				"participant", p.id,
+				"error", err.Error())
+		}
+	}
+}
+
+// receive decodes the browser's audio and broadcasts it into the bridge
+func (p *WebRTCParticipant) receive(track *webrtc.TrackRemote) {
+	decoder, err := opus.NewDecoder(webrtcSampleRate, 1)
+	if err != nil {
+		slog.Error("Failed to create Opus decoder",
+			"event", "webrtc_decode_error",
+			"participant", p.id,
+			"error", err.Error())
+		return
+	}
+
+	slog.Info("Receiving WebRTC audio",
+		"event", "webrtc_track",
+		"session", p.session.CallID,
+		"participant", p.id,
+		"codec", track.Codec().MimeType)
+
+	samples := make([]int16, opusMaxFrameSamples)
+	var baseTimestamp uint32
+	first := true
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		if len(packet.Payload) == 0 {
+			continue
+		}
+		if first {
+			baseTimestamp = packet.Timestamp
+			first = false
+		}
+
+		n, err := decoder.Decode(packet.Payload, samples)
+		if err != nil {
+			slog.Warn("Failed to decode Opus packet",
+				"event", "webrtc_decode_error",
+				"participant", p.id,
+				"error", err.Error())
+			continue
+		}
+
+		pcmData := make([]byte, n*2)
+		samplesToPCM(samples[:n], pcmData)
+
+		err = p.session.MediaBridge.Broadcast(&MediaChunk{
+			Data:      pcmData,
+			SenderID:  p.id,
+			Format:    PCM16Format(webrtcSampleRate),
+			Timestamp: time.Duration(packet.Timestamp-baseTimestamp) * time.Second / webrtcSampleRate,
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Role returns the participant's current role
+func (p *WebRTCParticipant) Role() SupervisorRole {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.role
+}
+
+// SetRole switches the participant's role without renegotiating: only who
+// hears its audio changes
+func (p *WebRTCParticipant) SetRole(role SupervisorRole) (SupervisorRole, error) {
+	role, err := role.normalize()
+	if err != nil {
+		return role, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return role, io.ErrClosedPipe
+	}
+	if err := p.session.MediaBridge.SetAudience(p.id, role.audience(p.session)); err != nil {
+		return role, err
+	}
+	previous := p.role
+	p.role = role
+
+	slog.Info("Supervisor role changed",
+		"event", "supervisor_role",
+		"session", p.session.CallID,
+		"participant", p.id,
+		"from", previous.String(),
+		"to", role.String())
+
+	return role, nil
+}
+
+// Close leaves the bridge and closes the peer connection
+func (p *WebRTCParticipant) Close() {
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		p.closed = true
+		p.pending = nil
+		p.mu.Unlock()
+
+		close(p.stop)
+		p.session.MediaBridge.RemoveParticipant(p.id)
+		p.session.removeWebRTCParticipant(p.id)
+
+		if err := p.pc.Close(); err != nil {
+			slog.Warn("Failed to close peer connection",
+				"event", "webrtc_close_error",
+				"participant", p.id,
+				"error", err.Error())
+		}
+		p.wg.Wait()
+
+		slog.Info("WebRTC participant left",
+			"event", "webrtc_leave",
+			"session", p.session.CallID,
+			"participant", p.id)
+	})
+}
+
+// addWebRTCParticipant tracks a browser participant so it is closed with the session
+func (s *Session) addWebRTCParticipant(participant *WebRTCParticipant) {
+	s.webrtcMux.Lock()
+	defer s.webrtcMux.Unlock()
+
+	if s.webrtcParticipants == nil {
+		s.webrtcParticipants = make(map[string]*WebRTCParticipant)
+	}
+	s.webrtcParticipants[participant.id] = participant
+}
+
+// removeWebRTCParticipant stops tracking a browser participant
+func (s *Session) removeWebRTCParticipant(id string) {
+	s.webrtcMux.Lock()
+	defer s.webrtcMux.Unlock()
+
+	delete(s.webrtcParticipants, id)
+}
+
+// webrtcParticipant returns a browser participant by ID, or nil
+func (s *Session) webrtcParticipant(id string) *WebRTCParticipant {
+	s.webrtcMux.Lock()
+	defer s.webrtcMux.Unlock()
+
+	return s.webrtcParticipants[id]
+}
+
+// closeWebRTCParticipants disconnects every browser participant
+func (s *Session) closeWebRTCParticipants() {
+	s.webrtcMux.Lock()
+	participants := make([]*WebRTCParticipant, 0, len(s.webrtcParticipants))
+	for _, participant := range s.webrtcParticipants {
+		participants = append(participants, participant)
+	}
+	s.webrtcMux.Unlock()
+
+	for _, participant := range participants {
+		participant.Close()
+	}
+}